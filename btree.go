@@ -2,21 +2,73 @@ package main
 
 import (
 	"fmt"
-	"os"
 
 	"github.com/pkg/errors"
 )
 
-// TODO: Have a external buffer system, where any new page read is placed and then, when all operation for that page are completed, that pgae is updated to the disk
-// This ^ will allow to, not have to re-read the same page from the disk, just for the sake for an updated copy in the memory, which we currently are doing a lot.
+// Re-reading the same page over and over (for an updated copy of it) is cheap, since pages are cached in the buffer pool (see buffer_pool.go)
 
 // SEARCH OPERATION
 
-func Search(key uint32, root_id uint32, file_header *FileHeaderPage, file *os.File) ([]byte, bool, error) {
+func Get(key uint32, file_header *FileHeaderPage, file *DBFile) ([]byte, bool, error) {
+	// Same as Search from the root, but the root is read under the root latch so that it is safe to call alongside Insert and Delete
+	file.lock.RLock()
+	defer file.lock.RUnlock()
+
+	if file.pool == nil {
+		// Straight over the raw pages, without decoding them (see page_view.go)
+		return view_get(key, nil, file_header, file)
+	}
+	if is_blink(file_header) {
+		return blink_get(key, file_header, file)
+	}
+	if is_bplus(file_header) {
+		return bplus_get(key, file_header, file)
+	}
+	return get_helper(key, file_header, file)
+}
+
+func get_helper(key uint32, file_header *FileHeaderPage, file *DBFile) ([]byte, bool, error) {
+
+	file.root_latch.RLock()
+	root_id := file_header.Root_node_id
+	if root_id != 0 {
+		get_page_latch(file, root_id).RLock()
+	}
+	file.root_latch.RUnlock()
+
+	return search_helper(key, root_id, file_header, file)
+}
+
+func Search(key uint32, root_id uint32, file_header *FileHeaderPage, file *DBFile) ([]byte, bool, error) {
+	file.lock.RLock()
+	defer file.lock.RUnlock()
+
+	if is_blink(file_header) {
+		return blink_search(key, root_id, file_header, file)
+	}
+	if is_bplus(file_header) {
+		return bplus_search(key, root_id, file_header, file)
+	}
+	if root_id != 0 {
+		get_page_latch(file, root_id).RLock()
+	}
+	return search_helper(key, root_id, file_header, file)
+}
+
+func search_helper(key uint32, root_id uint32, file_header *FileHeaderPage, file *DBFile) ([]byte, bool, error) {
+	// The caller has latched `root_id` in read mode, the latch is let go of here (once the child below is latched)
 
 	if root_id == 0 {
 		return nil, false, nil
 	}
+	root_latch := get_page_latch(file, root_id)
+	latched := true
+	defer func() {
+		if latched {
+			root_latch.RUnlock()
+		}
+	}()
 
 	pt, _, np, _, err := ReadPage(file, root_id)
 	if err != nil {
@@ -30,19 +82,22 @@ func Search(key uint32, root_id uint32, file_header *FileHeaderPage, file *os.Fi
 	ind, inArr := binary_index_node(np.Blocks[:np.Block_size], 0, int(np.Block_size), key)
 	if !inArr || ind >= int(np.Block_size) {
 		if ind < int(np.Block_size)+1 {
-			return Search(key, np.Children[ind], file_header, file)
+			// Crab down, the child is latched before letting go of this node
+			if np.Children[ind] != 0 {
+				get_page_latch(file, np.Children[ind]).RLock()
+			}
+			root_latch.RUnlock()
+			latched = false
+			return search_helper(key, np.Children[ind], file_header, file)
 		} else {
 			return nil, false, errors.New(fmt.Sprintf("got index of key in nodepage to be %v which is more than even the number of children of the node %v", ind, np.Block_size+1))
 		}
 	}
 
-	data, found, err := Read_from_NodePage(root_id, key, file_header, file)
+	// Straight from the node already read, inline values need nothing more
+	data, err := read_node_value(np, ind, file_header, file)
 	if err != nil {
-		// TODO: This is where the error is occuring, data is literally not there where the offset leads to
-		return nil, false, errors.Wrap(err, fmt.Sprintf("error while trying to retrieve key %v data from the nodepage %v", key, np.Data_page_id))
-	}
-	if !found {
-		return nil, false, errors.Wrap(err, fmt.Sprintf("error while trying to retrieve key %v data from the datapage %v", key, np.Data_page_id))
+		return nil, false, errors.Wrap(err, fmt.Sprintf("error while trying to retrieve key %v data from the nodepage %v", key, root_id))
 	}
 
 	return data, true, nil
@@ -50,12 +105,30 @@ func Search(key uint32, root_id uint32, file_header *FileHeaderPage, file *os.Fi
 
 // INSERT OPERATION
 
-func split(node_id uint32, file_header *FileHeaderPage, file *os.File) (uint32, []byte, uint32, error) {
+func split_index(max_degree int, appending bool, file *DBFile) int {
+	// Where a full node is cut in two. When keys come in increasing order (appending, see insert_helper) a node never
+	// gets another key below its last one once it is split, so it keeps as much as the fill factor lets it (everything
+	// it can by default) and only the last keys go to the new node. Otherwise both halves get the same room to grow
+	if appending {
+		kept := (max_degree - 1) * file.fill.fill_factor / 100
+		if kept > max_degree-2 {
+			kept = max_degree - 2
+		}
+		if kept < max_degree/2 {
+			kept = max_degree / 2
+		}
+		return kept
+	}
+	return max_degree / 2
+}
+
+func split(node_id uint32, mid int, file_header *FileHeaderPage, file *DBFile) (uint32, []byte, uint32, error) {
 	/*
 		INPUT:
-			1. node_id: page id of the node which is needs to be split (IMP: This node's Block_size == MAX_DEGREE)
-			2. file_header
-			3. file
+			1. node_id: page id of the node which is needs to be split (IMP: This node's Block_size == max_degree)
+			2. mid: index of the key going up, the keys before it stay in the node (see split_index)
+			3. file_header
+			4. file
 		OUTPUT:
 			1. uint32 [push_to_top_key]  => the key of the data which needs to be pushed up
 			2. []byte [push_to_top_data] =>, associated data
@@ -71,17 +144,27 @@ func split(node_id uint32, file_header *FileHeaderPage, file *os.File) (uint32,
 		return 0, nil, 0, errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node_id, pt))
 	}
 
-	if node.Block_size < uint16(MAX_DEGREE) {
+	max_degree := node_max_degree(node)
+	if int(node.Block_size) < max_degree {
 		return 0, nil, 0, errors.New(fmt.Sprintf("read nodepage %v isn't full (block_size = %v), and so doesn't need splitting", node_id, node.Block_size))
 	}
+	if mid < 1 || mid > max_degree-2 {
+		return 0, nil, 0, errors.New(fmt.Sprintf("cannot split the nodepage %v at %v, both halves need at least one key", node_id, mid))
+	}
+
+	// The middle key is going up
+	blink_keys_moving(file_header, file)
 
-	var mid uint32
 	var new_node *NodePage
 	var new_node_id uint32
 	var i uint32 = 0
 
-	// Make a new NodePage
-	new_node_id, err = MakeNewPage(Page_type_ids["Node"], file_header, file)
+	// Make a new NodePage (of the same kind)
+	if node.Keys_only != 0 {
+		new_node_id, err = make_keys_only_node_page(file_header, file)
+	} else {
+		new_node_id, err = MakeNewPage(Page_type_ids["Node"], file_header, file)
+	}
 	if err != nil {
 		return 0, nil, 0, err
 	}
@@ -95,7 +178,6 @@ func split(node_id uint32, file_header *FileHeaderPage, file *os.File) (uint32,
 	}
 
 	// Save the mid value which will be pushed to the top layers
-	mid = uint32(MAX_DEGREE) / 2
 	push_to_top_key := node.Blocks[mid].Key
 	push_to_top_data, data_found, err := Read_from_NodePage(node_id, push_to_top_key, file_header, file)
 	if err != nil {
@@ -106,7 +188,7 @@ func split(node_id uint32, file_header *FileHeaderPage, file *os.File) (uint32,
 	}
 
 	// Move the later half of node to the new_node [BLOCKS]
-	for i = mid + 1; i < uint32(MAX_DEGREE); i++ {
+	for i = uint32(mid) + 1; i < uint32(max_degree); i++ {
 		data, foundKey, err := Read_from_NodePage(node_id, node.Blocks[i].Key, file_header, file)
 		if err != nil {
 			return 0, nil, 0, errors.Wrap(err, fmt.Sprintf("couldn't read the data of key %v from the nodepage %v", node.Blocks[i].Key, node_id))
@@ -141,13 +223,14 @@ func split(node_id uint32, file_header *FileHeaderPage, file *os.File) (uint32,
 	}
 	new_node.Children[0] = node.Children[mid+1]
 	node.Children[mid+1] = 0
+	blink_link_split(node, new_node, new_node_id, push_to_top_key, file_header)
 
-	// Save the node and the new_node
-	err = SavePage(node_id, Data_to_Bytes(node), file_header, file)
+	// Save the new_node and the node (in this order, so that the new_node is complete before anything points to it)
+	err = SavePage(new_node_id, Data_to_Bytes(new_node), file_header, file)
 	if err != nil {
 		return 0, nil, 0, err
 	}
-	err = SavePage(new_node_id, Data_to_Bytes(new_node), file_header, file)
+	err = SavePage(node_id, Data_to_Bytes(node), file_header, file)
 	if err != nil {
 		return 0, nil, 0, err
 	}
@@ -166,110 +249,124 @@ func split(node_id uint32, file_header *FileHeaderPage, file *os.File) (uint32,
 	return push_to_top_key, push_to_top_data, new_node_id, nil
 }
 
-func insert_helper(node_id uint32, key uint32, data []byte, file_header *FileHeaderPage, file *os.File) (uint32, bool, uint32, []byte, uint32, error) {
+func insert_helper(node_id uint32, key uint32, data []byte, rightmost bool, path *latch_path, file_header *FileHeaderPage, file *DBFile) (bool, bool, error) {
 	/*
 		INPUT:
 			1. Current root of the B-Tree
 			2. `key` integer to insert in the B-Tree
 			3. `data` associated data with the key
+			4. `rightmost` the node is the last one on its level (every key after it is in no other node)
 		OUTPUT:
-			1. uint32 [new_root_id] => The new root of the B-Tree
-			2. bool [is_overflow] => True, if overflow occured while inserting in the B-Tree, (signalling splitting has occured)
-			3. uint32 [pushed_from_bottom_key] => The integer which the current needs to accomodate since the lower layers are full.
-			4. []byte [pushed_from_bottom_data] => Associated with the data
-			5. uint32 [new_node_id] => New right node created from splitting at bottom level (This needs to be adjusted in the current node)
-			6. error
+			1. bool [is_full] => True, if the node now has max_degree keys and the caller has to make room in it (see make_room_in_child)
+			2. bool [appending] => True, if the key (or the one pushed up from below) went to the end of a rightmost node
+			3. error
+		`node_id` must already be latched in `path`
 	*/
 
 	pt, _, node, _, err := ReadPage(file, node_id)
 	if err != nil {
-		return 0, false, 0, nil, 0, err
+		return false, false, err
 	}
 	if pt != Page_type_ids["Node"] {
-		return 0, false, 0, nil, 0, errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node_id, pt))
+		return false, false, errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node_id, pt))
+	}
+
+	// This node will not split, so nothing above it will be touched by this insert anymore
+	if node_safe_for_insert(node, file) {
+		path.release_above(node_id)
 	}
 
 	// Check if there are any children
 	if node.Children[0] == 0 { // In a B-Tree there will either be children for all blocks or for none, since a B-Tree is always balanced
 		// This is the leaf node
-		_, inArr := binary_index_node(node.Blocks[:node.Block_size], 0, int(node.Block_size), key)
+		ind, inArr := binary_index_node(node.Blocks[:node.Block_size], 0, int(node.Block_size), key)
 		if inArr {
-			return node_id, false, 0, nil, 0, nil
+			return false, false, nil
 		}
+		appending := rightmost && ind == int(node.Block_size)
 
 		err = Put_in_NodePage(node_id, key, data, 0, false, file_header, file) // Will also update the `node *NodePage`
 		if err != nil {
-			return 0, false, 0, nil, 0, err
+			return false, false, err
 		}
 
 		// Read the node again, since its updated now...
 		pt, _, node, _, err = ReadPage(file, node_id)
 		if err != nil {
-			return 0, false, 0, nil, 0, err
+			return false, false, err
 		}
 		if pt != Page_type_ids["Node"] {
-			return 0, false, 0, nil, 0, errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node_id, pt))
-		}
-
-		if int(node.Block_size) == MAX_DEGREE {
-			// Overflow has occured in the node, so the node needs to be split
-			push_to_top_key, push_to_top_data, new_node_id, err := split(node_id, file_header, file)
-			if err != nil {
-				return node_id, true, push_to_top_key, push_to_top_data, new_node_id, errors.Wrap(err, fmt.Sprintf("error while trying to split the nodepage %v", node_id))
-			}
-			return node_id, true, push_to_top_key, push_to_top_data, new_node_id, nil
+			return false, false, errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node_id, pt))
 		}
 
-		return node_id, false, 0, nil, 0, nil
+		return int(node.Block_size) == node_max_degree(node), appending, nil
 	}
 
 	// Now, we need to find the correct child to do recursion on
 	ind, inArr := binary_index_node(node.Blocks[:node.Block_size], 0, int(node.Block_size), key)
 	if inArr {
-		return node_id, false, 0, nil, 0, nil
+		return false, false, nil
 	}
+	// The key pushed up from the child (if it splits) goes in at `ind` as well
+	appending := rightmost && ind == int(node.Block_size)
 
-	_, is_overflow, pushed_from_bottom_key, pushed_from_bottom_data, new_node_id, err := insert_helper(node.Children[ind], key, data, file_header, file)
+	path.hold(node.Children[ind])
+	child_is_full, child_appending, err := insert_helper(node.Children[ind], key, data, appending, path, file_header, file)
 	if err != nil {
-		return node_id, false, 0, nil, 0, errors.Wrap(err, fmt.Sprintf("error while trying to find the child node to put key %v in", key))
+		return false, false, errors.Wrap(err, fmt.Sprintf("error while trying to find the child node to put key %v in", key))
 	}
 
-	if !is_overflow {
-		return node_id, false, 0, nil, 0, nil
+	if !child_is_full {
+		return false, false, nil
 	}
 
-	err = Put_in_NodePage(node_id, pushed_from_bottom_key, pushed_from_bottom_data, new_node_id, false, file_header, file) // Will also update the `node *NodePage`
+	// Overflow has occured in the child, so keys have to go to its siblings, or the child needs to be split
+	err = make_room_in_child(node_id, ind, child_appending, path, file_header, file)
 	if err != nil {
-		return 0, false, 0, nil, 0, err
+		return false, false, errors.Wrap(err, fmt.Sprintf("error while trying to make room in the child %v of the nodepage %v", ind, node_id))
 	}
 
 	// Read the node again, since its updated now...
 	pt, _, node, _, err = ReadPage(file, node_id)
 	if err != nil {
-		return 0, false, 0, nil, 0, err
+		return false, false, err
 	}
 	if pt != Page_type_ids["Node"] {
-		return 0, false, 0, nil, 0, errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node_id, pt))
+		return false, false, errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node_id, pt))
 	}
 
-	if int(node.Block_size) == MAX_DEGREE {
-		// Overflow has occured in the node, so the node needs to be split
-		push_to_top_key, push_to_top_data, new_node_id, err := split(node_id, file_header, file)
-		if err != nil {
-			return node_id, true, push_to_top_key, push_to_top_data, new_node_id, errors.Wrap(err, fmt.Sprintf("error while trying to split the nodepage %v", node_id))
-		}
-		return node_id, true, push_to_top_key, push_to_top_data, new_node_id, nil
+	return int(node.Block_size) == node_max_degree(node), appending, nil
+}
+
+func Insert(key uint32, data []byte, file_header *FileHeaderPage, file *DBFile) error {
+
+	if file.Read_only {
+		return errors.Wrap(ErrReadOnly, fmt.Sprintf("cannot insert the key %v", key))
 	}
 
-	return node_id, false, 0, nil, 0, nil
-}
+	file.lock.RLock()
+	path := latch_path{file: file}
+	var err error
+	if is_bplus(file_header) {
+		err = bplus_insert_from_root(key, data, &path, file_header, file)
+	} else {
+		err = insert_from_root(key, data, &path, file_header, file)
+	}
+	path.release_all()
+	file.lock.RUnlock()
+	if err != nil {
+		return err
+	}
 
-func Insert(key uint32, data []byte, file_header *FileHeaderPage, file *os.File) error {
+	return nil
+}
 
-	earlier_value := file_header.Total_data_size
+func insert_from_root(key uint32, data []byte, path *latch_path, file_header *FileHeaderPage, file *DBFile) error {
 
 	var err error
 
+	// The root latch is held till the root node turns out to be safe, since splitting the root changes Root_node_id
+	path.hold_root()
 	if file_header.Root_node_id == 0 {
 		file_header.Root_node_id, err = MakeNewPage(Page_type_ids["Node"], file_header, file)
 		if err != nil {
@@ -277,17 +374,31 @@ func Insert(key uint32, data []byte, file_header *FileHeaderPage, file *os.File)
 		}
 	}
 
-	_, is_overflow, pushed_from_bottom_key, pushed_from_bottom_data, new_node_id, err := insert_helper(file_header.Root_node_id, key, data, file_header, file)
+	path.hold(file_header.Root_node_id)
+	is_full, appending, err := insert_helper(file_header.Root_node_id, key, data, true, path, file_header, file)
 	if err != nil {
 		return errors.Wrap(err, fmt.Sprintf("error while trying to find the child node to put key %v in", key))
 	}
 
-	if !is_overflow {
-		file_header.Total_data_size = earlier_value + uint64(len(data))
+	if !is_full {
+		add_to_total_data_size(int64(len(data)), file_header, file)
 		return nil
 	}
 
-	// There is an overflow for the exsting root node of the B-Tree, so make a new NodePage which will our new root of the B-tree
+	// The root has no siblings to hand keys to, so it is split
+	pt, _, root_node, _, err := ReadPage(file, file_header.Root_node_id)
+	if err != nil {
+		return err
+	}
+	if pt != Page_type_ids["Node"] {
+		return errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", file_header.Root_node_id, pt))
+	}
+	pushed_from_bottom_key, pushed_from_bottom_data, new_node_id, err := split(file_header.Root_node_id, split_index(node_max_degree(root_node), appending, file), file_header, file)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("error while trying to split the root nodepage %v", file_header.Root_node_id))
+	}
+
+	// Make a new NodePage which will our new root of the B-tree
 	new_root_id, err := MakeNewPage(Page_type_ids["Node"], file_header, file)
 	if err != nil {
 		return err
@@ -316,13 +427,13 @@ func Insert(key uint32, data []byte, file_header *FileHeaderPage, file *os.File)
 		return err
 	}
 
-	file_header.Total_data_size = earlier_value + uint64(len(data))
+	add_to_total_data_size(int64(len(data)), file_header, file)
 	return nil
 }
 
 // DELETE OPERATION
 
-func merge_helper(left_node_id uint32, right_node_id uint32, file_header *FileHeaderPage, file *os.File) error {
+func merge_helper(left_node_id uint32, right_node_id uint32, file_header *FileHeaderPage, file *DBFile) error {
 
 	pt, _, left_node, _, err := ReadPage(file, left_node_id)
 	if err != nil {
@@ -345,7 +456,7 @@ func merge_helper(left_node_id uint32, right_node_id uint32, file_header *FileHe
 
 	i := int(left_node.Block_size)
 	j := 0
-	for i < MAX_DEGREE-1 && j < int(right_node.Block_size) {
+	for i < node_max_degree(left_node)-1 && j < int(right_node.Block_size) {
 		right_key = right_node.Blocks[j].Key
 		right_data, found_data, err = Read_from_NodePage(right_node_id, right_key, file_header, file)
 		if err != nil {
@@ -374,6 +485,7 @@ func merge_helper(left_node_id uint32, right_node_id uint32, file_header *FileHe
 		return errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", left_node_id, pt))
 	}
 	left_node.Children[left_node.Block_size] = right_node.Children[right_node.Block_size]
+	blink_link_merge(left_node, right_node, file_header)
 
 	err = DeletePage(right_node_id, file_header, file)
 	if err != nil {
@@ -388,7 +500,7 @@ func merge_helper(left_node_id uint32, right_node_id uint32, file_header *FileHe
 	return nil
 }
 
-func merge(node_id uint32, ind int, file_header *FileHeaderPage, file *os.File) error {
+func merge(node_id uint32, ind int, path *latch_path, file_header *FileHeaderPage, file *DBFile) error {
 	/*
 		4 Possible Cases:
 			1. The child node has more than `min_block_size` elements.
@@ -398,6 +510,7 @@ func merge(node_id uint32, ind int, file_header *FileHeaderPage, file *os.File)
 				4.1. Left Sibling exists
 				4.2. Right Sibling exists
 		[Other sibling nodes except for just right and just left are not useful (in this scenario)]
+		`node_id` and its child at `ind` must already be latched in `path`, the siblings get latched here
 	*/
 
 	// Read node
@@ -418,12 +531,16 @@ func merge(node_id uint32, ind int, file_header *FileHeaderPage, file *os.File)
 	}
 
 	// Case 1
-	if child_of_node_1.Block_size >= uint16(min_block_size) {
+	if int(child_of_node_1.Block_size) >= node_min_block_size(child_of_node_1, file) {
 		return nil
 	}
 
+	// Every other case moves keys up or to the left
+	blink_keys_moving(file_header, file)
+
 	// Case 2
 	if ind+1 < int(node.Block_size)+1 {
+		path.hold(node.Children[ind+1])
 		pt, _, child_of_node_2, _, err := ReadPage(file, node.Children[ind+1])
 		if err != nil {
 			return err
@@ -431,56 +548,15 @@ func merge(node_id uint32, ind int, file_header *FileHeaderPage, file *os.File)
 		if pt != Page_type_ids["Node"] {
 			return errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node.Children[ind], pt))
 		}
-		if child_of_node_2.Block_size > uint16(min_block_size) {
+		if sibling_can_spare_key(child_of_node_1, child_of_node_2, file) {
 			// Right sibling exists and has more than `min_block_size` elements
-			right_child_id := node.Children[ind+1]
-			left_child_id := node.Children[ind]
-			right_child_key := child_of_node_2.Blocks[0].Key
-			right_child_left_child := child_of_node_2.Children[0]
-			right_child_data, found_data, err := Read_from_NodePage(right_child_id, right_child_key, file_header, file)
-			if err != nil {
-				return err
-			}
-			if !found_data {
-				return errors.New(fmt.Sprintf("coudn't find key %v in the nodepage %v", right_child_key, right_child_id))
-			}
-
-			// Take the 0th element from the right child
-			err = Delete_in_NodePage(right_child_id, right_child_key, true, file_header, file)
-			if err != nil {
-				return err
-			}
-
-			// Put the right child 0th element in the node at `ind` position
-			node_key := node.Blocks[ind].Key
-			node_data, found_data, err := Read_from_NodePage(node_id, node_key, file_header, file)
-			if err != nil {
-				return err
-			}
-			if !found_data {
-				return errors.New(fmt.Sprintf("coudn't find key %v in the nodepage %v", node_key, node_id))
-			}
-			err = Delete_in_NodePage(node_id, node_key, false, file_header, file)
-			if err != nil {
-				return err
-			}
-			err = Put_in_NodePage(node_id, right_child_key, right_child_data, right_child_id, false, file_header, file)
-			if err != nil {
-				return err
-			}
-
-			// Put the `ind` element of node into `ind` child
-			err = Put_in_NodePage(left_child_id, node_key, node_data, right_child_left_child, false, file_header, file)
-			if err != nil {
-				return nil
-			}
-
-			return nil
+			return rotate_left(node_id, ind, file_header, file)
 		}
 	}
 
 	// Case 3
 	if ind-1 > -1 {
+		path.hold(node.Children[ind-1])
 		pt, _, child_of_node_2, _, err := ReadPage(file, node.Children[ind-1])
 		if err != nil {
 			return err
@@ -488,51 +564,9 @@ func merge(node_id uint32, ind int, file_header *FileHeaderPage, file *os.File)
 		if pt != Page_type_ids["Node"] {
 			return errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node.Children[ind], pt))
 		}
-		if child_of_node_2.Block_size > uint16(min_block_size) {
+		if sibling_can_spare_key(child_of_node_1, child_of_node_2, file) {
 			// Left sibling exists and has more than `min_block_size` elements
-			left_child_id := node.Children[ind-1]
-			right_child_id := node.Children[ind]
-			left_child_key := child_of_node_2.Blocks[child_of_node_2.Block_size-1].Key
-			left_child_right_child := child_of_node_2.Children[child_of_node_2.Block_size]
-			left_child_data, found_data, err := Read_from_NodePage(left_child_id, left_child_key, file_header, file)
-			if err != nil {
-				return err
-			}
-			if !found_data {
-				return errors.New(fmt.Sprintf("coudn't find key %v in the nodepage %v", left_child_key, left_child_id))
-			}
-
-			// Take the last element from the left child
-			err = Delete_in_NodePage(left_child_id, left_child_key, false, file_header, file)
-			if err != nil {
-				return err
-			}
-
-			// Put the left child's last element in the node at `ind` position
-			node_key := node.Blocks[ind-1].Key
-			node_data, found_data, err := Read_from_NodePage(node_id, node_key, file_header, file)
-			if err != nil {
-				return err
-			}
-			if !found_data {
-				return errors.New(fmt.Sprintf("coudn't find key %v in the nodepage %v", node_key, node_id))
-			}
-			err = Delete_in_NodePage(node_id, node_key, true, file_header, file)
-			if err != nil {
-				return err
-			}
-			err = Put_in_NodePage(node_id, left_child_key, left_child_data, left_child_id, true, file_header, file)
-			if err != nil {
-				return err
-			}
-
-			// Put the `ind` element of node into `ind` child
-			err = Put_in_NodePage(right_child_id, node_key, node_data, left_child_right_child, true, file_header, file)
-			if err != nil {
-				return nil
-			}
-
-			return nil
+			return rotate_right(node_id, ind-1, file_header, file)
 		}
 	}
 
@@ -609,11 +643,147 @@ func merge(node_id uint32, ind int, file_header *FileHeaderPage, file *os.File)
 	return nil
 }
 
-func find_leftmost(node_id uint32, file_header *FileHeaderPage, file *os.File) (uint32, []byte, error) {
+func rotate_left(node_id uint32, ind int, file_header *FileHeaderPage, file *DBFile) error {
+	// The first key of the child at `ind+1` goes up into the node, and the key of the node between the two children
+	// comes down to the end of the child at `ind` (along with the leftmost child of the right one)
+	// `node_id` and both children must already be latched
+
+	blink_keys_moving(file_header, file)
+
+	pt, _, node, _, err := ReadPage(file, node_id)
+	if err != nil {
+		return err
+	}
+	if pt != Page_type_ids["Node"] {
+		return errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node_id, pt))
+	}
+	left_child_id := node.Children[ind]
+	right_child_id := node.Children[ind+1]
+	pt, _, right_child, _, err := ReadPage(file, right_child_id)
+	if err != nil {
+		return err
+	}
+	if pt != Page_type_ids["Node"] {
+		return errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", right_child_id, pt))
+	}
+
+	right_child_key := right_child.Blocks[0].Key
+	right_child_left_child := right_child.Children[0]
+	right_child_data, found_data, err := Read_from_NodePage(right_child_id, right_child_key, file_header, file)
+	if err != nil {
+		return err
+	}
+	if !found_data {
+		return errors.New(fmt.Sprintf("coudn't find key %v in the nodepage %v", right_child_key, right_child_id))
+	}
+
+	// Take the 0th element from the right child
+	err = Delete_in_NodePage(right_child_id, right_child_key, true, file_header, file)
+	if err != nil {
+		return err
+	}
+
+	// Put the right child 0th element in the node at `ind` position
+	node_key := node.Blocks[ind].Key
+	node_data, found_data, err := Read_from_NodePage(node_id, node_key, file_header, file)
+	if err != nil {
+		return err
+	}
+	if !found_data {
+		return errors.New(fmt.Sprintf("coudn't find key %v in the nodepage %v", node_key, node_id))
+	}
+	err = Delete_in_NodePage(node_id, node_key, false, file_header, file)
+	if err != nil {
+		return err
+	}
+	err = Put_in_NodePage(node_id, right_child_key, right_child_data, right_child_id, false, file_header, file)
+	if err != nil {
+		return err
+	}
+
+	// Put the `ind` element of node into `ind` child
+	err = Put_in_NodePage(left_child_id, node_key, node_data, right_child_left_child, false, file_header, file)
+	if err != nil {
+		return err
+	}
+
+	return blink_set_high_key(left_child_id, right_child_key, file_header, file)
+}
+
+func rotate_right(node_id uint32, ind int, file_header *FileHeaderPage, file *DBFile) error {
+	// The last key of the child at `ind` goes up into the node, and the key of the node between the two children
+	// comes down to the front of the child at `ind+1` (along with the rightmost child of the left one)
+	// `node_id` and both children must already be latched
+
+	blink_keys_moving(file_header, file)
+
+	pt, _, node, _, err := ReadPage(file, node_id)
+	if err != nil {
+		return err
+	}
+	if pt != Page_type_ids["Node"] {
+		return errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node_id, pt))
+	}
+	left_child_id := node.Children[ind]
+	right_child_id := node.Children[ind+1]
+	pt, _, left_child, _, err := ReadPage(file, left_child_id)
+	if err != nil {
+		return err
+	}
+	if pt != Page_type_ids["Node"] {
+		return errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", left_child_id, pt))
+	}
+
+	left_child_key := left_child.Blocks[left_child.Block_size-1].Key
+	left_child_right_child := left_child.Children[left_child.Block_size]
+	left_child_data, found_data, err := Read_from_NodePage(left_child_id, left_child_key, file_header, file)
+	if err != nil {
+		return err
+	}
+	if !found_data {
+		return errors.New(fmt.Sprintf("coudn't find key %v in the nodepage %v", left_child_key, left_child_id))
+	}
+
+	// Take the last element from the left child
+	err = Delete_in_NodePage(left_child_id, left_child_key, false, file_header, file)
+	if err != nil {
+		return err
+	}
+
+	// Put the left child's last element in the node at `ind` position
+	node_key := node.Blocks[ind].Key
+	node_data, found_data, err := Read_from_NodePage(node_id, node_key, file_header, file)
+	if err != nil {
+		return err
+	}
+	if !found_data {
+		return errors.New(fmt.Sprintf("coudn't find key %v in the nodepage %v", node_key, node_id))
+	}
+	err = Delete_in_NodePage(node_id, node_key, true, file_header, file)
+	if err != nil {
+		return err
+	}
+	err = Put_in_NodePage(node_id, left_child_key, left_child_data, left_child_id, true, file_header, file)
+	if err != nil {
+		return err
+	}
+
+	// Put the `ind` element of node into `ind+1` child
+	err = Put_in_NodePage(right_child_id, node_key, node_data, left_child_right_child, true, file_header, file)
+	if err != nil {
+		return err
+	}
+
+	return blink_set_high_key(left_child_id, left_child_key, file_header, file)
+}
+
+func find_leftmost(node_id uint32, path *latch_path, file_header *FileHeaderPage, file *DBFile) (uint32, []byte, error) {
 
 	if node_id == 0 {
 		return 0, nil, nil
 	}
+	// The whole way down is kept latched, since the leftmost element is going to be deleted from there right after
+	path.hold(node_id)
 
 	pt, _, node, _, err := ReadPage(file, node_id)
 	if err != nil {
@@ -633,10 +803,10 @@ func find_leftmost(node_id uint32, file_header *FileHeaderPage, file *os.File) (
 		}
 		return node.Blocks[0].Key, data, nil
 	}
-	return find_leftmost(node.Children[0], file_header, file)
+	return find_leftmost(node.Children[0], path, file_header, file)
 }
 
-func delete_helper(node_id uint32, key uint32, file_header *FileHeaderPage, file *os.File) (int, error) {
+func delete_helper(node_id uint32, key uint32, path *latch_path, file_header *FileHeaderPage, file *DBFile) (int, error) {
 	/*
 		INPUT:
 			1. The root of the B-Tree in which the element could be present
@@ -645,7 +815,8 @@ func delete_helper(node_id uint32, key uint32, file_header *FileHeaderPage, file
 			1. An integer which represents a code, which is used for internal function use to tell what case are we working with.
 				-> -1 = The element was not found
 				->  0 = The element was found and deleted wih no problems
-				->  1 = The deletion has occured but now the node below has less number of elems and thus needs to be merged with sibling.
+				->  1 = The deletion has occured but now the node below has less number of elems and thus needs to be merged with sibling (leaf or internal).
+		`node_id` must already be latched in `path`
 	*/
 	if node_id == 0 {
 		return -1, nil
@@ -659,6 +830,11 @@ func delete_helper(node_id uint32, key uint32, file_header *FileHeaderPage, file
 		return -1, errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node_id, pt))
 	}
 
+	// This node will not need merging, so nothing above it will be touched by this delete anymore
+	if node_safe_for_delete(node, file) {
+		path.release_above(node_id)
+	}
+
 	ind, inArr := binary_index_node(node.Blocks[:], 0, int(node.Block_size), key)
 
 	if inArr { // This node contains the element we want to delete
@@ -668,14 +844,16 @@ func delete_helper(node_id uint32, key uint32, file_header *FileHeaderPage, file
 			if err != nil {
 				return 1, errors.Wrap(err, fmt.Sprintf("error while trying to delete key %v from the nodepage %v", key, node_id))
 			}
-			if node.Block_size-1 < uint16(min_block_size) {
+			if int(node.Block_size)-1 < node_min_block_size(node, file) {
 				return 1, nil // This leaf node has less elements than we need and so, merging will be required
 			}
 			return 0, nil
 		}
 
 		// This is an internal node
-		replace_key, replace_data, err := find_leftmost(node.Children[ind+1], file_header, file)
+		// Its key gets replaced by the leftmost key of the right subtree, which moves up
+		blink_keys_moving(file_header, file)
+		replace_key, replace_data, err := find_leftmost(node.Children[ind+1], path, file_header, file)
 		if err != nil {
 			return -1, errors.Wrap(err, fmt.Sprintf("error while trying to find the leftmost element in the right subtree of the nodepage %v, with child index %v", node_id, ind+1))
 		}
@@ -689,13 +867,17 @@ func delete_helper(node_id uint32, key uint32, file_header *FileHeaderPage, file
 		if err != nil {
 			return -1, err
 		}
+		err = blink_set_right_spine_high_key(node.Children[ind], replace_key, path, file_header, file)
+		if err != nil {
+			return -1, err
+		}
 
-		code, err := delete_helper(node.Children[ind+1], replace_key, file_header, file)
+		code, err := delete_helper(node.Children[ind+1], replace_key, path, file_header, file)
 		if err != nil || code == -1 {
 			return -1, errors.Wrap(err, fmt.Sprintf("error while trying to delete the leftmost element of the right subtree of the nodepage %v at child index %v", node_id, ind+1))
 		}
 		if code == 1 {
-			err = merge(node_id, ind+1, file_header, file)
+			err = merge(node_id, ind+1, path, file_header, file)
 			if err != nil {
 				return -1, err
 			}
@@ -706,15 +888,16 @@ func delete_helper(node_id uint32, key uint32, file_header *FileHeaderPage, file
 			if pt != Page_type_ids["Node"] {
 				return -1, errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node_id, pt))
 			}
-			if int(node.Block_size) < min_block_size {
-				return 3, nil
+			if int(node.Block_size) < node_min_block_size(node, file) {
+				return 1, nil // The merge below took a key from this node, so now it needs merging too
 			}
 		}
 		return 0, nil
 	}
 
 	// The element maybe in one of the leaf nodes of the current node
-	code, err := delete_helper(node.Children[ind], key, file_header, file)
+	path.hold(node.Children[ind])
+	code, err := delete_helper(node.Children[ind], key, path, file_header, file)
 	if err != nil {
 		return -1, err
 	}
@@ -729,7 +912,7 @@ func delete_helper(node_id uint32, key uint32, file_header *FileHeaderPage, file
 	}
 	if code == 1 {
 		// Element WAS in the leaf node (which is just below this node)
-		err = merge(node_id, ind, file_header, file)
+		err = merge(node_id, ind, path, file_header, file)
 		if err != nil {
 			return -1, err
 		}
@@ -740,8 +923,8 @@ func delete_helper(node_id uint32, key uint32, file_header *FileHeaderPage, file
 		if pt != Page_type_ids["Node"] {
 			return -1, errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node_id, pt))
 		}
-		if int(node.Block_size) < min_block_size {
-			return 3, nil
+		if int(node.Block_size) < node_min_block_size(node, file) {
+			return 1, nil // The merge below took a key from this node, so now it needs merging too
 		}
 		return 0, nil
 	}
@@ -749,52 +932,80 @@ func delete_helper(node_id uint32, key uint32, file_header *FileHeaderPage, file
 	return 0, nil
 }
 
-func Delete(key uint32, file_header *FileHeaderPage, file *os.File) error {
+func Delete(key uint32, file_header *FileHeaderPage, file *DBFile) error {
 
-	data, found, err := Search(key, file_header.Root_node_id, file_header, file)
+	if file.Read_only {
+		return errors.Wrap(ErrReadOnly, fmt.Sprintf("cannot delete the key %v", key))
+	}
+
+	file.lock.RLock()
+	path := latch_path{file: file}
+	var err error
+	if is_bplus(file_header) {
+		err = bplus_delete_from_root(key, &path, file_header, file)
+	} else {
+		err = delete_from_root(key, &path, file_header, file)
+	}
+	path.release_all()
+	file.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func delete_from_root(key uint32, path *latch_path, file_header *FileHeaderPage, file *DBFile) error {
+
+	data, found, err := get_helper(key, file_header, file)
 	if err != nil {
 		return err
 	}
 	if !found {
 		return errors.New(fmt.Sprintf("error while trying to find data for the key %v in the b-tree", key))
 	}
-	earlier_value := file_header.Total_data_size
 
-	code, err := delete_helper(file_header.Root_node_id, key, file_header, file)
+	// The root latch is held till the root node turns out to be safe, since emptying the root changes Root_node_id
+	path.hold_root()
+	root_id := file_header.Root_node_id
+	path.hold(root_id)
+
+	code, err := delete_helper(root_id, key, path, file_header, file)
 	if err != nil {
 		return err
 	}
 	if code == -1 {
-		return errors.New(fmt.Sprintf("coudn't find key %v in the b-tree with root id %v", key, file_header.Root_node_id))
+		return errors.New(fmt.Sprintf("coudn't find key %v in the b-tree with root id %v", key, root_id))
 	}
 
 	if code == 1 {
-		pt, _, root_node, _, err := ReadPage(file, file_header.Root_node_id)
+		// The root wasn't safe (that is how we got here), so the root latch is still held
+		pt, _, root_node, _, err := ReadPage(file, root_id)
 		if err != nil {
 			return err
 		}
 		if pt != Page_type_ids["Node"] {
-			return errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", file_header.Root_node_id, pt))
+			return errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", root_id, pt))
 		}
 
 		if root_node.Block_size == 0 {
-			err = DeletePage(file_header.Root_node_id, file_header, file)
+			err = DeletePage(root_id, file_header, file)
 			if err != nil {
 				return err
 			}
 			file_header.Root_node_id = root_node.Children[0]
 		}
-		file_header.Total_data_size = earlier_value - uint64(len(data))
+		add_to_total_data_size(-int64(len(data)), file_header, file)
 		return nil
 	}
 
-	file_header.Total_data_size = earlier_value - uint64(len(data))
+	add_to_total_data_size(-int64(len(data)), file_header, file)
 	return nil
 }
 
 // TESTING
 
-// func postorder(node_id uint32, want_expanded_output bool, file_header *FileHeaderPage, file *os.File) error {
+// func postorder(node_id uint32, want_expanded_output bool, file_header *FileHeaderPage, file *DBFile) error {
 // 	var err error
 // 	if node_id != 0 {
 // 		err = Visualize_Page(node_id, file_header, file)
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	B-link tree mode (Tree_mode_ids["BLink"]), picked with ConnectOptions.Tree_mode when the db is created.
+
+	The tree is the same B-Tree as always, but every NodePage also knows the next node on its level (Right_link) and
+	the smallest key which is too big for it (High_key). When a node splits, the new right node is written first with
+	the old Right_link and High_key, and only then the left node is pointed to it, all before the parent hears of it.
+
+	Searches then don't crab at all. They latch a single node at a time, just for as long as it takes to read it, and
+	if the key turns out to be >= High_key the node has been split since its parent was read, so the search simply
+	walks over the Right_link. Nobody waits on a split happening above them anymore.
+
+	The Right_link only covers keys moving to the right. Keys moving up or to the left (the middle key of a split,
+	rotations and merges while deleting, the replacement of a deleted internal key) bump the blink_epoch of the
+	DBFile before anything is moved. A search which didn't find its key re-runs if the epoch changed while it was
+	running, and after blink_max_attempts of that it falls back to plain crabbing, which can't miss anything.
+
+	Inserts and Deletes are unchanged (they still crab with write latches), they only keep the links up to date.
+*/
+
+const blink_max_attempts = 8
+
+func is_blink(file_header *FileHeaderPage) bool {
+	return file_header.Tree_mode == Tree_mode_ids["BLink"]
+}
+
+// SEARCH
+
+func blink_get(key uint32, file_header *FileHeaderPage, file *DBFile) ([]byte, bool, error) {
+
+	for attempt := 0; attempt < blink_max_attempts; attempt++ {
+		epoch := file.blink_epoch.Load()
+
+		file.root_latch.RLock()
+		root_id := file_header.Root_node_id
+		file.root_latch.RUnlock()
+
+		data, found, err := blink_search_helper(key, root_id, file_header, file)
+		if found || file.blink_epoch.Load() == epoch {
+			return data, found, err
+		}
+	}
+
+	// The keys kept moving around this search, so crab down instead
+	return get_helper(key, file_header, file)
+}
+
+func blink_search(key uint32, root_id uint32, file_header *FileHeaderPage, file *DBFile) ([]byte, bool, error) {
+
+	for attempt := 0; attempt < blink_max_attempts; attempt++ {
+		epoch := file.blink_epoch.Load()
+
+		data, found, err := blink_search_helper(key, root_id, file_header, file)
+		if found || file.blink_epoch.Load() == epoch {
+			return data, found, err
+		}
+	}
+
+	// The keys kept moving around this search, so crab down instead
+	if root_id != 0 {
+		get_page_latch(file, root_id).RLock()
+	}
+	return search_helper(key, root_id, file_header, file)
+}
+
+func blink_search_helper(key uint32, root_id uint32, file_header *FileHeaderPage, file *DBFile) ([]byte, bool, error) {
+
+	node_id := root_id
+	for node_id != 0 {
+		node, data, found, err := blink_read_node(node_id, key, file_header, file)
+		if err != nil {
+			return nil, false, err
+		}
+		if found {
+			return data, true, nil
+		}
+
+		if node.Right_link != 0 && key >= node.High_key {
+			if key == node.High_key {
+				// The key belongs in one of the nodes above, which were already passed
+				return nil, false, nil
+			}
+			// The node was split after its parent was read, the key went to the right
+			node_id = node.Right_link
+			continue
+		}
+
+		ind, _ := binary_index_node(node.Blocks[:node.Block_size], 0, int(node.Block_size), key)
+		node_id = node.Children[ind]
+	}
+
+	return nil, false, nil
+}
+
+func blink_read_node(node_id uint32, key uint32, file_header *FileHeaderPage, file *DBFile) (*NodePage, []byte, bool, error) {
+	// Reads the node along with the data of the key (if it is in there) under the read latch of the node
+
+	latch := get_page_latch(file, node_id)
+	latch.RLock()
+	defer latch.RUnlock()
+
+	pt, _, node, _, err := ReadPage(file, node_id)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if pt != Page_type_ids["Node"] {
+		return nil, nil, false, errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node_id, pt))
+	}
+
+	ind, inArr := binary_index_node(node.Blocks[:node.Block_size], 0, int(node.Block_size), key)
+	if !inArr || ind >= int(node.Block_size) {
+		return node, nil, false, nil
+	}
+	data, err := read_node_value(node, ind, file_header, file)
+	if err != nil {
+		return nil, nil, false, errors.Wrap(err, fmt.Sprintf("error while trying to retrieve key %v data from the nodepage %v", key, node_id))
+	}
+	return node, data, true, nil
+}
+
+// KEEPING THE LINKS UP TO DATE (used by Insert and Delete)
+
+func blink_keys_moving(file_header *FileHeaderPage, file *DBFile) {
+	// Has to be called before a key moves up or to the left, while the nodes involved are latched
+	if is_blink(file_header) {
+		file.blink_epoch.Add(1)
+	}
+}
+
+func blink_link_split(node *NodePage, new_node *NodePage, new_node_id uint32, push_to_top_key uint32, file_header *FileHeaderPage) {
+	// `node` keeps the keys below `push_to_top_key` and `new_node` takes over the rest along with the old links
+	if !is_blink(file_header) {
+		return
+	}
+	new_node.Right_link = node.Right_link
+	new_node.High_key = node.High_key
+	node.Right_link = new_node_id
+	node.High_key = push_to_top_key
+}
+
+func blink_link_merge(left_node *NodePage, right_node *NodePage, file_header *FileHeaderPage) {
+	// `right_node` is merged into `left_node` and deleted
+	if !is_blink(file_header) {
+		return
+	}
+	left_node.Right_link = right_node.Right_link
+	left_node.High_key = right_node.High_key
+}
+
+func blink_set_high_key(node_id uint32, high_key uint32, file_header *FileHeaderPage, file *DBFile) error {
+	// `node_id` must already be latched in write mode
+
+	if !is_blink(file_header) {
+		return nil
+	}
+	pt, _, node, _, err := ReadPage(file, node_id)
+	if err != nil {
+		return err
+	}
+	if pt != Page_type_ids["Node"] {
+		return errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node_id, pt))
+	}
+	if node.High_key == high_key {
+		return nil
+	}
+	node.High_key = high_key
+	return SavePage(node_id, Data_to_Bytes(node), file_header, file)
+}
+
+func blink_set_right_spine_high_key(node_id uint32, high_key uint32, path *latch_path, file_header *FileHeaderPage, file *DBFile) error {
+	// The key right after the subtree of `node_id` changed, so its rightmost node on every level gets the new High_key
+
+	if !is_blink(file_header) {
+		return nil
+	}
+	for node_id != 0 {
+		path.hold(node_id)
+		pt, _, node, _, err := ReadPage(file, node_id)
+		if err != nil {
+			return err
+		}
+		if pt != Page_type_ids["Node"] {
+			return errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node_id, pt))
+		}
+		if node.High_key != high_key {
+			node.High_key = high_key
+			err = SavePage(node_id, Data_to_Bytes(node), file_header, file)
+			if err != nil {
+				return err
+			}
+		}
+		node_id = node.Children[node.Block_size]
+	}
+	return nil
+}
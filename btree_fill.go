@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	How full the nodes are kept, picked with ConnectOptions when the db is created and kept in its File Header (like
+	Tree_mode), so that every connection keeps the nodes the same way and Check knows how full they have to be.
+
+		Min_fill		->	A node with less than this percent of max_degree keys is rebalanced by Delete (it takes a key
+							from a sibling or is merged with one). 50 by default, a lower one leaves nodes emptier but
+							keeps deletes and inserts around the same keys from merging and splitting the same nodes
+							over and over.
+		Fill_factor		->	How full the node is left when appending to the rightmost node splits it (see split_index),
+							100 by default. Lower leaves room for keys coming in a bit out of order.
+		Lazy_rebalance	->	Nodes are let go as low as one key, and only rebalanced once they are empty. An empty node is
+							merged into a sibling whenever they fit in one node (so its page is freed), and only takes a
+							key from the sibling when they don't.
+
+	Merges are always kept from overflowing the node: with child < Min_fill and sibling <= Min_fill they fit, which is
+	why Min_fill can't be over 50.
+*/
+
+type fill_policy struct {
+	min_fill       int // Percent, see above
+	fill_factor    int // Percent, see above
+	lazy_rebalance bool
+}
+
+const (
+	default_min_fill    = 50
+	default_fill_factor = 100
+	min_fill_factor     = 50
+)
+
+func fill_policy_for_options(options ConnectOptions) (fill_policy, error) {
+
+	fill := fill_policy{min_fill: options.Min_fill, fill_factor: options.Fill_factor, lazy_rebalance: options.Lazy_rebalance}
+	if fill.min_fill == 0 {
+		fill.min_fill = default_min_fill
+	}
+	if fill.fill_factor == 0 {
+		fill.fill_factor = default_fill_factor
+	}
+	if fill.min_fill < 1 || fill.min_fill > default_min_fill {
+		return fill, errors.New(fmt.Sprintf("the min fill has to be from 1 to %v percent, not %v", default_min_fill, options.Min_fill))
+	}
+	if fill.fill_factor < min_fill_factor || fill.fill_factor > 100 {
+		return fill, errors.New(fmt.Sprintf("the fill factor has to be from %v to 100 percent, not %v", min_fill_factor, options.Fill_factor))
+	}
+	return fill, nil
+}
+
+func fill_policy_for_header(file_header *FileHeaderPage) (fill_policy, error) {
+	// The fill policy the db was created with, 0s (as in the dbs made before it was kept) are the defaults
+
+	options := ConnectOptions{Min_fill: int(file_header.Min_fill), Fill_factor: int(file_header.Fill_factor), Lazy_rebalance: file_header.Lazy_rebalance != 0}
+	fill, err := fill_policy_for_options(options)
+	if err != nil {
+		return fill, errors.Wrap(err, "the file header has a bad fill policy")
+	}
+	return fill, nil
+}
+
+func (fill fill_policy) save_in_header(file_header *FileHeaderPage) {
+	file_header.Min_fill = uint8(fill.min_fill)
+	file_header.Fill_factor = uint8(fill.fill_factor)
+	file_header.Lazy_rebalance = 0
+	if fill.lazy_rebalance {
+		file_header.Lazy_rebalance = 1
+	}
+}
+
+func node_min_block_size(np *NodePage, file *DBFile) int {
+	// A node with less keys than this gets rebalanced
+	if file.fill.lazy_rebalance {
+		return 1
+	}
+	min_block_size := len(np.Blocks)*file.fill.min_fill/100 - 1
+	if min_block_size < 1 {
+		return 1
+	}
+	return min_block_size
+}
+
+func sibling_can_spare_key(child *NodePage, sibling *NodePage, file *DBFile) bool {
+	// Whether the sibling of a child which got too small gives it a key, instead of the two being merged
+	if int(sibling.Block_size) <= node_min_block_size(sibling, file) {
+		return false
+	}
+	if file.fill.lazy_rebalance {
+		// Only if they don't fit in one node (counting the key between them)
+		return int(child.Block_size)+int(sibling.Block_size)+1 >= node_max_degree(sibling)
+	}
+	return true
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestFillPolicyKeptInTheDb(t *testing.T) {
+	store, _ := New_memory_page_store(DEFAULT_PAGESIZE)
+	options := Default_connect_options
+	options.Min_fill, options.Fill_factor, options.Lazy_rebalance = 30, 80, true
+	file, file_header, err := Create_and_ConnectDB_with_store(store, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	DisconnectDB(file, file_header)
+
+	// Reconnecting with other options doesn't change it
+	file, file_header, err = ConnectDB_with_store(store, Default_connect_options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DisconnectDB(file, file_header)
+	if file.fill != (fill_policy{min_fill: 30, fill_factor: 80, lazy_rebalance: true}) {
+		t.Fatalf("connected with the fill policy %+v", file.fill)
+	}
+
+	// The dbs made before it was kept have 0s in the File Header
+	fill, err := fill_policy_for_header(&FileHeaderPage{})
+	if err != nil || fill != (fill_policy{min_fill: default_min_fill, fill_factor: default_fill_factor}) {
+		t.Fatalf("a File Header without a fill policy gives %+v (err = %v)", fill, err)
+	}
+	if _, err := fill_policy_for_header(&FileHeaderPage{Min_fill: 90}); err == nil {
+		t.Fatal("a File Header with a min fill of 90 was taken")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import "sync"
+
+/*
+	Latches for running B-Tree operations side by side.
+
+	Every NodePage has its own latch (a RWMutex kept in the DBFile and made the first time the page is latched). The
+	DataPages of a node are looked after by the latch of that node, as nobody else ever touches them.
+
+	Operations go down the tree with latch crabbing:
+		-> Search latches the child in read mode and then lets go of the parent.
+		-> Insert and Delete latch the child in write mode and only let go of the parent (and everything above it) once
+		   the child is safe, i.e. the change can't make the child split (insert) or merge (delete), and so the parent
+		   will never need to be touched again.
+	Above the root sits the root latch, which guards file_header.Root_node_id and is crabbed just like a parent.
+
+	The free space table and the counters in the file header are guarded separately by the alloc_lock.
+*/
+
+func get_page_latch(file *DBFile, page_id uint32) *sync.RWMutex {
+	file.latches_lock.Lock()
+	defer file.latches_lock.Unlock()
+
+	if file.latches == nil {
+		file.latches = make(map[uint32]*sync.RWMutex)
+	}
+	latch, ok := file.latches[page_id]
+	if !ok {
+		latch = &sync.RWMutex{}
+		file.latches[page_id] = latch
+	}
+	return latch
+}
+
+func node_safe_for_insert(np *NodePage, file *DBFile) bool {
+	// One more key must not make the node reach max_degree (which is when it gets split)
+	return int(np.Block_size)+1 < node_max_degree(np)
+}
+
+func node_safe_for_delete(np *NodePage, file *DBFile) bool {
+	// One key less must not drop the node below min_block_size (which is when it gets merged)
+	return int(np.Block_size) > node_min_block_size(np, file)
+}
+
+// The write latches held by one Insert or Delete, in the order they were taken (top of the tree to the bottom)
+type latch_path struct {
+	file      *DBFile
+	root_held bool
+	pages     []uint32
+}
+
+func (lp *latch_path) hold_root() {
+	if !lp.root_held {
+		lp.file.root_latch.Lock()
+		lp.root_held = true
+	}
+}
+
+func (lp *latch_path) hold(page_id uint32) {
+	if page_id == 0 {
+		return
+	}
+	for _, held := range lp.pages {
+		if held == page_id {
+			return
+		}
+	}
+	get_page_latch(lp.file, page_id).Lock()
+	lp.pages = append(lp.pages, page_id)
+}
+
+func (lp *latch_path) release_above(page_id uint32) {
+	// The node `page_id` is safe, so everything latched before it is not going to be changed anymore
+	if lp.root_held {
+		lp.file.root_latch.Unlock()
+		lp.root_held = false
+	}
+	for i, held := range lp.pages {
+		if held == page_id {
+			for _, above := range lp.pages[:i] {
+				get_page_latch(lp.file, above).Unlock()
+			}
+			lp.pages = lp.pages[i:]
+			return
+		}
+	}
+}
+
+func (lp *latch_path) release_all() {
+	if lp.root_held {
+		lp.file.root_latch.Unlock()
+		lp.root_held = false
+	}
+	for _, held := range lp.pages {
+		get_page_latch(lp.file, held).Unlock()
+	}
+	lp.pages = nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// Many goroutines inserting, deleting and searching through the same handle
+// Run with `go test -race -run TestConcurrentTree` to also have the race detector look at the latches
+func TestConcurrentTree(t *testing.T) {
+	const num_workers = 4
+	const keys_per_worker = 400
+
+	for _, tree_mode := range []string{"BTree", "BLink", "BPlus"} {
+		for _, test := range []struct {
+			name    string
+			options func(options *ConnectOptions)
+		}{
+			{"pool", func(options *ConnectOptions) {}},
+			{"no pool", func(options *ConnectOptions) { options.Buffer_pool_bytes = 0 }},
+			{"mmap", func(options *ConnectOptions) { options.Buffer_pool_bytes = 0; options.Use_mmap = true }},
+			{"compaction", func(options *ConnectOptions) { options.Compaction_rate = 1000 }},
+		} {
+			t.Run(fmt.Sprint(tree_mode, "/", test.name), func(t *testing.T) {
+				options := Default_connect_options
+				options.Tree_mode = Tree_mode_ids[tree_mode]
+				test.options(&options)
+
+				// Only the file store can be read through mmap
+				var store PageStore
+				var err error
+				if options.Use_mmap {
+					store, err = Open_file_page_store(filepath.Join(t.TempDir(), "concurrent.db"), true, options)
+				} else {
+					store, err = New_memory_page_store(DEFAULT_PAGESIZE)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				file, file_header, err := Create_and_ConnectDB_with_store(store, options)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer DisconnectDB(file, file_header)
+
+				err = run_concurrent_workers(num_workers, keys_per_worker, file_header, file)
+				if err != nil {
+					t.Fatalf("%+v", err)
+				}
+
+				// Every key is either there with its value or deleted, and the tree is whole
+				num_found := 0
+				for key := 0; key < keys_per_worker*num_workers; key++ {
+					data, found, err := Get(uint32(key), file_header, file)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if found {
+						if string(data) != string(concurrent_value(key)) {
+							t.Fatalf("key %v has %v instead of %v", key, string(data), string(concurrent_value(key)))
+						}
+						num_found++
+					}
+				}
+				if num_found != num_workers*(keys_per_worker-keys_per_worker/2) {
+					t.Fatalf("found %v keys, expected %v", num_found, num_workers*(keys_per_worker-keys_per_worker/2))
+				}
+				check_ok(t, "after the workers", num_found, file_header, file)
+			})
+		}
+	}
+}
+
+func concurrent_value(key int) []byte {
+	return []byte(fmt.Sprintf("value-%v-%v", key, key*7919))
+}
+
+func run_concurrent_workers(num_workers int, keys_per_worker int, file_header *FileHeaderPage, file *DBFile) error {
+	// Every worker owns the keys k with k % num_workers == worker, so the expected contents are known at the end
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*num_workers)
+	for w := 0; w < num_workers; w++ {
+		wg.Add(2)
+
+		// Writer -> insert all of its keys in a random order and then delete half of them
+		go func(w int) {
+			defer wg.Done()
+			order := rand.New(rand.NewSource(int64(w))).Perm(keys_per_worker)
+			for _, i := range order {
+				key := i*num_workers + w
+				err := Insert(uint32(key), concurrent_value(key), file_header, file)
+				if err != nil {
+					errs <- errors.Wrap(err, fmt.Sprintf("worker %v couldn't insert the key %v", w, key))
+					return
+				}
+			}
+			for _, i := range order[:keys_per_worker/2] {
+				key := i*num_workers + w
+				err := Delete(uint32(key), file_header, file)
+				if err != nil {
+					errs <- errors.Wrap(err, fmt.Sprintf("worker %v couldn't delete the key %v", w, key))
+					return
+				}
+			}
+		}(w)
+
+		// Reader -> search random keys, whatever is found must be the right value
+		go func(w int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(num_workers + w)))
+			for i := 0; i < keys_per_worker; i++ {
+				key := r.Intn(keys_per_worker * num_workers)
+				data, found, err := Get(uint32(key), file_header, file)
+				if err != nil {
+					errs <- errors.Wrap(err, fmt.Sprintf("reader %v couldn't search for the key %v", w, key))
+					return
+				}
+				if found && string(data) != string(concurrent_value(key)) {
+					errs <- errors.New(fmt.Sprintf("reader %v found %v instead of %v for the key %v", w, string(data), string(concurrent_value(key)), key))
+					return
+				}
+				if !is_bplus(file_header) || i%20 != 0 {
+					continue
+				}
+				// B+ trees can also be scanned, the keys must come in order and with the right values
+				var scan_err error
+				last := -1
+				err = Scan(uint32(key), uint32(key+100), func(k uint32, d []byte) bool {
+					if int(k) <= last || string(d) != string(concurrent_value(int(k))) {
+						scan_err = errors.New(fmt.Sprintf("reader %v scanned %v for the key %v after the key %v", w, string(d), k, last))
+						return false
+					}
+					last = int(k)
+					return true
+				}, file_header, file)
+				if err == nil {
+					err = scan_err
+				}
+				if err != nil {
+					errs <- errors.Wrap(err, fmt.Sprintf("reader %v couldn't scan from the key %v", w, key))
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		return err
+	}
+	return nil
+}
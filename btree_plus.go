@@ -0,0 +1,709 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	B+ tree mode (Tree_mode_ids["BPlus"]), picked with ConnectOptions.Tree_mode when the db is created.
+
+	Only the leaves keep values. The internal nodes keep nothing but the keys which separate their children (they are
+	Keys_only), so without a data ref in every cell they fit half as many keys again into a page (504 instead of 336
+	for 4kB pages), and they have no DataPages at all. A key equal to a separator is under the child to its right.
+
+	The leaves are linked up in key order, Right_link to the next leaf and Left_link to the one before it, so Scan
+	goes through a range of keys leaf after leaf, without going back up the tree.
+
+		Insert	->	A full leaf hands keys to a sibling if it can (see btree_redistribution.go), or else is split and the
+					first key of the new (right) leaf is copied up as the separator, the leaf itself keeps the key and
+					its value. Full internal nodes are dealt with just like in the B-Tree.
+		Delete	->	The key only goes from its leaf, the separators above stay as they are (they still separate the
+					same children). A leaf which gets too small takes a key from a sibling (and their separator in the
+					parent is changed to match), or else the two are merged. Internal nodes are merged like in the B-Tree.
+
+	Latches are crabbed down the tree like in the B-Tree. Fixing the links only ever latches the next leaf to the
+	right, and Scan never waits on a leaf while holding another one, so no one can end up waiting on each other.
+*/
+
+func is_bplus(file_header *FileHeaderPage) bool {
+	return file_header.Tree_mode == Tree_mode_ids["BPlus"]
+}
+
+func make_keys_only_node_page(file_header *FileHeaderPage, file *DBFile) (uint32, error) {
+
+	if file.Read_only {
+		return 0, errors.Wrap(ErrReadOnly, "cannot make a new page")
+	}
+
+	temp := new_keys_only_node_page(file.layout)
+	temp.Identification_num = PAGE_IDENTITY_NUM
+	temp.Page_type = Page_type_ids["Node"]
+	page_id, err := write_new_page(Data_to_Bytes(temp), file_header, file)
+	if err != nil {
+		return 0, errors.Wrap(err, fmt.Sprintf("error while writing to page index = %v", page_id))
+	}
+	return page_id, nil
+}
+
+func bplus_read_node(node_id uint32, file *DBFile) (*NodePage, error) {
+	pt, _, np, _, err := ReadPage(file, node_id)
+	if err != nil {
+		return nil, err
+	}
+	if pt != Page_type_ids["Node"] {
+		return nil, errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node_id, pt))
+	}
+	return np, nil
+}
+
+// The child of the internal node `np` which `key` is under
+func bplus_child_index(np *NodePage, key uint32) int {
+	ind, inArr := binary_index_node(np.Blocks[:np.Block_size], 0, int(np.Block_size), key)
+	if inArr {
+		ind++
+	}
+	return ind
+}
+
+// SEARCH
+
+func bplus_get(key uint32, file_header *FileHeaderPage, file *DBFile) ([]byte, bool, error) {
+
+	leaf_id, leaf, err := bplus_latch_leaf(key, file_header, file)
+	if err != nil || leaf_id == 0 {
+		return nil, false, err
+	}
+	defer get_page_latch(file, leaf_id).RUnlock()
+
+	return bplus_read_from_leaf(leaf, key, file_header, file)
+}
+
+func bplus_search(key uint32, root_id uint32, file_header *FileHeaderPage, file *DBFile) ([]byte, bool, error) {
+
+	if root_id != 0 {
+		get_page_latch(file, root_id).RLock()
+	}
+	leaf_id, leaf, err := bplus_find_leaf(key, root_id, file)
+	if err != nil || leaf_id == 0 {
+		return nil, false, err
+	}
+	defer get_page_latch(file, leaf_id).RUnlock()
+
+	return bplus_read_from_leaf(leaf, key, file_header, file)
+}
+
+func bplus_latch_leaf(key uint32, file_header *FileHeaderPage, file *DBFile) (uint32, *NodePage, error) {
+	// The leaf `key` belongs in, latched in read mode (0 if the tree is empty)
+
+	file.root_latch.RLock()
+	root_id := file_header.Root_node_id
+	if root_id != 0 {
+		get_page_latch(file, root_id).RLock()
+	}
+	file.root_latch.RUnlock()
+
+	return bplus_find_leaf(key, root_id, file)
+}
+
+func bplus_find_leaf(key uint32, node_id uint32, file *DBFile) (uint32, *NodePage, error) {
+	// The caller has latched `node_id` in read mode. Crabs down to the leaf `key` belongs in, which is left latched
+
+	for node_id != 0 {
+		np, err := bplus_read_node(node_id, file)
+		if err != nil {
+			get_page_latch(file, node_id).RUnlock()
+			return 0, nil, err
+		}
+		if np.Keys_only == 0 {
+			return node_id, np, nil
+		}
+
+		child_id := np.Children[bplus_child_index(np, key)]
+		if child_id == 0 {
+			get_page_latch(file, node_id).RUnlock()
+			return 0, nil, errors.New(fmt.Sprintf("the internal nodepage %v has no child for the key %v", node_id, key))
+		}
+		get_page_latch(file, child_id).RLock()
+		get_page_latch(file, node_id).RUnlock()
+		node_id = child_id
+	}
+	return 0, nil, nil
+}
+
+func bplus_read_from_leaf(leaf *NodePage, key uint32, file_header *FileHeaderPage, file *DBFile) ([]byte, bool, error) {
+
+	ind, inArr := binary_index_node(leaf.Blocks[:leaf.Block_size], 0, int(leaf.Block_size), key)
+	if !inArr {
+		return nil, false, nil
+	}
+	data, err := read_node_value(leaf, ind, file_header, file)
+	if err != nil {
+		return nil, false, errors.Wrap(err, fmt.Sprintf("error while trying to retrieve key %v data from its leaf", key))
+	}
+	return data, true, nil
+}
+
+// RANGE SCAN
+
+// Calls `fn` with every key from `from` to `to` (both included) and its data in key order, till `fn` returns false.
+// Only for dbs made in BPlus mode. The db is locked for reading while `fn` runs, so `fn` must not use the db itself
+func Scan(from uint32, to uint32, fn func(key uint32, data []byte) bool, file_header *FileHeaderPage, file *DBFile) error {
+
+	if !is_bplus(file_header) {
+		return errors.New(fmt.Sprintf("range scans need a db made in the BPlus tree mode, this one is in the tree mode %v", file_header.Tree_mode))
+	}
+
+	file.lock.RLock()
+	defer file.lock.RUnlock()
+
+	if from > to {
+		return nil
+	}
+	leaf_id, leaf, err := bplus_latch_leaf(from, file_header, file)
+	if err != nil {
+		return err
+	}
+
+	for leaf_id != 0 {
+		// Everything needed from the leaf is read in first, `fn` is only called once it is let go of
+		var keys []uint32
+		var values [][]byte
+		done := false
+		for i := 0; i < int(leaf.Block_size); i++ {
+			key := leaf.Blocks[i].Key
+			if key < from {
+				continue
+			}
+			if key > to {
+				done = true
+				break
+			}
+			data, err := read_node_value(leaf, i, file_header, file)
+			if err != nil {
+				get_page_latch(file, leaf_id).RUnlock()
+				return errors.Wrap(err, fmt.Sprintf("error while trying to retrieve key %v data from the leaf %v", key, leaf_id))
+			}
+			keys = append(keys, key)
+			values = append(values, data)
+		}
+		if leaf.Block_size != 0 && leaf.Blocks[leaf.Block_size-1].Key == math.MaxUint32 {
+			done = true
+		}
+
+		next_id := leaf.Right_link
+		if done || next_id == 0 {
+			get_page_latch(file, leaf_id).RUnlock()
+			leaf_id = 0
+		} else if get_page_latch(file, next_id).TryRLock() {
+			get_page_latch(file, leaf_id).RUnlock()
+			leaf_id = next_id
+			leaf, err = bplus_read_node(leaf_id, file)
+			if err != nil {
+				get_page_latch(file, leaf_id).RUnlock()
+				return err
+			}
+		} else {
+			// Someone is changing the next leaf, and may well be waiting on this one to do it (coming from the left).
+			// So this one is let go of, and the next leaf is found again from the root
+			get_page_latch(file, leaf_id).RUnlock()
+			if leaf.Block_size != 0 {
+				from = max(from, leaf.Blocks[leaf.Block_size-1].Key+1)
+			}
+			leaf_id, leaf, err = bplus_latch_leaf(from, file_header, file)
+			if err != nil {
+				return err
+			}
+		}
+
+		for i := range keys {
+			if !fn(keys[i], values[i]) {
+				if leaf_id != 0 {
+					get_page_latch(file, leaf_id).RUnlock()
+				}
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// INSERT
+
+func bplus_insert_from_root(key uint32, data []byte, path *latch_path, file_header *FileHeaderPage, file *DBFile) error {
+
+	var err error
+
+	// The root latch is held till the root node turns out to be safe, since splitting the root changes Root_node_id
+	path.hold_root()
+	if file_header.Root_node_id == 0 {
+		// The first root is a leaf
+		file_header.Root_node_id, err = MakeNewPage(Page_type_ids["Node"], file_header, file)
+		if err != nil {
+			return err
+		}
+	}
+
+	path.hold(file_header.Root_node_id)
+	inserted, is_full, appending, err := bplus_insert_helper(file_header.Root_node_id, key, data, true, path, file_header, file)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("error while trying to find the child node to put key %v in", key))
+	}
+
+	if is_full {
+		// The root has no siblings to hand keys to, so it is split and a new (internal) root goes on top of the halves
+		root, err := bplus_read_node(file_header.Root_node_id, file)
+		if err != nil {
+			return err
+		}
+		pushed_from_bottom_key, _, new_node_id, err := split_node(file_header.Root_node_id, split_index(node_max_degree(root), appending, file), path, file_header, file)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("error while trying to split the root %v", file_header.Root_node_id))
+		}
+		new_root_id, err := make_keys_only_node_page(file_header, file)
+		if err != nil {
+			return err
+		}
+		err = Put_in_NodePage(new_root_id, pushed_from_bottom_key, nil, file_header.Root_node_id, true, file_header, file)
+		if err != nil {
+			return err
+		}
+		new_root, err := bplus_read_node(new_root_id, file)
+		if err != nil {
+			return err
+		}
+		new_root.Children[1] = new_node_id
+		err = SavePage(new_root_id, Data_to_Bytes(new_root), file_header, file)
+		if err != nil {
+			return err
+		}
+		file_header.Root_node_id = new_root_id
+	}
+
+	if inserted {
+		add_to_total_data_size(int64(len(data)), file_header, file)
+	}
+	return nil
+}
+
+func bplus_insert_helper(node_id uint32, key uint32, data []byte, rightmost bool, path *latch_path, file_header *FileHeaderPage, file *DBFile) (bool, bool, bool, error) {
+	/*
+		`rightmost` is true for the last node on its level, like in insert_helper
+		OUTPUT:
+			1. bool [inserted] => False if the key was already there (and so nothing changed)
+			2. bool [is_full] => True if `node_id` now has max_degree keys, and the caller has to make room in it
+			3. bool [appending] => True if the key (or the separator pushed up from below) went to the end of a rightmost node
+			4. error
+		`node_id` must already be latched in `path`
+	*/
+
+	node, err := bplus_read_node(node_id, file)
+	if err != nil {
+		return false, false, false, err
+	}
+
+	// This node will not split, so nothing above it will be touched by this insert anymore
+	if node_safe_for_insert(node, file) {
+		path.release_above(node_id)
+	}
+
+	if node.Keys_only == 0 {
+		// This is a leaf
+		ind, inArr := binary_index_node(node.Blocks[:node.Block_size], 0, int(node.Block_size), key)
+		if inArr {
+			return false, false, false, nil
+		}
+		appending := rightmost && ind == int(node.Block_size)
+		err = Put_in_NodePage(node_id, key, data, 0, false, file_header, file)
+		if err != nil {
+			return false, false, false, err
+		}
+		return true, int(node.Block_size)+1 == node_max_degree(node), appending, nil
+	}
+
+	ind := bplus_child_index(node, key)
+	appending := rightmost && ind == int(node.Block_size)
+	child_id := node.Children[ind]
+	path.hold(child_id)
+	inserted, child_is_full, child_appending, err := bplus_insert_helper(child_id, key, data, appending, path, file_header, file)
+	if err != nil || !child_is_full {
+		return inserted, false, false, err
+	}
+
+	err = make_room_in_child(node_id, ind, child_appending, path, file_header, file)
+	if err != nil {
+		return inserted, false, false, errors.Wrap(err, fmt.Sprintf("error while trying to make room in the child %v of the nodepage %v", ind, node_id))
+	}
+	node, err = bplus_read_node(node_id, file)
+	if err != nil {
+		return inserted, false, false, err
+	}
+	return inserted, int(node.Block_size) == node_max_degree(node), appending, nil
+}
+
+func bplus_split_leaf(node_id uint32, mid int, path *latch_path, file_header *FileHeaderPage, file *DBFile) (uint32, uint32, error) {
+	// Moves the keys of the full leaf `node_id` from `mid` on (see split_index) to a new leaf right after it, returns
+	// the first key of the new leaf (which also stays in it) and its page id
+
+	node, err := bplus_read_node(node_id, file)
+	if err != nil {
+		return 0, 0, err
+	}
+	max_degree := node_max_degree(node)
+	if int(node.Block_size) < max_degree {
+		return 0, 0, errors.New(fmt.Sprintf("read leaf %v isn't full (block_size = %v), and so doesn't need splitting", node_id, node.Block_size))
+	}
+	if mid < 1 || mid > max_degree-1 {
+		return 0, 0, errors.New(fmt.Sprintf("cannot split the leaf %v at %v, both halves need at least one key", node_id, mid))
+	}
+
+	new_node_id, err := MakeNewPage(Page_type_ids["Node"], file_header, file)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	push_to_top_key := node.Blocks[mid].Key
+	for i := mid; i < max_degree; i++ {
+		err = bplus_move_key(node_id, new_node_id, node.Blocks[i].Key, file_header, file)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	// The new leaf goes in between the node and the leaf after it. Nobody can get to the new leaf before the node
+	// points to it, so it is saved first
+	node, err = bplus_read_node(node_id, file)
+	if err != nil {
+		return 0, 0, err
+	}
+	new_node, err := bplus_read_node(new_node_id, file)
+	if err != nil {
+		return 0, 0, err
+	}
+	new_node.Right_link = node.Right_link
+	new_node.Left_link = node_id
+	node.Right_link = new_node_id
+
+	err = SavePage(new_node_id, Data_to_Bytes(new_node), file_header, file)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = SavePage(node_id, Data_to_Bytes(node), file_header, file)
+	if err != nil {
+		return 0, 0, err
+	}
+	if new_node.Right_link != 0 {
+		err = bplus_set_left_link(new_node.Right_link, new_node_id, path, file_header, file)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return push_to_top_key, new_node_id, nil
+}
+
+func bplus_move_key(from_id uint32, to_id uint32, key uint32, file_header *FileHeaderPage, file *DBFile) error {
+	// Moves `key` and its value from one leaf to another
+
+	data, found, err := Read_from_NodePage(from_id, key, file_header, file)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("couldn't read the data of key %v from the leaf %v", key, from_id))
+	}
+	if !found {
+		return errors.New(fmt.Sprintf("couldn't find the key %v in the leaf %v", key, from_id))
+	}
+	err = Put_in_NodePage(to_id, key, data, 0, false, file_header, file)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("couldn't put the key %v into the leaf %v", key, to_id))
+	}
+	err = Delete_in_NodePage(from_id, key, false, file_header, file)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("couldn't delete the key %v from the leaf %v", key, from_id))
+	}
+	return nil
+}
+
+func bplus_set_left_link(node_id uint32, left_id uint32, path *latch_path, file_header *FileHeaderPage, file *DBFile) error {
+	// `node_id` is the leaf to the right of the ones being changed, and is latched here
+
+	path.hold(node_id)
+	node, err := bplus_read_node(node_id, file)
+	if err != nil {
+		return err
+	}
+	node.Left_link = left_id
+	err = SavePage(node_id, Data_to_Bytes(node), file_header, file)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("error while trying to update the Left_link of the leaf %v", node_id))
+	}
+	return nil
+}
+
+// DELETE
+
+func bplus_delete_from_root(key uint32, path *latch_path, file_header *FileHeaderPage, file *DBFile) error {
+
+	data, found, err := bplus_get(key, file_header, file)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New(fmt.Sprintf("error while trying to find data for the key %v in the b-tree", key))
+	}
+
+	// The root latch is held till the root node turns out to be safe, since emptying the root changes Root_node_id
+	path.hold_root()
+	root_id := file_header.Root_node_id
+	path.hold(root_id)
+
+	code, err := bplus_delete_helper(root_id, key, path, file_header, file)
+	if err != nil {
+		return err
+	}
+	if code == -1 {
+		return errors.New(fmt.Sprintf("coudn't find key %v in the b-tree with root id %v", key, root_id))
+	}
+
+	if code == 1 {
+		// The root wasn't safe (that is how we got here), so the root latch is still held
+		root_node, err := bplus_read_node(root_id, file)
+		if err != nil {
+			return err
+		}
+		if root_node.Block_size == 0 {
+			// An internal root is left with a single child, which takes its place. An empty leaf leaves an empty tree
+			err = DeletePage(root_id, file_header, file)
+			if err != nil {
+				return err
+			}
+			file_header.Root_node_id = root_node.Children[0]
+		}
+	}
+
+	add_to_total_data_size(-int64(len(data)), file_header, file)
+	return nil
+}
+
+func bplus_delete_helper(node_id uint32, key uint32, path *latch_path, file_header *FileHeaderPage, file *DBFile) (int, error) {
+	/*
+		OUTPUT:
+			1. An integer code
+				-> -1 = The key was not found
+				->  0 = The key was deleted
+				->  1 = The key was deleted, but now `node_id` has too few keys and needs to be rebalanced by its parent
+			2. error
+		`node_id` must already be latched in `path`
+	*/
+
+	node, err := bplus_read_node(node_id, file)
+	if err != nil {
+		return -1, err
+	}
+
+	// This node will not need rebalancing, so nothing above it will be touched by this delete anymore
+	if node_safe_for_delete(node, file) {
+		path.release_above(node_id)
+	}
+
+	if node.Keys_only == 0 {
+		// This is a leaf
+		_, inArr := binary_index_node(node.Blocks[:node.Block_size], 0, int(node.Block_size), key)
+		if !inArr {
+			return -1, nil
+		}
+		err = Delete_in_NodePage(node_id, key, false, file_header, file)
+		if err != nil {
+			return -1, errors.Wrap(err, fmt.Sprintf("error while trying to delete key %v from the leaf %v", key, node_id))
+		}
+		if int(node.Block_size)-1 < node_min_block_size(node, file) {
+			return 1, nil
+		}
+		return 0, nil
+	}
+
+	ind := bplus_child_index(node, key)
+	path.hold(node.Children[ind])
+	code, err := bplus_delete_helper(node.Children[ind], key, path, file_header, file)
+	if err != nil || code != 1 {
+		return code, err
+	}
+
+	err = bplus_rebalance(node_id, ind, path, file_header, file)
+	if err != nil {
+		return -1, err
+	}
+	node, err = bplus_read_node(node_id, file)
+	if err != nil {
+		return -1, err
+	}
+	if int(node.Block_size) < node_min_block_size(node, file) {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func bplus_rebalance(node_id uint32, ind int, path *latch_path, file_header *FileHeaderPage, file *DBFile) error {
+	/*
+		The child at `ind` of `node_id` has too few keys. Internal children go through merge (like in the B-Tree), and
+		leaves:
+			1. Take the first key of the right sibling, if it can spare one
+			2. Take the last key of the left sibling, if it can spare one
+			3. Merge with the left sibling, or else the right one (the right leaf of the two always goes)
+		`node_id` and its child at `ind` must already be latched in `path`, the siblings get latched here
+	*/
+
+	node, err := bplus_read_node(node_id, file)
+	if err != nil {
+		return err
+	}
+	child_id := node.Children[ind]
+	child, err := bplus_read_node(child_id, file)
+	if err != nil {
+		return err
+	}
+	if child.Keys_only != 0 {
+		return merge(node_id, ind, path, file_header, file)
+	}
+	if int(child.Block_size) >= node_min_block_size(child, file) {
+		return nil
+	}
+
+	// Case 1
+	if ind < int(node.Block_size) {
+		right_id := node.Children[ind+1]
+		path.hold(right_id)
+		right, err := bplus_read_node(right_id, file)
+		if err != nil {
+			return err
+		}
+		if sibling_can_spare_key(child, right, file) {
+			return bplus_shift_left(node_id, ind, file_header, file)
+		}
+	}
+
+	// Case 2
+	if ind > 0 {
+		left_id := node.Children[ind-1]
+		path.hold(left_id)
+		left, err := bplus_read_node(left_id, file)
+		if err != nil {
+			return err
+		}
+		if sibling_can_spare_key(child, left, file) {
+			return bplus_shift_right(node_id, ind-1, file_header, file)
+		}
+	}
+
+	// Case 3
+	if ind > 0 {
+		return bplus_merge_leaves(node_id, ind-1, path, file_header, file)
+	}
+	if ind < int(node.Block_size) {
+		return bplus_merge_leaves(node_id, ind, path, file_header, file)
+	}
+	return nil
+}
+
+func bplus_shift_left(node_id uint32, ind int, file_header *FileHeaderPage, file *DBFile) error {
+	// The first key of the leaf at `ind+1` moves to the end of the leaf at `ind`, and their separator becomes the
+	// next key of the right leaf. `node_id` and both leaves must already be latched
+
+	node, err := bplus_read_node(node_id, file)
+	if err != nil {
+		return err
+	}
+	right_id := node.Children[ind+1]
+	right, err := bplus_read_node(right_id, file)
+	if err != nil {
+		return err
+	}
+	err = bplus_move_key(right_id, node.Children[ind], right.Blocks[0].Key, file_header, file)
+	if err != nil {
+		return err
+	}
+	return bplus_set_separator(node_id, ind, right.Blocks[1].Key, file_header, file)
+}
+
+func bplus_shift_right(node_id uint32, ind int, file_header *FileHeaderPage, file *DBFile) error {
+	// The last key of the leaf at `ind` moves to the front of the leaf at `ind+1`, and becomes their separator
+	// `node_id` and both leaves must already be latched
+
+	node, err := bplus_read_node(node_id, file)
+	if err != nil {
+		return err
+	}
+	left_id := node.Children[ind]
+	left, err := bplus_read_node(left_id, file)
+	if err != nil {
+		return err
+	}
+	moved_key := left.Blocks[left.Block_size-1].Key
+	err = bplus_move_key(left_id, node.Children[ind+1], moved_key, file_header, file)
+	if err != nil {
+		return err
+	}
+	return bplus_set_separator(node_id, ind, moved_key, file_header, file)
+}
+
+func bplus_set_separator(node_id uint32, ind int, key uint32, file_header *FileHeaderPage, file *DBFile) error {
+
+	node, err := bplus_read_node(node_id, file)
+	if err != nil {
+		return err
+	}
+	node.Blocks[ind].Key = key
+	return SavePage(node_id, Data_to_Bytes(node), file_header, file)
+}
+
+func bplus_merge_leaves(node_id uint32, ind int, path *latch_path, file_header *FileHeaderPage, file *DBFile) error {
+	// Moves everything from the leaf at `ind+1` into the one at `ind`, and drops it along with their separator
+
+	node, err := bplus_read_node(node_id, file)
+	if err != nil {
+		return err
+	}
+	left_id := node.Children[ind]
+	right_id := node.Children[ind+1]
+	right, err := bplus_read_node(right_id, file)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < int(right.Block_size); i++ {
+		data, found, err := Read_from_NodePage(right_id, right.Blocks[i].Key, file_header, file)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return errors.New(fmt.Sprintf("coudn't find key %v in the leaf %v", right.Blocks[i].Key, right_id))
+		}
+		err = Put_in_NodePage(left_id, right.Blocks[i].Key, data, 0, false, file_header, file)
+		if err != nil {
+			return err
+		}
+	}
+
+	left, err := bplus_read_node(left_id, file)
+	if err != nil {
+		return err
+	}
+	left.Right_link = right.Right_link
+	err = SavePage(left_id, Data_to_Bytes(left), file_header, file)
+	if err != nil {
+		return err
+	}
+	if right.Right_link != 0 {
+		err = bplus_set_left_link(right.Right_link, left_id, path, file_header, file)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = Delete_in_NodePage(node_id, node.Blocks[ind].Key, false, file_header, file)
+	if err != nil {
+		return err
+	}
+	return DeletePage(right_id, file_header, file)
+}
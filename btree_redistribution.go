@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	Making room in a full node before splitting it (B*-Tree style), used by Insert in every tree mode.
+
+	When an insert leaves a node with max_degree keys, its parent first tries to hand some of them to a sibling:
+		-> If the left or the right sibling has room, keys are rotated through the parent into it (the same rotations
+		   merge uses for deletes, see rotate_left and rotate_right) till both nodes have about as many keys.
+		-> If every sibling is full as well, the node is split off centre and then one full sibling gives keys to the
+		   new half, so two full nodes become three nodes about two thirds full (instead of the usual half full).
+		-> A node without siblings (the root, or a child of a node with no keys left) is split in the middle.
+	Appending at the end of the rightmost node (see split_index) skips all of this, as the node on the left is never
+	going to get any more keys.
+
+	B+ leaves move their keys to each other directly and only the separator in the parent changes (see
+	bplus_shift_left and bplus_shift_right). The siblings are latched right after the node (like merge does), while
+	the parent is still latched.
+*/
+
+func split_node(node_id uint32, mid int, path *latch_path, file_header *FileHeaderPage, file *DBFile) (uint32, []byte, uint32, error) {
+	// Splits the full node at `mid`, returns the key for the parent (and its data), and the new node on the right
+
+	pt, _, node, _, err := ReadPage(file, node_id)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	if pt != Page_type_ids["Node"] {
+		return 0, nil, 0, errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node_id, pt))
+	}
+	if is_bplus(file_header) && node.Keys_only == 0 {
+		push_to_top_key, new_node_id, err := bplus_split_leaf(node_id, mid, path, file_header, file)
+		return push_to_top_key, nil, new_node_id, err
+	}
+	return split(node_id, mid, file_header, file)
+}
+
+func shift_keys(node_id uint32, from int, to int, num_keys int, file_header *FileHeaderPage, file *DBFile) error {
+	// Moves `num_keys` keys from the child at `from` to the child next to it at `to`
+
+	pt, _, node, _, err := ReadPage(file, node_id)
+	if err != nil {
+		return err
+	}
+	if pt != Page_type_ids["Node"] {
+		return errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node_id, pt))
+	}
+	pt, _, child, _, err := ReadPage(file, node.Children[from])
+	if err != nil {
+		return err
+	}
+	if pt != Page_type_ids["Node"] {
+		return errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node.Children[from], pt))
+	}
+	leaves := is_bplus(file_header) && child.Keys_only == 0
+
+	for i := 0; i < num_keys; i++ {
+		switch {
+		case to == from-1 && leaves:
+			err = bplus_shift_left(node_id, to, file_header, file)
+		case to == from-1:
+			err = rotate_left(node_id, to, file_header, file)
+		case to == from+1 && leaves:
+			err = bplus_shift_right(node_id, from, file_header, file)
+		case to == from+1:
+			err = rotate_right(node_id, from, file_header, file)
+		default:
+			return errors.New(fmt.Sprintf("the children %v and %v of the nodepage %v aren't next to each other", from, to, node_id))
+		}
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("error while trying to move a key from the child %v to the child %v of the nodepage %v", from, to, node_id))
+		}
+	}
+	return nil
+}
+
+func make_room_in_child(node_id uint32, ind int, appending bool, path *latch_path, file_header *FileHeaderPage, file *DBFile) error {
+	/*
+		The child at `ind` of `node_id` has max_degree keys. Gives some of them to a sibling, or else splits it (which
+		puts one more key in `node_id`, the caller checks if that made it full in turn).
+		`node_id` and its child at `ind` must already be latched in `path`, the siblings get latched here
+	*/
+
+	pt, _, node, _, err := ReadPage(file, node_id)
+	if err != nil {
+		return err
+	}
+	if pt != Page_type_ids["Node"] {
+		return errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node_id, pt))
+	}
+	pt, _, child, _, err := ReadPage(file, node.Children[ind])
+	if err != nil {
+		return err
+	}
+	if pt != Page_type_ids["Node"] {
+		return errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node.Children[ind], pt))
+	}
+	max_degree := node_max_degree(child)
+
+	// Hand keys to a sibling with room, evening the two out
+	full_sibling := -1
+	if !appending {
+		for _, sibling := range []int{ind - 1, ind + 1} {
+			if sibling < 0 || sibling > int(node.Block_size) {
+				continue
+			}
+			path.hold(node.Children[sibling])
+			pt, _, sibling_node, _, err := ReadPage(file, node.Children[sibling])
+			if err != nil {
+				return err
+			}
+			if pt != Page_type_ids["Node"] {
+				return errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node.Children[sibling], pt))
+			}
+			if int(sibling_node.Block_size) < max_degree-1 {
+				return shift_keys(node_id, ind, sibling, (int(child.Block_size)-int(sibling_node.Block_size))/2, file_header, file)
+			}
+			if full_sibling == -1 {
+				full_sibling = sibling
+			}
+		}
+	}
+
+	// Split the child, leaving the half next to the full sibling smaller, so that the sibling can even it out
+	mid := split_index(max_degree, appending, file)
+	if full_sibling == ind-1 {
+		mid = max_degree / 3
+	} else if full_sibling == ind+1 {
+		mid = max_degree * 2 / 3
+	}
+	push_to_top_key, push_to_top_data, new_node_id, err := split_node(node.Children[ind], mid, path, file_header, file)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("error while trying to split the nodepage %v", node.Children[ind]))
+	}
+	err = Put_in_NodePage(node_id, push_to_top_key, push_to_top_data, new_node_id, false, file_header, file)
+	if err != nil {
+		return err
+	}
+	if full_sibling == -1 {
+		return nil
+	}
+
+	// The two halves are now at `ind` and `ind+1`, and the full sibling moved over by one if it was on the right
+	from, to := ind-1, ind
+	if full_sibling == ind+1 {
+		from, to = ind+2, ind+1
+	}
+	pt, _, node, _, err = ReadPage(file, node_id)
+	if err != nil {
+		return err
+	}
+	if pt != Page_type_ids["Node"] {
+		return errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node_id, pt))
+	}
+	path.hold(node.Children[to])
+	pt, _, from_node, _, err := ReadPage(file, node.Children[from])
+	if err != nil {
+		return err
+	}
+	if pt != Page_type_ids["Node"] {
+		return errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node.Children[from], pt))
+	}
+	pt, _, to_node, _, err := ReadPage(file, node.Children[to])
+	if err != nil {
+		return err
+	}
+	if pt != Page_type_ids["Node"] {
+		return errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node.Children[to], pt))
+	}
+	return shift_keys(node_id, from, to, (int(from_node.Block_size)-int(to_node.Block_size))/2, file_header, file)
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	Buffer pool, the page cache sitting between the B-Tree and the db file.
+
+	ReadChunk, ReadPage, WriteChunk (and so SavePage) all go through it when it is turned on (ConnectOptions.Buffer_pool_bytes).
+	Every cached page is kept as the raw page that is (or will be) in the PageStore, along with the decoded page, which is made
+	the first time ReadPage asks for it after the page was loaded or written. ReadPage hands out copies of the decoded
+	page, so callers are still free to change what they get and save it back, exactly like before.
+
+	Writes only go to the cache and mark the page dirty. Dirty pages reach the disk when they are evicted, and all of
+	them on Commit and DisconnectDB. As pages can now exist in the cache before they exist in the file, the size of the
+	db is whatever the pool says it is (see num_pages_in_db_file), and the file only catches up on a flush. So nothing
+	is durable before Commit or DisconnectDB (there is no commit on a timer), a crash loses everything done since the
+	last one. Whatever got evicted in the meantime is in the file, but no File Header points to it yet.
+
+	A page is pinned while someone is copying in or out of it, pinned pages are never evicted. The pool's lock is only
+	held while frames are looked up, reserved and dropped, never during disk I/O, so hits from many goroutines don't
+	wait behind anyone's read or write-back:
+		miss		->	a frame is reserved for the page and locked before anyone else can see it, and the page is read
+						into it after letting go of the pool's lock. Others asking for the same page wait on that
+						frame alone.
+		eviction	->	the victim is moved from `frames` to `evicting` and written back (if dirty) by the goroutine
+						which needed the room, again without the pool's lock. A miss on a page which is still in
+						`evicting` takes the frame back as it is, so a page is never read from the disk while its newer
+						copy is being written back.
+	A frame's lock may be taken while holding the pool's lock, never the other way round.
+
+	Which page gets evicted is up to the eviction policy (see eviction_policies.go), pinned pages are skipped. With
+	ConnectOptions.Pin_internal_nodes the internal NodePages are skipped as well, so the top of the tree always stays in
+	memory however much is scanned. If nothing can be evicted, the pool grows past its budget for a moment and shrinks
+	back on the next misses.
+*/
+
+const Default_buffer_pool_bytes = 8 << 20 // 8MB
+
+type buffer_frame struct {
+	page_id     uint32
+	pin_count   int  // Guarded by the pool's lock
+	internal    bool // Guarded by the pool's lock, an internal NodePage (known once the page is decoded)
+	write_backs int  // Guarded by the pool's lock, evictions of the frame still writing it back
+
+	lock     sync.RWMutex // Guards everything below
+	data     []byte       // One page
+	dirty    bool
+	load_err error // The page couldn't be read into the frame, which is dropped
+
+	decoded     bool // The pointers below are filled, they are never handed out (only copies of them)
+	page_type   uint8
+	file_header *FileHeaderPage
+	node        *NodePage
+	data_page   *DataPage
+}
+
+type BufferPool struct {
+	lock               sync.Mutex
+	frames             map[uint32]*buffer_frame
+	evicting           map[uint32]*buffer_frame // Evicted frames which are still being written back
+	policy             eviction_policy
+	max_frames         int
+	pin_internal_nodes bool
+	num_pages          uint32 // Size of the db in pages, including the pages not yet flushed to the file
+
+	hits        uint64
+	misses      uint64
+	evictions   uint64
+	write_backs uint64
+}
+
+type BufferPoolStats struct {
+	Hits         uint64
+	Misses       uint64
+	Evictions    uint64
+	Write_backs  uint64
+	Cached_pages int
+	Dirty_pages  int
+	Max_pages    int
+}
+
+func new_buffer_pool(budget_bytes int, policy_id uint8, pin_internal_nodes bool, file *DBFile) (*BufferPool, error) {
+
+	size, err := file.store.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	// A cached page costs its raw bytes plus the decoded copy
+	page_size := file.layout.page_size
+	max_frames := budget_bytes / (2 * page_size)
+	if max_frames < 1 {
+		return nil, errors.New(fmt.Sprintf("buffer pool budget of %v bytes can't hold even a single page (%v bytes)", budget_bytes, 2*page_size))
+	}
+	policy, err := new_eviction_policy(policy_id, max_frames)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BufferPool{
+		frames:             make(map[uint32]*buffer_frame),
+		evicting:           make(map[uint32]*buffer_frame),
+		policy:             policy,
+		max_frames:         max_frames,
+		pin_internal_nodes: pin_internal_nodes,
+		num_pages:          uint32(size / int64(page_size)),
+	}, nil
+}
+
+func Buffer_pool_stats(file *DBFile) BufferPoolStats {
+	pool := file.pool
+	if pool == nil {
+		return BufferPoolStats{}
+	}
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	stats := BufferPoolStats{
+		Hits:         pool.hits,
+		Misses:       pool.misses,
+		Evictions:    pool.evictions,
+		Write_backs:  pool.write_backs,
+		Cached_pages: len(pool.frames),
+		Max_pages:    pool.max_frames,
+	}
+	for _, frame := range pool.frames {
+		frame.lock.RLock()
+		if frame.dirty {
+			stats.Dirty_pages++
+		}
+		frame.lock.RUnlock()
+	}
+	return stats
+}
+
+// PINNING
+
+func (pool *BufferPool) pin(page_id uint32, load bool, file *DBFile) (*buffer_frame, error) {
+	// `load` = false is for pages which are about to be overwritten completely, there is no point in reading them first
+
+	pool.lock.Lock()
+
+	frame, ok := pool.frames[page_id]
+	if ok {
+		pool.hits++
+		frame.pin_count++
+		pool.policy.accessed(page_id)
+		pool.lock.Unlock()
+		return pool.wait_for_load(frame)
+	}
+	frame, ok = pool.evicting[page_id]
+	if ok {
+		// Still being written back, but it is the newest copy of the page, so it just comes back
+		delete(pool.evicting, page_id)
+		pool.hits++
+		frame.pin_count++
+		pool.frames[page_id] = frame
+		pool.policy.added(page_id)
+		pool.lock.Unlock()
+		return frame, nil
+	}
+	pool.misses++
+
+	if page_id >= pool.num_pages && load {
+		pool.lock.Unlock()
+		return nil, errors.New(fmt.Sprintf("Specified pageIndex = %v is out of the scope of the file", page_id))
+	}
+
+	victims := pool.pick_victims()
+	frame = &buffer_frame{page_id: page_id, pin_count: 1, data: make([]byte, file.layout.page_size)}
+	frame.lock.Lock() // Till the page is in it
+	pool.frames[page_id] = frame
+	pool.policy.added(page_id)
+	pool.lock.Unlock()
+
+	err := pool.write_back(victims, file)
+	if err == nil && load {
+		var buf []byte
+		buf, err = read_chunk_from_store(file, page_id)
+		if err == nil {
+			copy(frame.data, buf)
+		}
+	}
+	if err != nil {
+		frame.load_err = err
+		frame.lock.Unlock()
+
+		pool.lock.Lock()
+		if pool.frames[page_id] == frame {
+			delete(pool.frames, page_id)
+			pool.policy.removed(page_id)
+		}
+		frame.pin_count--
+		pool.lock.Unlock()
+		return nil, err
+	}
+	frame.lock.Unlock()
+	return frame, nil
+}
+
+func (pool *BufferPool) wait_for_load(frame *buffer_frame) (*buffer_frame, error) {
+	// For a frame which may still be being loaded by someone else
+
+	frame.lock.RLock()
+	err := frame.load_err
+	frame.lock.RUnlock()
+	if err != nil {
+		pool.unpin(frame)
+		return nil, err
+	}
+	return frame, nil
+}
+
+func (pool *BufferPool) unpin(frame *buffer_frame) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	frame.pin_count--
+}
+
+func (pool *BufferPool) pick_victims() []*buffer_frame {
+	// Makes room for one more frame, the victims are then written back with write_back
+	// The caller holds the pool's lock
+
+	evictable := func(page_id uint32) bool {
+		frame := pool.frames[page_id]
+		return frame.pin_count == 0 && !(pool.pin_internal_nodes && frame.internal)
+	}
+
+	var victims []*buffer_frame
+	for len(pool.frames) >= pool.max_frames {
+		victim_id, found := pool.policy.victim(evictable)
+		if !found {
+			// Everything is pinned, go over the budget for now
+			break
+		}
+		victim := pool.frames[victim_id]
+		delete(pool.frames, victim_id)
+		pool.policy.removed(victim_id)
+		pool.evicting[victim_id] = victim
+		victim.write_backs++
+		pool.evictions++
+		victims = append(victims, victim)
+	}
+	return victims
+}
+
+func (pool *BufferPool) write_back(victims []*buffer_frame, file *DBFile) error {
+	// Writes the dirty victims to the store, without the pool's lock. A victim which couldn't be written goes back into
+	// the pool, so that its changes aren't lost
+
+	var first_err error
+	for _, victim := range victims {
+		written := false
+		victim.lock.Lock()
+		var err error
+		if victim.dirty {
+			err = write_chunk_to_store(file, victim.page_id, victim.data)
+			if err == nil {
+				victim.dirty = false
+				written = true
+			}
+		}
+		victim.lock.Unlock()
+
+		pool.lock.Lock()
+		victim.write_backs--
+		if written {
+			pool.write_backs++
+		}
+		if pool.evicting[victim.page_id] == victim && victim.write_backs == 0 {
+			delete(pool.evicting, victim.page_id)
+			if err != nil {
+				pool.frames[victim.page_id] = victim
+				pool.policy.added(victim.page_id)
+			}
+		}
+		pool.lock.Unlock()
+
+		if err != nil && first_err == nil {
+			first_err = errors.Wrap(err, fmt.Sprintf("error while writing back the page %v before evicting it", victim.page_id))
+		}
+	}
+	return first_err
+}
+
+// READING AND WRITING PAGES
+
+func (pool *BufferPool) read_chunk(page_id uint32, file *DBFile) ([]byte, error) {
+
+	frame, err := pool.pin(page_id, true, file)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.unpin(frame)
+
+	buf := make([]byte, len(frame.data))
+	frame.lock.RLock()
+	copy(buf, frame.data)
+	frame.lock.RUnlock()
+	return buf, nil
+}
+
+func (pool *BufferPool) write_chunk(page_id uint32, data []byte, file *DBFile) error {
+
+	frame, err := pool.pin(page_id, false, file)
+	if err != nil {
+		return err
+	}
+	defer pool.unpin(frame)
+
+	frame.lock.Lock()
+	copy(frame.data, data)
+	frame.dirty = true
+	frame.decoded = false
+	frame.file_header, frame.node, frame.data_page = nil, nil, nil
+	frame.lock.Unlock()
+
+	pool.lock.Lock()
+	if page_id >= pool.num_pages {
+		pool.num_pages = page_id + 1
+	}
+	pool.lock.Unlock()
+	return nil
+}
+
+func (pool *BufferPool) read_page(page_id uint32, file *DBFile) (uint8, *FileHeaderPage, *NodePage, *DataPage, error) {
+
+	frame, err := pool.pin(page_id, true, file)
+	if err != nil {
+		return 0, nil, nil, nil, errors.Wrap(err, fmt.Sprintf("error while trying to read %v page from file", page_id))
+	}
+	defer pool.unpin(frame)
+
+	frame.lock.RLock()
+	if !frame.decoded {
+		// Decode it once, every later read of the page just copies it
+		frame.lock.RUnlock()
+		frame.lock.Lock()
+		if !frame.decoded {
+			pt, fp, np, dp, err := decode_page(page_id, frame.data, file.layout)
+			if err != nil {
+				frame.lock.Unlock()
+				return 0, nil, nil, nil, err
+			}
+			frame.page_type, frame.file_header, frame.node, frame.data_page = pt, fp, np, dp
+			frame.decoded = true
+		}
+		internal := frame.node != nil && frame.node.Children[0] != 0
+		frame.lock.Unlock()
+
+		// Not under the frame's lock, see the locking order at the top
+		pool.lock.Lock()
+		frame.internal = internal
+		pool.lock.Unlock()
+		frame.lock.RLock()
+	}
+	defer frame.lock.RUnlock()
+
+	var fp *FileHeaderPage
+	var np *NodePage
+	var dp *DataPage
+	if frame.file_header != nil {
+		temp := *frame.file_header
+		fp = &temp
+	}
+	if frame.node != nil {
+		np = frame.node.clone()
+	}
+	if frame.data_page != nil {
+		dp = frame.data_page.clone()
+	}
+	return frame.page_type, fp, np, dp, nil
+}
+
+// FLUSHING AND TRUNCATING
+
+func (pool *BufferPool) flush(file_header_slots bool, file *DBFile) error {
+	// Either just the File Header slots or every other page, see write_back_db for why
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	// In the order of the page ids, so that the writes go through the file from the start to the end
+	page_ids := make([]uint32, 0, len(pool.frames))
+	for page_id := range pool.frames {
+		if (page_id < num_file_header_slots) == file_header_slots {
+			page_ids = append(page_ids, page_id)
+		}
+	}
+	sort.Slice(page_ids, func(i, j int) bool { return page_ids[i] < page_ids[j] })
+
+	for _, page_id := range page_ids {
+		frame := pool.frames[page_id]
+		frame.lock.Lock()
+		if frame.dirty {
+			err := write_chunk_to_store(file, page_id, frame.data)
+			if err != nil {
+				frame.lock.Unlock()
+				return errors.Wrap(err, fmt.Sprintf("error while flushing the page %v", page_id))
+			}
+			frame.dirty = false
+			pool.write_backs++
+		}
+		frame.lock.Unlock()
+	}
+	return nil
+}
+
+func (pool *BufferPool) truncate(num_pages uint32, file *DBFile) error {
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	// The cut off pages are just dropped, dirty or not
+	for page_id, frame := range pool.frames {
+		if page_id < num_pages {
+			continue
+		}
+		if frame.pin_count != 0 {
+			return errors.New(fmt.Sprintf("cannot truncate the db file to %v pages while the page %v is pinned", num_pages, page_id))
+		}
+		delete(pool.frames, page_id)
+		pool.policy.removed(page_id)
+	}
+	pool.num_pages = num_pages
+
+	size, err := file.store.Size()
+	if err != nil {
+		return err
+	}
+	if size > int64(num_pages)*int64(file.layout.page_size) {
+		return file.store.Truncate(num_pages)
+	}
+	return nil
+}
+
+func flush_buffer_pool(file_header_slots bool, file *DBFile) error {
+	if file.pool == nil {
+		return nil
+	}
+	return file.pool.flush(file_header_slots, file)
+}
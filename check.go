@@ -0,0 +1,542 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	Structural integrity check of the db file (Check, `go run . check <db_name>`), which only reads it.
+
+	Everything reachable is walked from the File Header down, and every page of the file has to be exactly one of
+	the File Header slots, a NodePage of the tree, a DataPage of one node's chain, a free page (in the Free Space table
+	or the freelist) or a FreelistPage. Along the way it looks at:
+
+		tree		->	keys sorted within every node and between the separators of its parent, every leaf on the
+						same level, no node with more than max_degree-1 keys (or none at all, besides the root).
+						[BLink] Right_link to the next node on the level and High_key equal to the separator above.
+						[BPlus] Keys_only internal nodes without DataPages, and the leaves linked up both ways.
+		values		->	every data ref of a cell (and of every continued record) points to a record in the node's
+						own chain, no record used twice, and every value can be read back (decompressed if it was).
+		datapages	->	Parent_node_page of the node, Next_data_page going to DataPages which belong to nobody
+						else, slots within Data and not overlapping each other, Data_held adding up.
+		file header	->	Total_data_size, Total_pages and Freelist_size matching what was found, the free pages
+						wiped and none of them reachable as well (ids in the freelist past the end of the file are
+						left there by trimming, see freelist.go).
+
+	Nothing found is returned as an error, it all goes into the CheckReport (which is meant to be read by programs as
+	well, see its json tags). The error is only for when the check itself couldn't run.
+
+	The keys of every node besides the root have to be within node_min_block_size..max_degree-1, under the fill policy
+	kept in the File Header (so with Lazy_rebalance, just not empty). The only nodes allowed under it are the rightmost
+	ones of every level, since splitting them while appending leaves the new node just the last few keys, and these
+	are only warned about. So are records nobody points to and wiped pages at the end of the file (left there by the
+	compaction for the next trim), which only waste room.
+*/
+
+type CheckProblem struct {
+	Kind    string `json:"kind"`    // One of the check_* kinds below
+	Page_id uint32 `json:"page_id"` // Where it was found, 0 for the file as a whole
+	Message string `json:"message"`
+}
+
+type CheckReport struct {
+	Ok        bool   `json:"ok"` // No errors, there may still be warnings
+	Tree_mode string `json:"tree_mode"`
+
+	Num_pages          uint32 `json:"num_pages"` // Of the file
+	Num_node_pages     uint32 `json:"num_node_pages"`
+	Num_data_pages     uint32 `json:"num_data_pages"`
+	Num_free_pages     uint32 `json:"num_free_pages"`
+	Num_freelist_pages uint32 `json:"num_freelist_pages"`
+	Depth              int    `json:"depth"` // Levels of the tree, 0 if it is empty
+	Num_keys           uint64 `json:"num_keys"`
+	Total_data_size    uint64 `json:"total_data_size"` // Of the values found, to compare with the File Header
+
+	Errors   []CheckProblem `json:"errors"`
+	Warnings []CheckProblem `json:"warnings"`
+}
+
+const (
+	check_unreadable_page = "unreadable_page"
+	check_page_type       = "page_type"
+	check_page_reuse      = "page_reuse" // A page reachable twice, or both reachable and free
+	check_page_range      = "page_range"
+	check_leaked_page     = "leaked_page"
+	check_key_order       = "key_order"
+	check_leaf_depth      = "leaf_depth"
+	check_block_size      = "block_size"
+	check_underfull_node  = "underfull_node"
+	check_links           = "links"
+	check_data_ref        = "data_ref"
+	check_data_page       = "data_page"
+	check_orphan_record   = "orphan_record"
+	check_file_header     = "file_header"
+	check_free_space      = "free_space"
+)
+
+// Keys which may be under a node, from the separators above it
+type key_bounds struct {
+	lo, hi         uint32
+	has_lo, has_hi bool
+}
+
+type checked_node struct {
+	node_id uint32
+	np      *NodePage
+	bounds  key_bounds
+}
+
+type checker struct {
+	file_header *FileHeaderPage
+	file        *DBFile
+	report      *CheckReport
+	owners      map[uint32]string // What every page found so far is
+	levels      [][]checked_node  // The nodes of every level from left to right
+	leaf_depth  int               // -1 till the first leaf is found
+	data_size   uint64            // Of the values found so far
+	used_slots  map[uint32][]bool // DataPage -> which of its slots are pointed to
+}
+
+func (c *checker) fail(kind string, page_id uint32, format string, args ...any) {
+	c.report.Errors = append(c.report.Errors, CheckProblem{Kind: kind, Page_id: page_id, Message: fmt.Sprintf(format, args...)})
+}
+
+func (c *checker) warn(kind string, page_id uint32, format string, args ...any) {
+	c.report.Warnings = append(c.report.Warnings, CheckProblem{Kind: kind, Page_id: page_id, Message: fmt.Sprintf(format, args...)})
+}
+
+// Returns false if the page can't be taken as `what`, i.e. it is past the end of the file or already something else
+func (c *checker) claim(page_id uint32, what string) bool {
+	if page_id >= c.report.Num_pages {
+		c.fail(check_page_range, page_id, "%v is past the end of the file (%v pages)", what, c.report.Num_pages)
+		return false
+	}
+	if owner, ok := c.owners[page_id]; ok {
+		c.fail(check_page_reuse, page_id, "%v is already %v", what, owner)
+		return false
+	}
+	c.owners[page_id] = what
+	return true
+}
+
+func Check(file_header *FileHeaderPage, file *DBFile) (*CheckReport, error) {
+
+	file.lock.Lock()
+	defer file.lock.Unlock()
+
+	num_pages, err := num_pages_in_db_file(file)
+	if err != nil {
+		return nil, err
+	}
+	c := &checker{
+		file_header: file_header,
+		file:        file,
+		report:      &CheckReport{Num_pages: num_pages, Errors: []CheckProblem{}, Warnings: []CheckProblem{}},
+		owners:      make(map[uint32]string),
+		leaf_depth:  -1,
+		used_slots:  make(map[uint32][]bool),
+	}
+	for mode, id := range Tree_mode_ids {
+		if id == file_header.Tree_mode {
+			c.report.Tree_mode = mode
+		}
+	}
+	if c.report.Tree_mode == "" {
+		c.fail(check_file_header, 0, "unknown tree mode %v", file_header.Tree_mode)
+	}
+
+	for slot := uint32(0); slot < num_file_header_slots; slot++ {
+		c.claim(slot, "the file header")
+	}
+	if file_header.Root_node_id != 0 {
+		c.check_node(file_header.Root_node_id, 0, key_bounds{})
+	}
+	c.check_links()
+	c.check_free_pages()
+	c.check_totals()
+
+	c.report.Ok = len(c.report.Errors) == 0
+	return c.report, nil
+}
+
+// TREE
+
+func (c *checker) check_node(node_id uint32, depth int, bounds key_bounds) {
+
+	if !c.claim(node_id, "a nodepage") {
+		return
+	}
+	pt, _, np, _, err := ReadPage(c.file, node_id)
+	if err != nil {
+		c.fail(check_unreadable_page, node_id, "%v", err)
+		return
+	}
+	if pt != Page_type_ids["Node"] {
+		c.fail(check_page_type, node_id, "expected a nodepage, found a page of type %v", pt)
+		return
+	}
+	c.report.Num_node_pages++
+	for len(c.levels) <= depth {
+		c.levels = append(c.levels, nil)
+	}
+	c.levels[depth] = append(c.levels[depth], checked_node{node_id: node_id, np: np, bounds: bounds})
+
+	leaf := np.Children[0] == 0
+	bplus := is_bplus(c.file_header)
+
+	// Block_size
+	max_degree := node_max_degree(np)
+	if int(np.Block_size) > max_degree-1 {
+		c.fail(check_block_size, node_id, "%v keys, the node can only keep %v", np.Block_size, max_degree-1)
+		return
+	}
+	if np.Block_size == 0 && node_id != c.file_header.Root_node_id {
+		c.fail(check_block_size, node_id, "no keys in a node which isn't the root")
+	} else if int(np.Block_size) < node_min_block_size(np, c.file) && node_id != c.file_header.Root_node_id {
+		// Appends split the rightmost node of a level (the one without a separator above it) and leave it the last
+		// keys only, any other node that small should have been rebalanced
+		if bounds.has_hi {
+			c.fail(check_block_size, node_id, "%v keys, under the %v of the fill policy of the db", np.Block_size, node_min_block_size(np, c.file))
+		} else {
+			c.warn(check_underfull_node, node_id, "%v keys, under the %v of the fill policy (as appends may leave the rightmost node)", np.Block_size, node_min_block_size(np, c.file))
+		}
+	}
+
+	// Keys, within the node and within what the parent says
+	for i := 0; i < int(np.Block_size); i++ {
+		key := np.Blocks[i].Key
+		if i > 0 && key <= np.Blocks[i-1].Key {
+			c.fail(check_key_order, node_id, "key %v at %v isn't bigger than key %v before it", key, i, np.Blocks[i-1].Key)
+		}
+		// A key equal to a B+ separator is under the child to its right
+		if bounds.has_lo && (key < bounds.lo || (key == bounds.lo && !bplus)) {
+			c.fail(check_key_order, node_id, "key %v at %v is below the separator %v of the parent", key, i, bounds.lo)
+		}
+		if bounds.has_hi && key >= bounds.hi {
+			c.fail(check_key_order, node_id, "key %v at %v isn't below the separator %v of the parent", key, i, bounds.hi)
+		}
+	}
+
+	// Keys_only
+	keys_only := bplus && !leaf
+	if (np.Keys_only != 0) != keys_only {
+		c.fail(check_page_type, node_id, "Keys_only is %v for a node which is a leaf = %v of a %v tree", np.Keys_only, leaf, c.report.Tree_mode)
+	} else if np.Keys_only != 0 {
+		if np.Data_page_id != 0 {
+			c.fail(check_data_page, node_id, "the node keeps only keys, but has the datapage %v", np.Data_page_id)
+		}
+	} else {
+		c.report.Num_keys += uint64(np.Block_size)
+		c.check_values(node_id, np)
+	}
+
+	// Children
+	if leaf {
+		for i := 0; i <= int(np.Block_size); i++ {
+			if np.Children[i] != 0 {
+				c.fail(check_page_type, node_id, "leaf with the child %v at %v", np.Children[i], i)
+			}
+		}
+		if c.leaf_depth == -1 {
+			c.leaf_depth = depth
+		} else if c.leaf_depth != depth {
+			c.fail(check_leaf_depth, node_id, "leaf at depth %v, the first leaf was at depth %v", depth, c.leaf_depth)
+		}
+		return
+	}
+	for i := 0; i <= int(np.Block_size); i++ {
+		if np.Children[i] == 0 {
+			c.fail(check_page_type, node_id, "internal node without a child at %v", i)
+			continue
+		}
+		child_bounds := bounds
+		if i > 0 {
+			child_bounds.lo, child_bounds.has_lo = np.Blocks[i-1].Key, true
+		}
+		if i < int(np.Block_size) {
+			child_bounds.hi, child_bounds.has_hi = np.Blocks[i].Key, true
+		}
+		c.check_node(np.Children[i], depth+1, child_bounds)
+	}
+}
+
+func (c *checker) check_links() {
+
+	c.report.Depth = len(c.levels)
+	for depth, level := range c.levels {
+		for i, node := range level {
+			var right, left uint32
+			if i+1 < len(level) {
+				right = level[i+1].node_id
+			}
+			if i > 0 {
+				left = level[i-1].node_id
+			}
+
+			if is_blink(c.file_header) {
+				if node.np.Right_link != right {
+					c.fail(check_links, node.node_id, "Right_link is %v, the next node on the level is %v", node.np.Right_link, right)
+				}
+				if right != 0 && (!node.bounds.has_hi || node.np.High_key != node.bounds.hi) {
+					c.fail(check_links, node.node_id, "High_key is %v, the separator above the node is %v", node.np.High_key, node.bounds.hi)
+				}
+			}
+			if is_bplus(c.file_header) && depth == len(c.levels)-1 {
+				if node.np.Right_link != right {
+					c.fail(check_links, node.node_id, "Right_link is %v, the next leaf is %v", node.np.Right_link, right)
+				}
+				if node.np.Left_link != left {
+					c.fail(check_links, node.node_id, "Left_link is %v, the leaf before is %v", node.np.Left_link, left)
+				}
+			}
+		}
+	}
+}
+
+// VALUES
+
+func (c *checker) check_values(node_id uint32, np *NodePage) {
+
+	if np.Data_page_id == 0 {
+		c.fail(check_data_page, node_id, "the node keeps values, but has no datapage")
+		return
+	}
+
+	// The chain of the node, as far as it goes right
+	chain := new_data_chain(np.Data_page_id)
+	for chain.next != 0 {
+		page_id := chain.next
+		if !c.claim(page_id, fmt.Sprintf("datapage %v of the nodepage %v", len(chain.pages), node_id)) {
+			break
+		}
+		_, err := chain.page(len(chain.pages), c.file)
+		if err != nil {
+			c.fail(check_data_page, page_id, "%v", err)
+			break
+		}
+		c.report.Num_data_pages++
+		c.check_data_page(page_id, node_id, chain.pages[len(chain.pages)-1])
+	}
+
+	for i := 0; i < int(np.Block_size); i++ {
+		off := np.Blocks[i].Offset
+		if off&data_ref_inline != 0 {
+			data, err := read_node_value(np, i, c.file_header, c.file)
+			if err != nil {
+				c.fail(check_data_ref, node_id, "key %v: %v", np.Blocks[i].Key, err)
+				continue
+			}
+			c.data_size += uint64(len(data))
+			continue
+		}
+		length, err := c.check_value(off, chain)
+		if err != nil {
+			c.fail(check_data_ref, node_id, "key %v: %v", np.Blocks[i].Key, err)
+			continue
+		}
+		c.data_size += uint64(length)
+	}
+
+	// Records nobody points to
+	for i, dp := range chain.pages {
+		used := c.used_slots[chain.ids[i]] // nil if no value is kept in this DataPage
+		for slot := uint16(0); slot < dp.Num_slots && int(slot) < len(dp.Slots); slot++ {
+			if dp.Slots[slot].Length != 0 && (int(slot) >= len(used) || !used[slot]) {
+				c.warn(check_orphan_record, chain.ids[i], "the record in the slot %v isn't a value of the nodepage %v", slot, node_id)
+			}
+		}
+	}
+}
+
+func (c *checker) check_value(ref uint32, chain *data_chain) (int, error) {
+	// Like data_chain.get_value, but every record taken is marked in used_slots
+
+	var data []byte
+	var flags uint8
+	for pieces := 0; ; pieces++ {
+		chain_ind, slot := split_data_ref(ref)
+		if chain_ind >= len(chain.pages) {
+			return 0, errors.New(fmt.Sprintf("the data ref %v is past the %v datapages of the chain", ref, len(chain.pages)))
+		}
+		page_id := chain.ids[chain_ind]
+		used := c.used_slots[page_id]
+		if used == nil {
+			used = make([]bool, len(chain.pages[chain_ind].Slots))
+			c.used_slots[page_id] = used
+		}
+		if int(slot) >= len(used) {
+			return 0, errors.New(fmt.Sprintf("the data ref %v is past the %v slots of the datapage %v", ref, len(used), page_id))
+		}
+		if used[slot] {
+			return 0, errors.New(fmt.Sprintf("the record at %v (slot %v of the datapage %v) is used more than once", ref, slot, page_id))
+		}
+		record, err := data_page_record(chain.pages[chain_ind], slot)
+		if err != nil {
+			return 0, errors.New(fmt.Sprintf("data ref %v in the datapage %v: %v", ref, page_id, err))
+		}
+		used[slot] = true
+
+		if pieces == 0 {
+			flags = record[0] & DATA_RECORD_COMPRESSED
+		}
+		if record[0]&DATA_RECORD_CONTINUED == 0 {
+			data = append(data, record[data_record_header_size:]...)
+			break
+		}
+		if len(record) < data_record_continued_size {
+			return 0, errors.New(fmt.Sprintf("the record at %v is too short to be continued", ref))
+		}
+		data = append(data, record[data_record_continued_size:]...)
+		ref = NativeEndian.Uint32(record[data_record_header_size:data_record_continued_size])
+	}
+
+	value, err := decode_value(data, flags)
+	if err != nil {
+		return 0, err
+	}
+	return len(value), nil
+}
+
+func (c *checker) check_data_page(page_id uint32, node_id uint32, dp *DataPage) {
+
+	if dp.Parent_node_page != node_id {
+		c.fail(check_data_page, page_id, "Parent_node_page is %v, the datapage is in the chain of the nodepage %v", dp.Parent_node_page, node_id)
+	}
+	if int(dp.Num_slots) > len(dp.Slots) {
+		c.fail(check_data_page, page_id, "%v slots used, there are only %v", dp.Num_slots, len(dp.Slots))
+		return
+	}
+
+	// The records can't go past Data or over each other
+	type record_span struct{ start, end int }
+	var spans []record_span
+	held := 0
+	for slot := uint16(0); slot < dp.Num_slots; slot++ {
+		s := dp.Slots[slot]
+		if s.Length == 0 {
+			continue
+		}
+		if int(s.Offset)+int(s.Length) > len(dp.Data) {
+			c.fail(check_data_page, page_id, "the record in the slot %v goes past the end of the datapage", slot)
+			continue
+		}
+		held += int(s.Length)
+		spans = append(spans, record_span{int(s.Offset), int(s.Offset) + int(s.Length)})
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	for i := 1; i < len(spans); i++ {
+		if spans[i].start < spans[i-1].end {
+			c.fail(check_data_page, page_id, "the records at %v and %v overlap", spans[i-1].start, spans[i].start)
+		}
+	}
+	if held != int(dp.Data_held) {
+		c.fail(check_data_page, page_id, "Data_held is %v, the records take up %v bytes", dp.Data_held, held)
+	}
+}
+
+// FREE PAGES
+
+func (c *checker) claim_free_page(page_id uint32, what string) {
+
+	if !c.claim(page_id, what) {
+		return
+	}
+	c.report.Num_free_pages++
+	buf, err := ReadChunk(c.file, page_id)
+	if err != nil {
+		c.fail(check_unreadable_page, page_id, "%v", err)
+		return
+	}
+	ident, page_type := decode_page_start(buf)
+	if ident == PAGE_IDENTITY_NUM {
+		c.fail(check_free_space, page_id, "%v, but it still holds a page of type %v", what, page_type)
+	}
+}
+
+func (c *checker) check_free_pages() {
+
+	fh := c.file_header
+	table_size := int(fh.Space_table_size)
+	if table_size > num_free_space_entries_file_header {
+		c.fail(check_free_space, 0, "Space_table_size is %v, the table only has %v rows", table_size, num_free_space_entries_file_header)
+		table_size = num_free_space_entries_file_header
+	}
+	for i := 0; i < table_size; i++ {
+		row := fh.Free_space_table[i]
+		if row.Num_pages == 0 || row.Page_id < num_file_header_slots {
+			c.fail(check_free_space, row.Page_id, "the row %v of the free space table is %v pages from %v", i, row.Num_pages, row.Page_id)
+			continue
+		}
+		for j := uint32(0); j < uint32(row.Num_pages); j++ {
+			c.claim_free_page(row.Page_id+j, fmt.Sprintf("a free page of the row %v of the free space table", i))
+		}
+	}
+
+	var freelist_size uint32
+	for page_id := fh.Freelist_head; page_id != 0; {
+		if !c.claim(page_id, "a freelist page") {
+			break
+		}
+		fp, err := read_freelist_page(page_id, c.file)
+		if err != nil {
+			c.fail(check_free_space, page_id, "%v", err)
+			break
+		}
+		c.report.Num_freelist_pages++
+		if int(fp.Num_entries) > len(fp.Page_ids) {
+			c.fail(check_free_space, page_id, "%v entries in the freelist page, there is only room for %v", fp.Num_entries, len(fp.Page_ids))
+			break
+		}
+		for _, free_id := range fp.Page_ids[:fp.Num_entries] {
+			if free_id >= c.report.Num_pages {
+				continue // Trimmed off the end of the file, and not yet popped (see freelist.go)
+			}
+			c.claim_free_page(free_id, fmt.Sprintf("a free page of the freelist page %v", page_id))
+		}
+		freelist_size += fp.Num_entries
+		page_id = fp.Next_freelist_page
+	}
+	if freelist_size != fh.Freelist_size {
+		c.fail(check_file_header, 0, "Freelist_size is %v, the freelist has %v pages", fh.Freelist_size, freelist_size)
+	}
+
+	// Pages which are nothing at all. Wiped ones at the very end are left by the compaction for the next trim
+	trailing := true
+	for page_id := c.report.Num_pages; page_id > 0; page_id-- {
+		if _, ok := c.owners[page_id-1]; ok {
+			trailing = false
+			continue
+		}
+		buf, err := ReadChunk(c.file, page_id-1)
+		if err != nil {
+			c.fail(check_unreadable_page, page_id-1, "%v", err)
+			continue
+		}
+		ident, page_type := decode_page_start(buf)
+		if trailing && ident != PAGE_IDENTITY_NUM {
+			c.warn(check_leaked_page, page_id-1, "wiped page at the end of the file which isn't free")
+			continue
+		}
+		trailing = false
+		if ident == PAGE_IDENTITY_NUM {
+			c.fail(check_leaked_page, page_id-1, "page of type %v which is neither reachable nor free", page_type)
+		} else {
+			c.fail(check_leaked_page, page_id-1, "wiped page which isn't free")
+		}
+	}
+}
+
+func (c *checker) check_totals() {
+
+	c.report.Total_data_size = c.data_size
+	if c.file_header.Total_data_size != c.data_size {
+		c.fail(check_file_header, 0, "Total_data_size is %v, the values add up to %v", c.file_header.Total_data_size, c.data_size)
+	}
+	in_use := num_file_header_slots + c.report.Num_node_pages + c.report.Num_data_pages
+	if c.file_header.Total_pages != in_use {
+		c.fail(check_file_header, 0, "Total_pages is %v, %v pages are in use", c.file_header.Total_pages, in_use)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestCheckFillPolicy(t *testing.T) {
+	// Whatever order the keys come in and go in, every node besides the rightmost ones stays within the fill policy of
+	// the db, so Check has nothing to complain about
+
+	const num_keys = 1500
+	orders := map[string]func(r *rand.Rand) []int{
+		"ascending": func(r *rand.Rand) []int {
+			keys := make([]int, num_keys)
+			for i := range keys {
+				keys[i] = i
+			}
+			return keys
+		},
+		"descending": func(r *rand.Rand) []int {
+			keys := make([]int, num_keys)
+			for i := range keys {
+				keys[i] = num_keys - 1 - i
+			}
+			return keys
+		},
+		"random": func(r *rand.Rand) []int { return r.Perm(num_keys) },
+	}
+
+	for _, tree_mode := range []string{"BTree", "BLink", "BPlus"} {
+		for _, fill := range []fill_policy{{50, 100, false}, {30, 70, false}, {50, 50, false}, {50, 100, true}} {
+			for _, test := range []struct{ insert_order, delete_order string }{
+				{"ascending", "ascending"}, {"ascending", "random"}, {"descending", "descending"}, {"random", "random"},
+			} {
+				t.Run(fmt.Sprint(tree_mode, "/", fill, "/", test.insert_order, "/", test.delete_order), func(t *testing.T) {
+					options := Default_connect_options
+					options.Tree_mode = Tree_mode_ids[tree_mode]
+					options.Min_fill, options.Fill_factor, options.Lazy_rebalance = fill.min_fill, fill.fill_factor, fill.lazy_rebalance
+					store, _ := New_memory_page_store(DEFAULT_PAGESIZE)
+					file, file_header, err := Create_and_ConnectDB_with_store(store, options)
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer DisconnectDB(file, file_header)
+
+					r := rand.New(rand.NewSource(1))
+					for _, key := range orders[test.insert_order](r) {
+						err = Insert(uint32(key), []byte("some value"), file_header, file)
+						if err != nil {
+							t.Fatal(err)
+						}
+					}
+					check_ok(t, "after inserting", num_keys, file_header, file)
+
+					for i, key := range orders[test.delete_order](r) {
+						if i%3 == 2 {
+							continue
+						}
+						err = Delete(uint32(key), file_header, file)
+						if err != nil {
+							t.Fatal(err)
+						}
+					}
+					check_ok(t, "after deleting", num_keys/3, file_header, file)
+				})
+			}
+		}
+	}
+}
+
+func TestCheckUnderfullNode(t *testing.T) {
+	// A node under the min of the fill policy which isn't the rightmost one of its level is an error
+
+	store, _ := New_memory_page_store(DEFAULT_PAGESIZE)
+	file, file_header, err := Create_and_ConnectDB_with_store(store, Default_connect_options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DisconnectDB(file, file_header)
+	for key := uint32(0); key < 3000; key++ {
+		err = Insert(key, []byte("some value"), file_header, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, _, root, _, err := ReadPage(file, file_header.Root_node_id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf_id := root.Children[0]
+	_, _, leaf, _, err := ReadPage(file, leaf_id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf.Block_size = 1
+	err = SavePage(leaf_id, Data_to_Bytes(leaf), file_header, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Check(file_header, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, problem := range report.Errors {
+		if problem.Kind == check_block_size && problem.Page_id == leaf_id {
+			return
+		}
+	}
+	t.Fatalf("no %v error for the node %v cut down to one key, errors: %+v", check_block_size, leaf_id, report.Errors)
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	Incremental compaction of the db file, so that it shrinks after lots of deletes without a long pause.
+
+	Every step takes the last page of the file and moves it to the lowest free page (the same one MakeNewPage would
+	hand out), fixes up only the pages pointing to it, and then cuts the free pages off the end of the file. Each
+	step is a handful of page reads and writes, no matter how big the file is.
+
+		NodePage		->	its parent (found by searching the tree for its first key), or Root_node_id for the root. In
+							BLink mode also the node to its left on the same level, through Right_link, and in BPlus mode
+							the leaves on either side of it. Its DataPages get the new Parent_node_page.
+		DataPage		->	Data_page_id of its node, or Next_data_page of the DataPage before it in the chain. Values are
+							found through data refs into the chain, so nothing else changes.
+		FreelistPage	->	it is taken out of the chain and its page ids are put back into the freelist (which puts
+							them in FreelistPages lower down in the file). Finding the FreelistPage before it in the
+							chain is a walk over the FreelistPages, there is no link back. It is the one step which
+							isn't bounded, but it only reads FreelistPages (one for every 1019 free pages with 4kB
+							pages), and only for the few steps where a FreelistPage is the last page.
+
+	Compact does up to `max_pages` of such moves with file.lock held in write mode, so it can be called between the
+	user's own operations. With ConnectOptions.Compaction_rate it is run by a goroutine in the background instead, a
+	few pages at a time so that no B-Tree operation waits for long. It stops once there are no free pages left in the
+	file, and picks up again after the next delete.
+*/
+
+const compaction_min_interval = 100 * time.Millisecond // Background steps are never closer together than this
+
+// Returns how many pages were moved, 0 once the file is as small as it can get
+func Compact(max_pages int, file_header *FileHeaderPage, file *DBFile) (int, error) {
+
+	if file.Read_only {
+		return 0, errors.Wrap(ErrReadOnly, "cannot compact the db file")
+	}
+
+	file.lock.Lock()
+	defer file.lock.Unlock()
+
+	moved := 0
+	for moved < max_pages {
+		err := Trim_db_file(file_header, file)
+		if err != nil {
+			return moved, errors.Wrap(err, "error while trying to trim the db file")
+		}
+		if file_header.Space_table_size == 0 && file_header.Freelist_head == 0 {
+			// Nothing free is left, so every page is in use
+			return moved, nil
+		}
+
+		num_pages, err := num_pages_in_db_file(file)
+		if err != nil {
+			return moved, err
+		}
+		last_page_id := num_pages - 1
+
+		buf, err := ReadChunk(file, last_page_id)
+		if err != nil {
+			return moved, errors.Wrap(err, fmt.Sprintf("error while trying to read the last page %v of the db file", last_page_id))
+		}
+		_, page_type := decode_page_start(buf)
+
+		if page_type == Page_type_ids["Node"] {
+			err = move_node_page(last_page_id, file_header, file)
+		} else if page_type == Page_type_ids["Data"] {
+			err = move_data_page(last_page_id, file_header, file)
+		} else if page_type == Page_type_ids["Freelist"] {
+			err = move_freelist_page(last_page_id, file_header, file)
+		} else {
+			err = errors.New(fmt.Sprintf("found a page of type %v at the end of the db file after trimming it", page_type))
+		}
+		if err != nil {
+			return moved, errors.Wrap(err, fmt.Sprintf("error while trying to move the page %v", last_page_id))
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+func take_page_to_move_to(file_header *FileHeaderPage, file *DBFile) (uint32, error) {
+	// One page is taken and the moved one is cut off, so Total_pages stays the same
+	file.alloc_lock.Lock()
+	defer file.alloc_lock.Unlock()
+
+	return take_free_page_id(file_header, file)
+}
+
+func wipe_moved_page(page_id uint32, file *DBFile) error {
+	// Left as a free page at the end of the file, for the next trim to cut off
+	err := WriteChunk(file, page_id, make([]byte, file.layout.page_size))
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("error while trying to wipe the moved page %v", page_id))
+	}
+	return nil
+}
+
+// NodePage
+
+type tree_path_step struct {
+	node_id uint32
+	node    *NodePage
+	ind     int // Of the child which was taken
+}
+
+func find_node_path(node_id uint32, np *NodePage, file_header *FileHeaderPage, file *DBFile) ([]tree_path_step, error) {
+	// The nodes from the root down to `node_id` (not included), found by searching for the first key of the node
+
+	if node_id == file_header.Root_node_id {
+		return nil, nil
+	}
+	if np.Block_size == 0 {
+		return nil, errors.New(fmt.Sprintf("the nodepage %v has no keys and isn't the root", node_id))
+	}
+	key := np.Blocks[0].Key
+
+	var path []tree_path_step
+	cur_id := file_header.Root_node_id
+	for cur_id != node_id {
+		if cur_id == 0 {
+			return nil, errors.New(fmt.Sprintf("couldn't find the nodepage %v in the tree by its key %v", node_id, key))
+		}
+		pt, _, cur, _, err := ReadPage(file, cur_id)
+		if err != nil {
+			return nil, err
+		}
+		if pt != Page_type_ids["Node"] {
+			return nil, errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", cur_id, pt))
+		}
+		ind, inArr := binary_index_node(cur.Blocks[:cur.Block_size], 0, int(cur.Block_size), key)
+		if inArr {
+			if !is_bplus(file_header) {
+				return nil, errors.New(fmt.Sprintf("the key %v of the nodepage %v is in the nodepage %v as well", key, node_id, cur_id))
+			}
+			ind++ // A separator of a B+ tree, the key is to the right of it
+		}
+		path = append(path, tree_path_step{node_id: cur_id, node: cur, ind: ind})
+		cur_id = cur.Children[ind]
+	}
+	return path, nil
+}
+
+func find_left_neighbour(path []tree_path_step, file *DBFile) (uint32, error) {
+	// [BLink mode] The node whose Right_link points to the node at the end of `path`
+	// Up to the first ancestor which isn't at its leftmost child, then down the rightmost children of the child before
+
+	for level := len(path) - 1; level >= 0; level-- {
+		if path[level].ind == 0 {
+			continue
+		}
+		cur_id := path[level].node.Children[path[level].ind-1]
+		for depth := level + 1; depth < len(path); depth++ {
+			pt, _, cur, _, err := ReadPage(file, cur_id)
+			if err != nil {
+				return 0, err
+			}
+			if pt != Page_type_ids["Node"] {
+				return 0, errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", cur_id, pt))
+			}
+			cur_id = cur.Children[cur.Block_size]
+		}
+		return cur_id, nil
+	}
+	return 0, nil // The leftmost node of its level
+}
+
+func move_node_page(page_id uint32, file_header *FileHeaderPage, file *DBFile) error {
+
+	pt, _, np, _, err := ReadPage(file, page_id)
+	if err != nil {
+		return err
+	}
+	if pt != Page_type_ids["Node"] {
+		return errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", page_id, pt))
+	}
+
+	// Everyone pointing to the node is found before anything is changed
+	path, err := find_node_path(page_id, np, file_header, file)
+	if err != nil {
+		return err
+	}
+	var left_id uint32
+	if is_blink(file_header) {
+		left_id, err = find_left_neighbour(path, file)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("error while trying to find the node to the left of the nodepage %v", page_id))
+		}
+	}
+	if is_bplus(file_header) {
+		left_id = np.Left_link
+	}
+
+	new_page_id, err := take_page_to_move_to(file_header, file)
+	if err != nil {
+		return err
+	}
+	err = WriteChunk(file, new_page_id, Data_to_Bytes(np))
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("error while trying to write the nodepage %v to %v", page_id, new_page_id))
+	}
+
+	if len(path) == 0 {
+		file.root_latch.Lock()
+		file_header.Root_node_id = new_page_id
+		file.root_latch.Unlock()
+	} else {
+		parent := path[len(path)-1]
+		parent.node.Children[parent.ind] = new_page_id
+		err = WriteChunk(file, parent.node_id, Data_to_Bytes(parent.node))
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("error while trying to update the parent %v of the nodepage %v", parent.node_id, page_id))
+		}
+	}
+
+	if left_id != 0 {
+		pt, _, left, _, err := ReadPage(file, left_id)
+		if err != nil {
+			return err
+		}
+		if pt == Page_type_ids["Node"] && left.Right_link == page_id {
+			left.Right_link = new_page_id
+			err = WriteChunk(file, left_id, Data_to_Bytes(left))
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("error while trying to update the Right_link of the nodepage %v", left_id))
+			}
+		}
+	}
+
+	if is_bplus(file_header) && np.Right_link != 0 {
+		pt, _, right, _, err := ReadPage(file, np.Right_link)
+		if err != nil {
+			return err
+		}
+		if pt == Page_type_ids["Node"] && right.Left_link == page_id {
+			right.Left_link = new_page_id
+			err = WriteChunk(file, np.Right_link, Data_to_Bytes(right))
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("error while trying to update the Left_link of the leaf %v", np.Right_link))
+			}
+		}
+	}
+
+	if np.Data_page_id != 0 {
+		err = put_nodeId_to_data_page(new_page_id, np.Data_page_id, file)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("error while trying to put the new node id %v into its datapages", new_page_id))
+		}
+	}
+
+	return wipe_moved_page(page_id, file)
+}
+
+// DataPage
+
+func move_data_page(page_id uint32, file_header *FileHeaderPage, file *DBFile) error {
+
+	pt, _, _, dp, err := ReadPage(file, page_id)
+	if err != nil {
+		return err
+	}
+	if pt != Page_type_ids["Data"] {
+		return errors.New(fmt.Sprintf("expected to find data page but didn't find data at page_id = %v. found page type = %v", page_id, pt))
+	}
+
+	// Either the node or the DataPage before it in the chain points to it
+	pt, _, np, _, err := ReadPage(file, dp.Parent_node_page)
+	if err != nil {
+		return err
+	}
+	if pt != Page_type_ids["Node"] {
+		return errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", dp.Parent_node_page, pt))
+	}
+	var prev_id uint32
+	var prev *DataPage
+	if np.Data_page_id != page_id {
+		prev_id = np.Data_page_id
+		for {
+			pt, _, _, prev, err = ReadPage(file, prev_id)
+			if err != nil {
+				return err
+			}
+			if pt != Page_type_ids["Data"] {
+				return errors.New(fmt.Sprintf("expected to find data page but didn't find data at page_id = %v. found page type = %v", prev_id, pt))
+			}
+			if prev.Next_data_page == page_id {
+				break
+			}
+			if prev.Next_data_page == 0 {
+				return errors.New(fmt.Sprintf("the datapage %v isn't in the chain of its nodepage %v", page_id, dp.Parent_node_page))
+			}
+			prev_id = prev.Next_data_page
+		}
+	}
+
+	new_page_id, err := take_page_to_move_to(file_header, file)
+	if err != nil {
+		return err
+	}
+	err = WriteChunk(file, new_page_id, Data_to_Bytes(dp))
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("error while trying to write the datapage %v to %v", page_id, new_page_id))
+	}
+
+	if prev == nil {
+		np.Data_page_id = new_page_id
+		err = WriteChunk(file, dp.Parent_node_page, Data_to_Bytes(np))
+	} else {
+		prev.Next_data_page = new_page_id
+		err = WriteChunk(file, prev_id, Data_to_Bytes(prev))
+	}
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("error while trying to point the chain of the nodepage %v to %v", dp.Parent_node_page, new_page_id))
+	}
+
+	return wipe_moved_page(page_id, file)
+}
+
+// FreelistPage
+
+func move_freelist_page(page_id uint32, file_header *FileHeaderPage, file *DBFile) error {
+	file.alloc_lock.Lock()
+	defer file.alloc_lock.Unlock()
+
+	fp, err := read_freelist_page(page_id, file)
+	if err != nil {
+		return err
+	}
+
+	// Out of the chain first, so that the page ids don't go right back into it
+	if file_header.Freelist_head == page_id {
+		file_header.Freelist_head = fp.Next_freelist_page
+	} else {
+		prev_id := file_header.Freelist_head
+		for {
+			if prev_id == 0 {
+				return errors.New(fmt.Sprintf("the freelist page %v isn't in the freelist", page_id))
+			}
+			prev, err := read_freelist_page(prev_id, file)
+			if err != nil {
+				return err
+			}
+			if prev.Next_freelist_page == page_id {
+				prev.Next_freelist_page = fp.Next_freelist_page
+				err = WriteChunk(file, prev_id, Data_to_Bytes(prev))
+				if err != nil {
+					return errors.Wrap(err, fmt.Sprintf("error while trying to update the freelist page %v", prev_id))
+				}
+				break
+			}
+			prev_id = prev.Next_freelist_page
+		}
+	}
+	file_header.Freelist_size -= fp.Num_entries
+
+	// Left out are the ones trimmed off already (see freelist.go)
+	num_pages, err := num_pages_in_db_file(file)
+	if err != nil {
+		return err
+	}
+	drop_cut_off_page_ids(fp, num_pages)
+	for _, free_page_id := range fp.Page_ids[:fp.Num_entries] {
+		err = push_to_freelist(free_page_id, file_header, file)
+		if err != nil {
+			return err
+		}
+	}
+
+	return wipe_moved_page(page_id, file)
+}
+
+// BACKGROUND
+
+func start_compaction(rate int, file_header *FileHeaderPage, file *DBFile) {
+	// Moves about `rate` pages per second until DisconnectDB
+
+	if rate <= 0 || file.Read_only {
+		return
+	}
+	interval := time.Second / time.Duration(rate)
+	pages_per_step := 1
+	if interval < compaction_min_interval {
+		interval = compaction_min_interval
+		pages_per_step = max(1, int(int64(rate)*int64(compaction_min_interval)/int64(time.Second)))
+	}
+
+	file.compaction_stop = make(chan struct{})
+	file.compaction_done.Add(1)
+	go func() {
+		defer file.compaction_done.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-file.compaction_stop:
+				return
+			case <-ticker.C:
+				_, err := Compact(pages_per_step, file_header, file)
+				if err != nil {
+					fmt.Printf("error while compacting the db file in the background, stopping the compaction: \n%+v\n", err)
+					return
+				}
+			}
+		}
+	}()
+}
+
+func stop_compaction(file *DBFile) {
+	if file.compaction_stop == nil {
+		return
+	}
+	close(file.compaction_stop)
+	file.compaction_done.Wait()
+	file.compaction_stop = nil
+}
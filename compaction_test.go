@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Counts the FreelistPages read out of the store
+type freelist_read_counter struct {
+	PageStore
+	num_reads int
+}
+
+func (s *freelist_read_counter) Read_page(page_id uint32) ([]byte, error) {
+	buf, err := s.PageStore.Read_page(page_id)
+	if err == nil {
+		_, page_type := decode_page_start(buf)
+		if page_type == Page_type_ids["Freelist"] {
+			s.num_reads++
+		}
+	}
+	return buf, err
+}
+
+func TestCompactionStepsBounded(t *testing.T) {
+	// A filler page after every insert, all of them freed at the end, so that the free pages are spread out in lots of
+	// runs. The Free Space table fills up and the freelist takes a few FreelistPages
+	const num_keys = 6000
+	memory_store, _ := New_memory_page_store(DEFAULT_PAGESIZE)
+	store := &freelist_read_counter{PageStore: memory_store}
+	options := Default_connect_options
+	options.Buffer_pool_bytes = 0 // Every read goes to the store
+	file, file_header, err := Create_and_ConnectDB_with_store(store, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DisconnectDB(file, file_header)
+	var fillers []uint32
+	for key := 0; key < num_keys; key++ {
+		err = Insert(uint32(key), []byte(fmt.Sprintf("value-%v-%0500d", key, key)), file_header, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page_id, err := MakeNewPage(Page_type_ids["Data"], file_header, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fillers = append(fillers, page_id)
+	}
+	for _, page_id := range fillers {
+		err = DeletePage(page_id, file_header, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	report := check_ok(t, "after freeing the fillers", num_keys, file_header, file)
+	if report.Num_freelist_pages < 2 {
+		t.Fatalf("the freelist has %v FreelistPages, not enough to see it read on every step", report.Num_freelist_pages)
+	}
+	num_pages_before := report.Num_pages
+
+	// Every step reads the first FreelistPage at most, besides the ones moving a FreelistPage (which walk the chain)
+	num_steps := 0
+	for {
+		// Trimmed like Compact does first, to see which page it is going to move
+		err = Trim_db_file(file_header, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		num_pages, err := num_pages_in_db_file(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := ReadChunk(file, num_pages-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, last_page_type := decode_page_start(buf)
+
+		store.num_reads = 0
+		moved, err := Compact(1, file_header, file)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if moved == 0 {
+			break
+		}
+		num_steps++
+		if last_page_type != Page_type_ids["Freelist"] && store.num_reads > 2 {
+			t.Fatalf("step %v read %v FreelistPages", num_steps, store.num_reads)
+		}
+		if num_steps%500 == 0 {
+			// With ids of trimmed off pages left in the freelist
+			check_ok(t, fmt.Sprint("after ", num_steps, " steps"), num_keys, file_header, file)
+		}
+	}
+
+	report = check_ok(t, "after the compaction", num_keys, file_header, file)
+	if report.Num_pages >= num_pages_before || report.Num_free_pages != 0 || report.Num_freelist_pages != 0 {
+		t.Fatalf("compacted from %v to %v pages in %v steps, with %v free pages and %v FreelistPages left", num_pages_before, report.Num_pages, num_steps, report.Num_free_pages, report.Num_freelist_pages)
+	}
+}
@@ -1,754 +1,483 @@
 package main
 
 import (
-	"encoding/binary"
 	"fmt"
-	"os"
 	"sort"
 
 	"github.com/pkg/errors"
 )
 
-const DATA_HEADER uint16 = 0x1E7F
-const max_data_size = PAGESIZE - 512 // DO NOT CHANGE // maximum data that can be put inside the DataPage, including the header for the data
+/*
+	Data Handling in Data Pages
 
-// Data Handling in Data Pages
+	Every DataPage is a slotted page. The values are kept as records in Data, and the slots in the header say where
+	each one is (Offset and Length, 0 for a free slot). Nothing in Data is ever looked at to find where a record
+	starts, so the bytes of a value can be anything at all.
 
-func overlap_intervals_bytes(a_offset, b_offset uint16, a_size, b_size uint16) bool {
-	// a and b should be in sorted order
-	if a_offset < b_offset {
-		return a_offset+a_size == b_offset
-	} else if a_offset > b_offset {
-		return b_offset+b_size == a_size
-	}
-	return true
-}
+	A node points to its values with data refs (the Offset of its cells), which are the index of the DataPage in the
+	chain of the node and the slot in it:
 
-func DataPage_table_fixer(dp *DataPage) {
+		data ref	->	chain index << 16 | slot
 
-	// Removing empty elements
-	i := uint16(0)
-	j := uint16(0)
-	for i < dp.Space_table_size && j < dp.Space_table_size {
-		for j < dp.Space_table_size && dp.Unallocated_space_table[j].Size == 0 {
-			j++
-		}
-		if j >= dp.Space_table_size {
-			break
-		}
-		if i != j {
-			dp.Unallocated_space_table[i] = dp.Unallocated_space_table[j]
-			dp.Unallocated_space_table[j] = data_page_unallocated_space_table_row{0, 0}
-		}
-		i++
-		j++
-	}
-	dp.Space_table_size = i
+	The slot of a record never changes while it is there. When a DataPage has enough room for a record, but not all in
+	one place, its records are slid together to the start of Data (compact_data_page), which only changes the Offsets
+	of the slots. So nothing in the node has to be updated when that happens.
 
-	// Sorting elements
-	sort.Slice(dp.Unallocated_space_table[:dp.Space_table_size], func(i, j int) bool {
-		a := dp.Unallocated_space_table[i]
-		b := dp.Unallocated_space_table[j]
-		return a.Offset > b.Offset
-	})
+	Every record starts with 1 byte of flags:
+		DATA_RECORD_COMPRESSED	->	the value was compressed (see value_compression.go)
+		DATA_RECORD_CONTINUED	->	the value doesn't fit in one DataPage. The next 4 bytes are the data ref of the
+									record with the rest of it.
+	A value too big for one DataPage is cut up into records which fill new DataPages completely, with whatever is left
+	over put anywhere it fits, like any other record. Once the DataPages at the end of a chain are left with nothing in
+	them, they are dropped from it (the first one always stays, the node points to it).
 
-	// Merging overlapping elements
-	i = dp.Space_table_size - 1
-	for i < dp.Space_table_size {
-		j = i - 1
-		for j < dp.Space_table_size && overlap_intervals_bytes(dp.Unallocated_space_table[i].Offset, dp.Unallocated_space_table[j].Offset, dp.Unallocated_space_table[i].Size, dp.Unallocated_space_table[j].Size) {
-			dp.Unallocated_space_table[i].Size += dp.Unallocated_space_table[j].Size
-			dp.Unallocated_space_table[j] = data_page_unallocated_space_table_row{0, 0}
-			j--
-		}
-		i = j
-	}
+	Short values don't go to the DataPages at all when the db has an Inline_value_size. Every cell of a node then has
+	that many bytes of room (Inline_values), and a value which fits is kept right there, so reading it takes nothing
+	but the node. Its Offset is not a data ref but
 
-	// Removing empty elements
-	i = 0
-	j = 0
-	for i < dp.Space_table_size && j < dp.Space_table_size {
-		for j < dp.Space_table_size && dp.Unallocated_space_table[j].Size == 0 {
-			j++
-		}
-		if j >= dp.Space_table_size {
-			break
-		}
-		if i != j {
-			dp.Unallocated_space_table[i] = dp.Unallocated_space_table[j]
-			dp.Unallocated_space_table[j] = data_page_unallocated_space_table_row{0, 0}
-		}
-		i++
-		j++
-	}
-	dp.Space_table_size = i
-}
+		data_ref_inline | length
 
-func appendHeader(b []byte) []byte {
-	// Create a new byte slice to store the final result
-	newSlice := make([]byte, len(b)+6) // 6 bytes for one uint16 (2B) header value and one uint32 (4B) length value
+	Inline values are never compressed, they are too short for it anyway.
+*/
 
-	// Add the head value at the beginning
-	if NativeEndian == binary.BigEndian {
-		binary.BigEndian.PutUint16(newSlice[:2], DATA_HEADER)
-	} else {
-		binary.LittleEndian.PutUint16(newSlice[:2], DATA_HEADER)
-	}
+const DATA_RECORD_COMPRESSED uint8 = 1 << 0
+const DATA_RECORD_CONTINUED uint8 = 1 << 1
+const data_record_header_size = 1        // The flags
+const data_record_continued_size = 1 + 4 // The flags and the data ref of the rest of the value
+const max_data_chain_length = 1 << 15    // The chain index has to fit in the upper half of a data ref, below data_ref_inline
 
-	// Add the tail value at the end
-	if NativeEndian == binary.BigEndian {
-		binary.BigEndian.PutUint32(newSlice[2:6], uint32(len(b)))
-	} else {
-		binary.LittleEndian.PutUint32(newSlice[2:6], uint32(len(b)))
-	}
+const data_ref_inline = 1 << 31   // Set in the Offset of a cell whose value is in Inline_values
+const max_inline_value_size = 128 // Any more and the nodes get too small
 
-	// Copy the original slice
-	copy(newSlice[6:], b)
+func data_ref(chain_ind int, slot uint16) uint32 {
+	return uint32(chain_ind)<<16 | uint32(slot)
+}
 
-	return newSlice
+func split_data_ref(ref uint32) (int, uint16) {
+	return int(ref >> 16), uint16(ref)
 }
 
-func defragment_datapage(datapage_id uint32, file_header *FileHeaderPage, file *os.File) (map[uint32]uint32, error) {
-
-	// We will eventually need to get all the datapages anyways, so why not do it in the beginning?
-	// Then make an array of these datapages... This will make working with them much easier!
-	var dp_array []*DataPage
-	var dp_id_array []uint32
-	// Working with heap memory is easier right now and also faster (in this case) since it is unlikely to be that more than size of 4 (==16kB)
-	// If we instead just bring in the Datapages we have the need for the moment, it will create a massive delay since smae Datapages will have to be
-	// loaded repeatedly... Also, saving the updated Datapages will become more hassling...
-	cur_page_id := datapage_id
-	for cur_page_id != 0 {
-		pt, _, _, temp, err := ReadPage(file, cur_page_id)
-		if err != nil {
-			return nil, err
-		}
-		if pt != Page_type_ids["Data"] {
-			return nil, errors.New(fmt.Sprintf("read page %v isn't a datapage. read page of type %v", cur_page_id, pt))
+func data_page_free_slot(dp *DataPage) (uint16, bool) {
+	for i := uint16(0); i < dp.Num_slots; i++ {
+		if dp.Slots[i].Length == 0 {
+			return i, true
 		}
-		dp_id_array = append(dp_id_array, cur_page_id)
-		cur_page_id = temp.Next_data_page
-		dp_array = append(dp_array, temp)
 	}
-
-	type index struct {
-		dp   int
-		data int
+	if int(dp.Num_slots) < len(dp.Slots) {
+		return dp.Num_slots, true
 	}
-	j := index{0, 0} // Index of the byte from which we are start going to fill from
-	k := index{0, 0} // Index which will look for data and ignore blanks (by incrementing when encountering them)
-
-	changes_record := make(map[uint32]uint32)
-
-	var header_buffer [6]byte
+	return 0, false
+}
 
-	// Loop through all the bytes in the data field of datapage (including all the next datapages)
-	for k.dp < len(dp_array) && j.dp < len(dp_array) { // Iterating through all the datapages
-		for u := 0; u < 6; u++ {
-			if k.data >= max_data_size {
-				k.data = 0
-				k.dp++
-			}
-			if k.dp >= len(dp_array) {
-				break
-			}
-			header_buffer[u] = dp_array[k.dp].Data[k.data]
-			k.data++
-		}
-		if k.dp >= len(dp_array) {
-			break
-		}
-		for u := 0; u < 6; u++ {
-			if k.data == 0 {
-				k.data = max_data_size - 1
-				k.dp--
-				continue
-			}
-			k.data--
-		}
-		is_start_of_data, length_of_data := checkHeader(header_buffer[:], 0)
-
-		// If there is data in our current i_th position then fill it in j_th position and increment it
-		if is_start_of_data {
-			if j == k {
-				k.data += int(length_of_data)
-				j.data += int(length_of_data)
-				if k.data >= max_data_size {
-					k.data = k.data - max_data_size
-					k.dp++
-					j.data = j.data - max_data_size
-					j.dp++
-				}
-				continue
-			}
-			if max_data_size-j.data <= 6 {
-				j.data = 0
-				j.dp++
-			}
-			changes_record[uint32(max_data_size*k.dp+k.data)] = uint32(max_data_size*j.dp + j.data)
-			for t := 0; t < int(length_of_data); t++ {
-				dp_array[j.dp].Data[j.data] = dp_array[k.dp].Data[k.data]
-				dp_array[k.dp].Data[k.data] = 0
-				k.data++
-				j.data++
-				if k.data == max_data_size {
-					k.data = 0
-					k.dp++
-				}
-				if j.data == max_data_size {
-					j.data = 0
-					j.dp++
-				}
-			}
-			continue
-		}
-		// else just increment i_th position and skip all the blanks
-		k.data++
-		if k.data >= max_data_size {
-			k.data = 0
-			k.dp++
-		}
-		if k.dp >= len(dp_array) {
-			break
-		}
-		for k.dp < len(dp_array) && dp_array[k.dp].Data[k.data] == 0 {
-			k.data++
-			if k.data == max_data_size {
-				k.data = 0
-				k.dp++
-			}
+func data_page_data_end(dp *DataPage) int {
+	// Everything after this in Data is free
+	end := 0
+	for i := uint16(0); i < dp.Num_slots; i++ {
+		if dp.Slots[i].Length != 0 {
+			end = max(end, int(dp.Slots[i].Offset)+int(dp.Slots[i].Length))
 		}
 	}
+	return end
+}
 
-	// Fix the headers of all the DataPages
-	delete_from := -1
-	for i := 0; i < len(dp_array); i++ {
-		count := 0
-		for j := max_data_size - 1; j >= 0; j-- {
-			if dp_array[i].Data[j] == 0 {
-				count++
-			} else {
-				break
-			}
-		}
-		dp_array[i].Data_held = uint16(max_data_size - count)
-		if count == max_data_size {
-			for k := i + 1; k < len(dp_array); k++ {
-				dp_array[k].Data_held = 0
-			}
-			if i != 0 {
-				dp_array[i-1].Next_data_page = 0
-				delete_from = i
-			} else {
-				delete_from = i + 1
-			}
-			break
-		}
-		for t := 0; t < int(dp_array[i].Space_table_size); t++ {
-			dp_array[i].Unallocated_space_table[t] = data_page_unallocated_space_table_row{0, 0}
-		}
-		dp_array[i].Space_table_size = 1
-		dp_array[i].Unallocated_space_table[0] = data_page_unallocated_space_table_row{Offset: uint16(max_data_size - count), Size: uint16(count)}
-	}
+func compact_data_page(dp *DataPage) {
+	// Slides all the records to the start of Data, in the order they are in, so that all the free space is at the end
 
-	// Save all the changes made to the DataPages
-	for i := 0; i < len(dp_array); i++ {
-		err := WriteChunk(file, dp_id_array[i], Data_to_Bytes(dp_array[i]))
-		if err != nil {
-			return changes_record, errors.Wrap(err, fmt.Sprintf("error while trying to overwrite unnecessary datapage %v", dp_id_array[i]))
+	var used []uint16
+	for i := uint16(0); i < dp.Num_slots; i++ {
+		if dp.Slots[i].Length != 0 {
+			used = append(used, i)
 		}
 	}
+	sort.Slice(used, func(i, j int) bool {
+		return dp.Slots[used[i]].Offset < dp.Slots[used[j]].Offset
+	})
 
-	// Delete unnecessary Datapages
-	if delete_from > 0 {
-		for i := delete_from; i < len(dp_array); i++ {
-			err := DeletePage(dp_id_array[i], file_header, file)
-			if err != nil {
-				return changes_record, errors.Wrap(err, fmt.Sprintf("error while trying to delete unnecessary datapage %v", dp_id_array[i]))
-			}
-		}
+	end := uint16(0)
+	for _, slot := range used {
+		s := &dp.Slots[slot]
+		copy(dp.Data[end:], dp.Data[s.Offset:s.Offset+s.Length])
+		s.Offset = end
+		end += s.Length
 	}
-
-	return changes_record, nil
+	clear(dp.Data[end:])
 }
 
-func Defragment_Node(page_id uint32, file_header *FileHeaderPage, file *os.File) error {
+// Returns false if there is no free slot or not enough room in the DataPage for the record
+func data_page_put_record(dp *DataPage, record []byte) (uint16, bool) {
 
-	pt, _, np, _, err := ReadPage(file, page_id)
-	if err != nil {
-		return err
-	}
-	if pt != Page_type_ids["Node"] {
-		return errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", page_id, pt))
+	slot, ok := data_page_free_slot(dp)
+	if !ok || len(dp.Data)-int(dp.Data_held) < len(record) {
+		return 0, false
 	}
-
-	if np.Data_page_id == 0 {
-		return errors.New(fmt.Sprintf("tried to defragment a nodepage %v with no associated datapages", page_id))
+	end := data_page_data_end(dp)
+	if len(dp.Data)-end < len(record) {
+		compact_data_page(dp)
+		end = int(dp.Data_held)
 	}
 
-	// defragment Datapage
-	changes_made, err := defragment_datapage(np.Data_page_id, file_header, file)
-	if err != nil {
-		return errors.Wrap(err, fmt.Sprintf("error while trying to defragment the datapage %v belonging to the nodepage %v", np.Data_page_id, page_id))
+	copy(dp.Data[end:], record)
+	dp.Slots[slot] = data_page_slot{Offset: uint16(end), Length: uint16(len(record))}
+	if slot == dp.Num_slots {
+		dp.Num_slots++
 	}
+	dp.Data_held += uint16(len(record))
+	return slot, true
+}
 
-	// Relay changes to the offsets near the key
-	for i := 0; i < int(np.Block_size); i++ {
-		if val, ok := changes_made[np.Blocks[i].Offset]; ok {
-			np.Blocks[i].Offset = val
-		}
+func data_page_record(dp *DataPage, slot uint16) ([]byte, error) {
+	if slot >= dp.Num_slots || dp.Slots[slot].Length == 0 {
+		return nil, errors.New(fmt.Sprintf("there is no record in the slot %v", slot))
 	}
-
-	// Save the changes made to the nodepage
-	err = WriteChunk(file, page_id, Data_to_Bytes(np))
-	if err != nil {
-		return err
+	s := dp.Slots[slot]
+	if int(s.Offset)+int(s.Length) > len(dp.Data) {
+		return nil, errors.New(fmt.Sprintf("the record in the slot %v goes past the end of the datapage", slot))
 	}
-
-	return nil
+	return dp.Data[s.Offset : s.Offset+s.Length], nil
 }
 
-func rec_put_in_datapage_helper(page_id uint32, data []byte, file_header *FileHeaderPage, file *os.File) (uint32, error) { // This function is only to be used after Datapage has been defragmented
-	/*
-		ONLY TO BE USED AFTER DEFRAGMENTATION
-	*/
+func data_page_free_record(dp *DataPage, slot uint16) {
+	s := dp.Slots[slot]
+	clear(dp.Data[s.Offset : s.Offset+s.Length])
+	dp.Data_held -= s.Length
+	dp.Slots[slot] = data_page_slot{}
 
-	pt, _, _, dp, err := ReadPage(file, page_id)
-	if err != nil {
-		return 0, err
-	}
-	if pt != Page_type_ids["Data"] {
-		return 0, errors.New(fmt.Sprintf("read page %v isn't a datapage. read page of type %v", page_id, pt))
+	// The slots at the end are as good as never used
+	for dp.Num_slots > 0 && dp.Slots[dp.Num_slots-1].Length == 0 {
+		dp.Num_slots--
 	}
+}
 
-	// Data must already be appended with headers
+// The chain of DataPages of a node, read in as far as needed, changed in memory and then written back with save
+type data_chain struct {
+	ids   []uint32
+	pages []*DataPage
+	dirty []bool
+	next  uint32 // Next_data_page of the last DataPage read in, 0 once the whole chain is
 
-	// Go the last datapage available and start adding data from there
-	if dp.Next_data_page != 0 {
-		off, err := rec_put_in_datapage_helper(dp.Next_data_page, data, file_header, file)
-		return max_data_size + off, err
-	}
+	in_memory *page_layout // Only set for a chain made just in memory (see vacuum.go), its DataPages get their ids later
+}
+
+func new_data_chain(page_id uint32) *data_chain {
+	return &data_chain{next: page_id}
+}
 
-	// This is the last page, start adding data from here
+func (chain *data_chain) page(chain_ind int, file *DBFile) (*DataPage, error) {
 
-	// Calculate how many DataPages more might be needed to fit the data
-	datapages_needed := 0
-	if len(data) > int(dp.Unallocated_space_table[0].Size) {
-		datapages_needed = 1 + ((len(data) - int(dp.Unallocated_space_table[0].Size)) / max_data_size)
-	}
-	// Make the required number of datapages
-	cur_dp := dp
-	cur_id := page_id
-	var new_dp_id uint32
-	for i := 0; i < datapages_needed; i++ {
-		// Make a new datapage for data put into
-		new_dp_id, err = MakeNewPage(Page_type_ids["Data"], file_header, file)
-		if err != nil {
-			return 0, errors.Wrap(err, "needed new datapage for data to fit but coudnt make a new datapage")
+	for chain_ind >= len(chain.pages) {
+		if chain.next == 0 {
+			return nil, errors.New(fmt.Sprintf("there is no datapage %v in a chain of %v datapages", chain_ind, len(chain.pages)))
 		}
-		// Connect new datapage to current datapage
-		cur_dp.Next_data_page = new_dp_id
-		if cur_id == page_id {
-			dp.Next_data_page = new_dp_id
+		if len(chain.pages) == max_data_chain_length {
+			return nil, errors.New(fmt.Sprintf("the chain of datapages starting at %v is longer than %v datapages", chain.ids[0], max_data_chain_length))
 		}
-		// Add parent node id to the new datapage
-		err = put_nodeId_to_data_page(dp.Parent_node_page, new_dp_id, file)
+		pt, _, _, dp, err := ReadPage(file, chain.next)
 		if err != nil {
-			return 0, errors.Wrap(err, fmt.Sprintf("error while trying to put node id %v in the datapages", dp.Parent_node_page))
+			return nil, err
 		}
-		// Save the current datapage
-		err = WriteChunk(file, cur_id, Data_to_Bytes(cur_dp))
-		if err != nil {
-			return 0, err
+		if pt != Page_type_ids["Data"] {
+			return nil, errors.New(fmt.Sprintf("read page %v isn't a datapage. read page of type %v", chain.next, pt))
 		}
-		// Update the current datapage
-		pt, _, _, cur_dp, err = ReadPage(file, cur_dp.Next_data_page)
-		cur_id = new_dp_id
+		chain.ids = append(chain.ids, chain.next)
+		chain.pages = append(chain.pages, dp)
+		chain.dirty = append(chain.dirty, false)
+		chain.next = dp.Next_data_page
+	}
+	return chain.pages[chain_ind], nil
+}
+
+func read_data_chain(page_id uint32, file *DBFile) (*data_chain, error) {
+	// The whole of it
+
+	chain := new_data_chain(page_id)
+	for chain.next != 0 {
+		_, err := chain.page(len(chain.pages), file)
 		if err != nil {
-			return 0, err
-		}
-		if pt != Page_type_ids["Data"] {
-			return 0, errors.New(fmt.Sprintf("tried to read a datapage (%v) at page id %v but instead got page of type %v", Page_type_ids["Data"], cur_dp.Next_data_page, pt))
+			return nil, err
 		}
 	}
+	return chain, nil
+}
 
-	// Putting the data in
-	off := dp.Unallocated_space_table[0].Offset
-	type index struct {
-		dp      *DataPage
-		dp_id   uint32
-		data_id uint16
-	}
-	j := index{dp, page_id, dp.Unallocated_space_table[0].Offset}
-	i := 0
-	for i < len(data) {
-		if j.data_id >= max_data_size {
-			DataPage_table_fixer(j.dp)
-			// Save the current datapage
-			err = WriteChunk(file, j.dp_id, Data_to_Bytes(j.dp))
-			if err != nil {
-				return uint32(dp.Unallocated_space_table[0].Offset), err
-			}
+func (chain *data_chain) add_page(file_header *FileHeaderPage, file *DBFile) error {
 
-			j.data_id = 0
-			j.dp_id = j.dp.Next_data_page
+	if len(chain.pages) == max_data_chain_length {
+		return errors.New(fmt.Sprintf("the chain of datapages can't be longer than %v datapages", max_data_chain_length))
+	}
 
-			// Update the current datapage
-			pt, _, _, j.dp, err = ReadPage(file, j.dp_id)
-			if err != nil {
-				return uint32(dp.Unallocated_space_table[0].Offset), err
-			}
-			if pt != Page_type_ids["Data"] {
-				return uint32(dp.Unallocated_space_table[0].Offset), errors.New(fmt.Sprintf("error, read page %v isn't a datapage, found page_id = %v", j.dp_id, pt))
-			}
-		}
-		j.dp.Data[j.data_id] = data[i]
-		i++
-		j.data_id++
-		j.dp.Data_held += 1
-		j.dp.Unallocated_space_table[0].Size -= 1
-		j.dp.Unallocated_space_table[0].Offset += 1
-	}
-	file_header.Total_data_size += uint64(len(data))
-	// Save the current datapage
-	err = WriteChunk(file, j.dp_id, Data_to_Bytes(j.dp))
-	if err != nil {
-		return uint32(dp.Unallocated_space_table[0].Offset), err
+	if chain.in_memory != nil {
+		dp := new_data_page(chain.in_memory)
+		dp.Identification_num = PAGE_IDENTITY_NUM
+		dp.Page_type = Page_type_ids["Data"]
+		chain.ids = append(chain.ids, 0)
+		chain.pages = append(chain.pages, dp)
+		chain.dirty = append(chain.dirty, true)
+		return nil
 	}
 
-	return uint32(off), nil
+	page_id, err := MakeNewPage(Page_type_ids["Data"], file_header, file)
+	if err != nil {
+		return errors.Wrap(err, "needed new datapage for data to fit but coudnt make a new datapage")
+	}
+	dp := new_data_page(file.layout)
+	dp.Identification_num = PAGE_IDENTITY_NUM
+	dp.Page_type = Page_type_ids["Data"]
+	if len(chain.pages) != 0 {
+		last := len(chain.pages) - 1
+		dp.Parent_node_page = chain.pages[last].Parent_node_page
+		chain.pages[last].Next_data_page = page_id
+		chain.dirty[last] = true
+	}
+	chain.ids = append(chain.ids, page_id)
+	chain.pages = append(chain.pages, dp)
+	chain.dirty = append(chain.dirty, true)
+	return nil
 }
 
-func Put_in_DataPage(page_id uint32, data []byte, file_header *FileHeaderPage, file *os.File) (uint32, error) {
+func (chain *data_chain) put_record(record []byte, file_header *FileHeaderPage, file *DBFile) (uint32, error) {
+	// First fit, and a new DataPage at the end if it doesn't fit anywhere
+
+	for i, dp := range chain.pages {
+		slot, ok := data_page_put_record(dp, record)
+		if ok {
+			chain.dirty[i] = true
+			return data_ref(i, slot), nil
+		}
+	}
 
-	pt, _, _, dp, err := ReadPage(file, page_id)
+	err := chain.add_page(file_header, file)
 	if err != nil {
 		return 0, err
 	}
-	if pt != Page_type_ids["Data"] {
-		return 0, errors.New(fmt.Sprintf("read page %v isn't a datapage. read page of type %v", page_id, pt))
+	last := len(chain.pages) - 1
+	slot, ok := data_page_put_record(chain.pages[last], record)
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("a record of %v bytes doesn't fit even in an empty datapage", len(record)))
 	}
+	return data_ref(last, slot), nil
+}
 
-	data = appendHeader(data)
-
-	// 2 casses possible,
-	// 		1. Data can fit within an existing fragment -> Put it there
-	//		2. It cannot fit in THIS datapage
-	//			2.1. There are more pages there -> Check if it can fit any fragments in the next pages
-	//			2.2. There aren't anymore pages there -> Defragment Datapage, then put it at the end
+func (chain *data_chain) put_value(data []byte, flags uint8, file_header *FileHeaderPage, file *DBFile) (uint32, error) {
+	max_data_size := len(chain.pages[0].Data)
 
-	type index struct {
-		dp    *DataPage
-		dp_id uint32
-		ind   uint32
+	if data_record_header_size+len(data) <= max_data_size {
+		record := make([]byte, data_record_header_size+len(data))
+		record[0] = flags
+		copy(record[data_record_header_size:], data)
+		return chain.put_record(record, file_header, file)
 	}
-	cur_dp := index{dp, page_id, 0}
-
-	for cur_dp.dp_id != 0 {
-		// Checking if Data can fit or not
-		chosen := -1
-		for i := 0; i < int(cur_dp.dp.Space_table_size); i++ {
-			// BEST FIT alogorithm to find where to put the data
-			if int(cur_dp.dp.Unallocated_space_table[i].Size) >= len(data) {
-				if chosen != -1 && cur_dp.dp.Unallocated_space_table[i].Size <= cur_dp.dp.Unallocated_space_table[chosen].Size {
-					chosen = i
-				} else if chosen == -1 {
-					chosen = i
-				}
-			}
-		}
 
-		if chosen == -1 {
-			cur_dp.ind++
-			cur_dp.dp_id = cur_dp.dp.Next_data_page
-			if cur_dp.dp_id == 0 {
-				cur_dp.dp = nil
-				break
-			}
-			pt, _, _, cur_dp.dp, err = ReadPage(file, cur_dp.dp_id)
-			if err != nil {
-				return 0, err
-			}
-			if pt != Page_type_ids["Data"] {
-				return 0, errors.New(fmt.Sprintf("read page %v isn't a datapage. read page of type %v", cur_dp.dp_id, pt))
-			}
-			continue
-		}
+	// Cut up into records filling whole DataPages, put from the last to the first so that each one knows where the rest
+	// of the value went. Whatever is left over (at most a DataPage) is put first, like any other record.
+	piece_size := max_data_size - data_record_continued_size
+	num_pieces := (len(data) - 1) / piece_size
 
-		// Data can be fitted inside this datapage with no problem
-		for i := 0; i < len(data); i++ {
-			cur_dp.dp.Data[cur_dp.dp.Unallocated_space_table[chosen].Offset+uint16(i)] = data[i]
+	rest := data[num_pieces*piece_size:]
+	record := make([]byte, data_record_header_size+len(rest))
+	copy(record[data_record_header_size:], rest)
+	ref, err := chain.put_record(record, file_header, file)
+	if err != nil {
+		return 0, err
+	}
+	for i := num_pieces - 1; i >= 0; i-- {
+		record := make([]byte, max_data_size)
+		record[0] = DATA_RECORD_CONTINUED
+		if i == 0 {
+			record[0] |= flags
 		}
-
-		// Update the headers
-		data_loc := cur_dp.dp.Unallocated_space_table[chosen].Offset
-		cur_dp.dp.Data_held += uint16(len(data))
-		file_header.Total_data_size += uint64(len(data))
-		// Update the Unallocated Space Table
-		cur_dp.dp.Unallocated_space_table[chosen].Size -= uint16(len(data))
-		cur_dp.dp.Unallocated_space_table[chosen].Offset += uint16(len(data))
-		DataPage_table_fixer(cur_dp.dp)
-
-		// Save the changes made
-		err = WriteChunk(file, cur_dp.dp_id, Data_to_Bytes(cur_dp.dp))
+		NativeEndian.PutUint32(record[data_record_header_size:data_record_continued_size], ref)
+		copy(record[data_record_continued_size:], data[i*piece_size:(i+1)*piece_size])
+		ref, err = chain.put_record(record, file_header, file)
 		if err != nil {
 			return 0, err
 		}
-
-		return (cur_dp.ind * max_data_size) + uint32(data_loc), nil
 	}
+	return ref, nil
+}
 
-	// No Space in any of the DataPages for the new Data, so defragment and then put the data
+func (chain *data_chain) get_value(ref uint32, file *DBFile) ([]byte, uint8, error) {
+	// The value kept at the data ref as it is (still compressed if it was), along with the flags of its first record
 
-	// Defragment the Datapages
-	if dp.Parent_node_page == 0 {
-		_, err = defragment_datapage(page_id, file_header, file)
-		if err != nil {
-			return 0, errors.Wrap(err, fmt.Sprintf("error while trying to defragment the nodepage %v", page_id))
+	var data []byte
+	var flags uint8
+	for pieces := 0; ; pieces++ {
+		if pieces > max_data_chain_length {
+			return nil, 0, errors.New(fmt.Sprintf("the records of the value at %v go round in circles", ref))
 		}
-	} else {
-		err = Defragment_Node(dp.Parent_node_page, file_header, file)
+		record, err := chain.record(ref, file)
 		if err != nil {
-			return 0, errors.Wrap(err, fmt.Sprintf("error while trying to defragment the nodepage %v", dp.Parent_node_page))
+			return nil, 0, err
+		}
+		if pieces == 0 {
+			flags = record[0] & DATA_RECORD_COMPRESSED
+		}
+		if record[0]&DATA_RECORD_CONTINUED == 0 {
+			return append(data, record[data_record_header_size:]...), flags, nil
 		}
+		if len(record) < data_record_continued_size {
+			return nil, 0, errors.New(fmt.Sprintf("the record at %v is too short to be continued", ref))
+		}
+		data = append(data, record[data_record_continued_size:]...)
+		ref = NativeEndian.Uint32(record[data_record_header_size:data_record_continued_size])
 	}
+}
 
-	// Now, just put data in the last place in the datapage
-	off, err := rec_put_in_datapage_helper(page_id, data, file_header, file)
+func (chain *data_chain) record(ref uint32, file *DBFile) ([]byte, error) {
+	chain_ind, slot := split_data_ref(ref)
+	dp, err := chain.page(chain_ind, file)
 	if err != nil {
-		return 0, err
+		return nil, errors.Wrap(err, fmt.Sprintf("error while trying to find the datapage of the data ref %v", ref))
 	}
-
-	return off, nil
+	return data_page_record(dp, slot)
 }
 
-func checkHeader(b []byte, offset uint16) (bool, uint32) {
-	// Ensure there is enough space in the slice for the header and the length
-	if len(b) < int(offset)+6 {
-		return false, 0
-	}
+func (chain *data_chain) delete_value(ref uint32, file *DBFile) error {
 
-	// Check the head (at offset)
-	var head uint16
-	if NativeEndian == binary.BigEndian {
-		head = binary.BigEndian.Uint16(b[offset:])
-	} else {
-		head = binary.LittleEndian.Uint16(b[offset:])
-	}
-	if head != DATA_HEADER {
-		return false, 0
-	}
+	for pieces := 0; ; pieces++ {
+		if pieces > max_data_chain_length {
+			return errors.New(fmt.Sprintf("the records of the value at %v go round in circles", ref))
+		}
+		record, err := chain.record(ref, file)
+		if err != nil {
+			return err
+		}
+		next := uint32(0)
+		continued := record[0]&DATA_RECORD_CONTINUED != 0
+		if continued {
+			if len(record) < data_record_continued_size {
+				return errors.New(fmt.Sprintf("the record at %v is too short to be continued", ref))
+			}
+			next = NativeEndian.Uint32(record[data_record_header_size:data_record_continued_size])
+		}
 
-	// Check the length (at offset + 2)
-	var length uint32
-	if NativeEndian == binary.BigEndian {
-		length = binary.BigEndian.Uint32(b[offset+2:])
-	} else {
-		length = binary.LittleEndian.Uint32(b[offset+2:])
+		chain_ind, slot := split_data_ref(ref)
+		data_page_free_record(chain.pages[chain_ind], slot)
+		chain.dirty[chain_ind] = true
+		if !continued {
+			return nil
+		}
+		ref = next
 	}
-
-	return true, length + 6
 }
 
-func Delete_in_DataPage(page_id uint32, offset uint32, file_header *FileHeaderPage, file *os.File) error {
+func (chain *data_chain) save(file_header *FileHeaderPage, file *DBFile) error {
 
-	pt, _, _, dp, err := ReadPage(file, page_id)
-	if err != nil {
-		return err
+	// Empty DataPages at the end are dropped (if the chain was read in up to its end), but never the first one
+	keep := len(chain.pages)
+	for chain.next == 0 && keep > 1 && chain.pages[keep-1].Num_slots == 0 {
+		keep--
 	}
-	if pt != Page_type_ids["Data"] {
-		return errors.New(fmt.Sprintf("read page %v isn't a datapage. read page type to be %v", page_id, pt))
+	if keep < len(chain.pages) {
+		chain.pages[keep-1].Next_data_page = 0
+		chain.dirty[keep-1] = true
 	}
 
-	if offset >= max_data_size {
-		if dp.Next_data_page == 0 {
-			return errors.New(fmt.Sprintf("recieved input for offset %v which is over the length of the data field size for this datapage and no next datapage exists", offset))
+	for i := 0; i < keep; i++ {
+		if !chain.dirty[i] {
+			continue
 		}
-		err := Delete_in_DataPage(dp.Next_data_page, offset-max_data_size, file_header, file)
+		err := WriteChunk(file, chain.ids[i], Data_to_Bytes(chain.pages[i]))
 		if err != nil {
-			return err
+			return errors.Wrap(err, fmt.Sprintf("error while trying to save the datapage %v", chain.ids[i]))
 		}
-		return nil
+		chain.dirty[i] = false
 	}
 
-	// Deleting the data
-	type index struct {
-		dp      *DataPage
-		dp_id   uint32
-		data_id uint16
-	}
-	var overflow bool = false
-	j := index{dp, page_id, uint16(offset)}
-	k := j
-	var header_buffer [6]byte
-	for u := 0; u < 6; u++ {
-		if k.data_id == max_data_size {
-			k.data_id = 0
-			k.dp_id = k.dp.Next_data_page
-			pt, _, _, k.dp, err = ReadPage(file, k.dp_id)
-			if err != nil {
-				return err
-			}
-			if pt != Page_type_ids["Data"] {
-				return errors.New(fmt.Sprintf("read page %v isn't a datapage. read page type to be %v", k.dp_id, pt))
-			}
+	if keep < len(chain.pages) {
+		// Still linked to each other in the file, so they all go with the first of them
+		err := DeletePage(chain.ids[keep], file_header, file)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("error while trying to delete unnecessary datapage %v", chain.ids[keep]))
 		}
-		header_buffer[u] = k.dp.Data[k.data_id]
-		k.data_id++
-	}
-	isValid, length := checkHeader(header_buffer[:], 0)
-	if !isValid {
-		return errors.New(fmt.Sprintf("error: data at offset %v is not valid data", offset))
+		chain.ids = chain.ids[:keep]
+		chain.pages = chain.pages[:keep]
+		chain.dirty = chain.dirty[:keep]
 	}
+	return nil
+}
 
-	if j.dp.Space_table_size+1 > data_page_space_table_num_entries {
-		overflow = true
-	}
-	if !overflow {
-		j.dp.Space_table_size++
-		j.dp.Unallocated_space_table[j.dp.Space_table_size-1].Offset = uint16(offset)
+func defragment_datapage(datapage_id uint32, file_header *FileHeaderPage, file *DBFile) error {
+	// Compacts every DataPage of the chain and drops the empty ones at the end. The data refs all stay the same
+
+	chain, err := read_data_chain(datapage_id, file)
+	if err != nil {
+		return err
 	}
-	for i := 0; i < int(length); i++ {
-		if j.data_id >= max_data_size {
-			// Fix the Free Space Table
-			if !overflow {
-				DataPage_table_fixer(j.dp)
-			}
-			// Save the DataPage
-			err = WriteChunk(file, j.dp_id, Data_to_Bytes(j.dp))
-			if err != nil {
-				return err
-			}
-			// Update the j_th index
-			j.dp_id = j.dp.Next_data_page
-			j.data_id = 0
-			pt, _, _, j.dp, err = ReadPage(file, j.dp_id)
-			if err != nil {
-				return err
-			}
-			if pt != Page_type_ids["Data"] {
-				return errors.New(fmt.Sprintf("read page %v isn't a datapage. read page type to be %v", page_id, pt))
-			}
-			if !overflow {
-				if j.dp.Space_table_size+1 > data_page_space_table_num_entries {
-					overflow = true
-				}
-			}
-			if !overflow {
-				j.dp.Space_table_size++
-				j.dp.Unallocated_space_table[j.dp.Space_table_size-1].Offset = 0
-			}
-		}
-		j.dp.Data[j.data_id] = 0
-		j.dp.Data_held--
-		j.data_id++
-		if !overflow {
-			j.dp.Unallocated_space_table[j.dp.Space_table_size-1].Size++
-		}
+	for i, dp := range chain.pages {
+		compact_data_page(dp)
+		chain.dirty[i] = true
 	}
+	return chain.save(file_header, file)
+}
+
+func Defragment_Node(page_id uint32, file_header *FileHeaderPage, file *DBFile) error {
 
-	// Save the j_th DataPage
-	DataPage_table_fixer(j.dp)
-	err = WriteChunk(file, j.dp_id, Data_to_Bytes(j.dp))
+	pt, _, np, _, err := ReadPage(file, page_id)
 	if err != nil {
 		return err
 	}
+	if pt != Page_type_ids["Node"] {
+		return errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", page_id, pt))
+	}
 
-	// Checking if Free Space Table is full or not, if full then defragment the Datapages
-	if overflow {
-		if dp.Parent_node_page != 0 {
-			err = Defragment_Node(dp.Parent_node_page, file_header, file)
-			if err != nil {
-				return err
-			}
-
-		} else {
-			_, err = defragment_datapage(page_id, file_header, file)
-			if err != nil {
-				return err
-			}
-		}
+	if np.Data_page_id == 0 {
+		return errors.New(fmt.Sprintf("tried to defragment a nodepage %v with no associated datapages", page_id))
 	}
 
-	// Update the file_header
-	file_header.Total_data_size -= uint64(length)
+	err = defragment_datapage(np.Data_page_id, file_header, file)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("error while trying to defragment the datapage %v belonging to the nodepage %v", np.Data_page_id, page_id))
+	}
 	return nil
 }
 
-func Read_from_DataPage(page_id uint32, offset uint32, file_header *FileHeaderPage, file *os.File) ([]byte, error) {
+func Put_in_DataPage(page_id uint32, data []byte, file_header *FileHeaderPage, file *DBFile) (uint32, error) {
 
-	pt, _, _, dp, err := ReadPage(file, page_id)
+	chain, err := read_data_chain(page_id, file)
 	if err != nil {
-		return nil, err
-	}
-	if pt != Page_type_ids["Data"] {
-		return nil, errors.New(fmt.Sprintf("read page %v isn't a datapage. read page type to be %v", page_id, pt))
+		return 0, err
 	}
 
-	if offset >= max_data_size {
-		if dp.Next_data_page == 0 {
-			return nil, errors.New(fmt.Sprintf("recieved input for offset %v which is over the length of the data field size for this datapage and no next datapage exists", offset))
-		}
-		data, err := Read_from_DataPage(dp.Next_data_page, offset-max_data_size, file_header, file)
-		if err != nil {
-			return nil, err
-		}
-		return data, nil
+	data, flags := encode_value(data, file)
+	ref, err := chain.put_value(data, flags, file_header, file)
+	if err != nil {
+		return 0, err
 	}
 
-	type index struct {
-		dp      *DataPage
-		dp_id   uint32
-		data_id uint16
-	}
-	j := index{dp, page_id, uint16(offset)}
-	k := j
-	var header_buffer [6]byte
-	for u := 0; u < 6; u++ {
-		if k.data_id == max_data_size {
-			k.data_id = 0
-			k.dp_id = k.dp.Next_data_page
-			pt, _, _, k.dp, err = ReadPage(file, k.dp_id)
-			if err != nil {
-				return nil, err
-			}
-			if pt != Page_type_ids["Data"] {
-				return nil, errors.New(fmt.Sprintf("read page %v isn't a datapage. read page type to be %v", k.dp_id, pt))
-			}
-		}
-		header_buffer[u] = k.dp.Data[k.data_id]
-		k.data_id++
+	err = chain.save(file_header, file)
+	if err != nil {
+		return 0, err
 	}
-	isValid, length := checkHeader(header_buffer[:], 0)
-	if !isValid {
-		return nil, errors.New(fmt.Sprintf("data at offset %v is not valid data", offset))
+	return ref, nil
+}
+
+func Delete_in_DataPage(page_id uint32, ref uint32, file_header *FileHeaderPage, file *DBFile) error {
+
+	chain := new_data_chain(page_id) // Read in only as far as the records of the value are
+	err := chain.delete_value(ref, file)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("error while trying to delete the data at %v", ref))
 	}
 
-	// Reading the Data
-	j = index{dp, page_id, uint16(offset)}
-	var data []byte
-	for i := 0; i < int(length); i++ {
-		if j.data_id >= max_data_size {
-			if j.dp.Next_data_page == 0 {
-				return nil, errors.New(fmt.Sprintf("recieved input for offset %v which is over the length of the data field size for this datapage and no next datapage exists", offset))
-			}
-			j.data_id = 0
-			j.dp_id = j.dp.Next_data_page
-			pt, _, _, j.dp, err = ReadPage(file, j.dp_id)
-			if err != nil {
-				return nil, err
-			}
-			if pt != Page_type_ids["Data"] {
-				return nil, errors.New(fmt.Sprintf("read page %v isn't a datapage. read page type to be %v", page_id, pt))
-			}
-		}
+	return chain.save(file_header, file)
+}
 
-		data = append(data, j.dp.Data[j.data_id])
-		j.data_id++
+func Read_from_DataPage(page_id uint32, ref uint32, file_header *FileHeaderPage, file *DBFile) ([]byte, error) {
+	data, flags, err := read_value_from_DataPage(page_id, ref, file_header, file)
+	if err != nil {
+		return nil, err
 	}
+	return decode_value(data, flags)
+}
 
-	// Removing the headers (6 Bytes) from the data
-	return data[6:], nil
+// The value as it is kept in the DataPages (still compressed if it was), along with its flags
+func read_value_from_DataPage(page_id uint32, ref uint32, file_header *FileHeaderPage, file *DBFile) ([]byte, uint8, error) {
+
+	data, flags, err := new_data_chain(page_id).get_value(ref, file)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, fmt.Sprintf("data at %v is not valid data", ref))
+	}
+	return data, flags, nil
 }
 
 // Data Handling in Node Pages
@@ -769,7 +498,7 @@ func binary_index_node(arr []node_page_cell_offet, low, high int, key uint32) (i
 	return l, false
 }
 
-func Put_in_NodePage(page_id uint32, key uint32, data []byte, new_node uint32, put_child_on_left_of_new_node bool, file_header *FileHeaderPage, file *os.File) error {
+func Put_in_NodePage(page_id uint32, key uint32, data []byte, new_node uint32, put_child_on_left_of_new_node bool, file_header *FileHeaderPage, file *DBFile) error {
 
 	pt, _, np, _, err := ReadPage(file, page_id)
 	if err != nil {
@@ -779,8 +508,10 @@ func Put_in_NodePage(page_id uint32, key uint32, data []byte, new_node uint32, p
 		return errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", page_id, pt))
 	}
 
+	inline := np.Inline_size != 0 && np.Keys_only == 0 && len(data) <= int(np.Inline_size)
+
 	// Make a new DataPage if it doesn't exist
-	if np.Data_page_id == 0 {
+	if np.Data_page_id == 0 && np.Keys_only == 0 && !inline {
 		data_page_id, err := MakeNewPage(Page_type_ids["Data"], file_header, file)
 		if err != nil {
 			return errors.Wrap(err, fmt.Sprintf("error while trying to make a new DataPage for the NodePage %v", page_id))
@@ -793,23 +524,19 @@ func Put_in_NodePage(page_id uint32, key uint32, data []byte, new_node uint32, p
 	}
 
 	// Check if node is full
-	if np.Block_size == uint16(MAX_DEGREE) {
+	if int(np.Block_size) == node_max_degree(np) {
 		return errors.New(fmt.Sprintf("the nodepage %v is full and cannot accept any further key-data", page_id))
 	}
 
-	// Put the data in the DataPage and get where it is saved
-	off, err := Put_in_DataPage(np.Data_page_id, data, file_header, file) // This can update the NodePage we are working in (just the offsets)
-	if err != nil {
-		return errors.Wrap(err, fmt.Sprintf("error while trying to put data in datapage %v for the nodepage %v", np.Data_page_id, page_id))
-	}
-
-	// Read the possibly updated NodePage
-	pt, _, np, _, err = ReadPage(file, page_id)
-	if err != nil {
-		return err
-	}
-	if pt != Page_type_ids["Node"] {
-		return errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", page_id, pt))
+	// Put the data in the DataPage and get its data ref (keys only nodes just drop the data)
+	var off uint32
+	if inline {
+		off = data_ref_inline | uint32(len(data))
+	} else if np.Keys_only == 0 {
+		off, err = Put_in_DataPage(np.Data_page_id, data, file_header, file)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("error while trying to put data in datapage %v for the nodepage %v", np.Data_page_id, page_id))
+		}
 	}
 
 	// Binary Search to find the position in which this key should be kept.
@@ -824,6 +551,15 @@ func Put_in_NodePage(page_id uint32, key uint32, data []byte, new_node uint32, p
 		np.Blocks[i] = np.Blocks[i-1]
 	}
 	np.Blocks[ind] = node_page_cell_offet{Key: key, Offset: off}
+	if np.Inline_size != 0 {
+		size := int(np.Inline_size)
+		copy(np.Inline_values[(ind+1)*size:], np.Inline_values[ind*size:int(np.Block_size)*size])
+		cell := np.Inline_values[ind*size : (ind+1)*size]
+		clear(cell)
+		if inline {
+			copy(cell, data)
+		}
+	}
 	limit := ind + 1
 	if put_child_on_left_of_new_node {
 		limit = ind
@@ -843,7 +579,7 @@ func Put_in_NodePage(page_id uint32, key uint32, data []byte, new_node uint32, p
 	return nil
 }
 
-func Delete_in_NodePage(page_id uint32, key uint32, delete_left_child_of_key bool, file_header *FileHeaderPage, file *os.File) error {
+func Delete_in_NodePage(page_id uint32, key uint32, delete_left_child_of_key bool, file_header *FileHeaderPage, file *DBFile) error {
 
 	pt, _, np, _, err := ReadPage(file, page_id)
 	if err != nil {
@@ -864,22 +600,28 @@ func Delete_in_NodePage(page_id uint32, key uint32, delete_left_child_of_key boo
 
 	// Remove the key from the node
 	temp := np.Blocks[ind]
+	max_degree := node_max_degree(np)
 	var j int
-	for j = ind; j < min(MAX_DEGREE-1, int(np.Block_size)); j++ {
+	for j = ind; j < min(max_degree-1, int(np.Block_size)); j++ {
 		np.Blocks[j] = np.Blocks[j+1]
 	}
 	j = ind + 1
 	if delete_left_child_of_key {
 		j = ind
 	}
-	for j < min(MAX_DEGREE, int(np.Block_size+1)) {
+	for j < min(max_degree, int(np.Block_size+1)) {
 		np.Children[j] = np.Children[j+1]
 		j++
 	}
 	np.Children[j] = 0
-	if np.Block_size == uint16(MAX_DEGREE) {
-		np.Blocks[MAX_DEGREE-1] = node_page_cell_offet{0, 0}
-		np.Children[MAX_DEGREE] = 0
+	if int(np.Block_size) == max_degree {
+		np.Blocks[max_degree-1] = node_page_cell_offet{0, 0}
+		np.Children[max_degree] = 0
+	}
+	if np.Inline_size != 0 {
+		size := int(np.Inline_size)
+		copy(np.Inline_values[ind*size:], np.Inline_values[(ind+1)*size:int(np.Block_size)*size])
+		clear(np.Inline_values[(int(np.Block_size)-1)*size : int(np.Block_size)*size])
 	}
 	np.Block_size -= 1
 
@@ -889,6 +631,10 @@ func Delete_in_NodePage(page_id uint32, key uint32, delete_left_child_of_key boo
 		return err
 	}
 
+	if np.Keys_only != 0 || temp.Offset&data_ref_inline != 0 {
+		return nil
+	}
+
 	// Save the associated key data from the DataPage
 	err = Delete_in_DataPage(np.Data_page_id, temp.Offset, file_header, file)
 	if err != nil {
@@ -898,7 +644,7 @@ func Delete_in_NodePage(page_id uint32, key uint32, delete_left_child_of_key boo
 	return nil
 }
 
-func Read_from_NodePage(page_id uint32, key uint32, file_header *FileHeaderPage, file *os.File) ([]byte, bool, error) {
+func Read_from_NodePage(page_id uint32, key uint32, file_header *FileHeaderPage, file *DBFile) ([]byte, bool, error) {
 	pt, _, np, _, err := ReadPage(file, page_id)
 	if err != nil {
 		return nil, false, err
@@ -912,15 +658,40 @@ func Read_from_NodePage(page_id uint32, key uint32, file_header *FileHeaderPage,
 	if !inArr || ind >= int(np.Block_size) {
 		return nil, false, nil
 	}
+	if np.Keys_only != 0 {
+		return nil, true, nil
+	}
 
-	data, err := Read_from_DataPage(np.Data_page_id, np.Blocks[ind].Offset, file_header, file)
+	data, err := read_node_value(np, ind, file_header, file)
 	if err != nil {
-		return nil, false, errors.Wrap(err, fmt.Sprintf("error while trying to retrieve key %v data from the datapage %v stored at offset %v", key, np.Data_page_id, np.Blocks[ind].Offset))
+		return nil, false, errors.Wrap(err, fmt.Sprintf("error while trying to retrieve key %v data from the nodepage %v", key, page_id))
 	}
 
 	return data, true, nil
 }
 
+// The value of the key at `ind` in the node, right from its cell if it is inline
+func read_node_value(np *NodePage, ind int, file_header *FileHeaderPage, file *DBFile) ([]byte, error) {
+
+	off := np.Blocks[ind].Offset
+	if off&data_ref_inline == 0 {
+		data, err := Read_from_DataPage(np.Data_page_id, off, file_header, file)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("error while trying to read the data from the datapage %v stored at offset %v", np.Data_page_id, off))
+		}
+		return data, nil
+	}
+
+	size := int(np.Inline_size)
+	length := int(off &^ data_ref_inline)
+	if length > size {
+		return nil, errors.New(fmt.Sprintf("the inline value at %v is %v bytes long, but the cells only have room for %v", ind, length, size))
+	}
+	data := make([]byte, length)
+	copy(data, np.Inline_values[ind*size:])
+	return data, nil
+}
+
 // Visualization of Pages
 
 func Visualize_NodePage(page_id uint32, np *NodePage) {
@@ -928,6 +699,18 @@ func Visualize_NodePage(page_id uint32, np *NodePage) {
 	fmt.Printf("NodePage ID: %v\n", page_id)
 	fmt.Printf("\t-> Data_page_id: %v\n", np.Data_page_id)
 	fmt.Printf("\t-> Block_size: %v\n", np.Block_size)
+	if np.Keys_only != 0 {
+		fmt.Printf("\t-> Keys_only\n")
+	}
+	if np.Inline_size != 0 {
+		fmt.Printf("\t-> Inline_size: %v\n", np.Inline_size)
+	}
+	if np.Left_link != 0 {
+		fmt.Printf("\t-> Left_link: %v\n", np.Left_link)
+	}
+	if np.Right_link != 0 {
+		fmt.Printf("\t-> Right_link: %v (High_key: %v)\n", np.Right_link, np.High_key)
+	}
 	fmt.Printf("\t-> Blocks: %v\n", np.Blocks[:max(np.Block_size, 10)])
 	fmt.Printf("\t-> Children: %v\n", np.Children[:max(np.Block_size, 10)+1])
 }
@@ -939,51 +722,26 @@ func Visualize_DataPage(page_id uint32, dp *DataPage) {
 	fmt.Printf("\t-> Data_held: %v\n", dp.Data_held)
 	fmt.Printf("\t-> Next_data_page: %v\n", dp.Next_data_page)
 	fmt.Printf("\t-> Parent_node_page: %v\n", dp.Parent_node_page)
-	fmt.Printf("\t-> Space_table_size: %v\n", dp.Space_table_size)
-	fmt.Printf("\t-> Unallocated_space_table: %v\n", dp.Unallocated_space_table[:max(dp.Space_table_size, 10)])
+	fmt.Printf("\t-> Num_slots: %v\n", dp.Num_slots)
+	fmt.Printf("\t-> Slots: %v\n", dp.Slots[:min(dp.Num_slots, 10)])
 	fmt.Printf("\t-> Data: ")
 
-	var is_data bool
-	var length uint32
-	var i uint16 = 0
-	var j int
-	for i < max_data_size {
-
-		if i == 0 && dp.Data[i] != 0 {
-			is_data, _ = checkHeader(dp.Data[:], i)
-			for !is_data && i < max_data_size && dp.Data[i] != 0 {
-				fmt.Printf("%c", dp.Data[i])
-				i++
-				is_data, _ = checkHeader(dp.Data[:], i)
-			}
-			fmt.Printf(", ")
-		}
-
-		is_data, length = checkHeader(dp.Data[:], i)
-		if !is_data {
+	for i := uint16(0); i < min(dp.Num_slots, 10); i++ {
+		record, err := data_page_record(dp, i)
+		if err != nil {
 			fmt.Printf("---, ")
+			continue
 		}
-		for !is_data && i < max_data_size {
-			i++
-			is_data, length = checkHeader(dp.Data[:], i)
-		}
-		if i >= max_data_size {
-			break
-		}
-		i += 6
-		for j = 0; j < int(length-6) && i < max_data_size; j++ {
-			fmt.Printf("%c", dp.Data[i])
-			i++
-		}
-		if j < int(length-6) {
-			fmt.Printf("...{continued in %v}", dp.Next_data_page)
+		if record[0]&DATA_RECORD_CONTINUED != 0 && len(record) >= data_record_continued_size {
+			fmt.Printf("%q...{continued at %v}, ", record[data_record_continued_size:min(len(record), data_record_continued_size+20)], NativeEndian.Uint32(record[data_record_header_size:data_record_continued_size]))
+			continue
 		}
-		fmt.Printf(", ")
+		fmt.Printf("%q, ", record[data_record_header_size:min(len(record), data_record_header_size+20)])
 	}
 	fmt.Println()
 }
 
-func Visualize_Page(page_id uint32, file_header *FileHeaderPage, file *os.File) error {
+func Visualize_Page(page_id uint32, file_header *FileHeaderPage, file *DBFile) error {
 	pt, fp, np, dp, err := ReadPage(file, page_id)
 	if err != nil {
 		return err
@@ -999,6 +757,7 @@ func Visualize_Page(page_id uint32, file_header *FileHeaderPage, file *os.File)
 	if pt == Page_type_ids["FileHeader"] {
 		fmt.Println()
 		fmt.Printf("FileHeader ID: %v\n", page_id)
+		fmt.Println("\t-> Sequence_num =", fp.Sequence_num)
 		fmt.Println("\t-> Total_pages =", fp.Total_pages)
 		fmt.Println("\t-> Space_table_size =", fp.Space_table_size)
 		fmt.Println("\t-> Total_data_size =", fp.Total_data_size)
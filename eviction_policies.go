@@ -0,0 +1,256 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	Eviction policies of the buffer pool, picked with ConnectOptions.Eviction_policy.
+
+		LRU		->	evicts the page used the longest time ago. Good for point lookups, but a single scan through the
+					file pushes every hot page out.
+		CLOCK	->	an approximation of LRU, every page has a reference bit which is set on use and cleared by the hand
+					sweeping around, the first page found with a clear bit is evicted. Cheaper to keep up than LRU.
+		2Q		->	scan resistant. New pages go into a small FIFO queue (A1in) and only pages used again later on get
+					into the main LRU queue (Am). Later on means either after falling out of A1in (such pages are
+					remembered by id in A1out), or more than a correlation period after the page's previous use. The
+					uses in a quick burst (like a scan reading every key of a node one after the other) count as one.
+					A scan only churns A1in.
+
+	The pool tells the policy about every page added, used and removed, and asks it for a victim when it is full.
+	Pages which can't be evicted right now (pinned ones) are skipped by the policy with the `evictable` check.
+*/
+
+var Eviction_policy_ids map[string]uint8 = map[string]uint8{"LRU": 0, "CLOCK": 1, "2Q": 2}
+
+type eviction_policy interface {
+	added(page_id uint32)
+	accessed(page_id uint32)
+	removed(page_id uint32)
+	victim(evictable func(page_id uint32) bool) (uint32, bool)
+}
+
+func new_eviction_policy(policy_id uint8, max_frames int) (eviction_policy, error) {
+	switch policy_id {
+	case Eviction_policy_ids["LRU"]:
+		return new_lru_policy(), nil
+	case Eviction_policy_ids["CLOCK"]:
+		return new_clock_policy(), nil
+	case Eviction_policy_ids["2Q"]:
+		return new_two_q_policy(max_frames), nil
+	}
+	return nil, errors.New(fmt.Sprintf("unknown eviction policy %v", policy_id))
+}
+
+// LRU
+
+type lru_policy struct {
+	order *list.List // Front is the most recently used page
+	elems map[uint32]*list.Element
+}
+
+func new_lru_policy() *lru_policy {
+	return &lru_policy{order: list.New(), elems: make(map[uint32]*list.Element)}
+}
+
+func (p *lru_policy) added(page_id uint32) {
+	p.elems[page_id] = p.order.PushFront(page_id)
+}
+
+func (p *lru_policy) accessed(page_id uint32) {
+	if elem, ok := p.elems[page_id]; ok {
+		p.order.MoveToFront(elem)
+	}
+}
+
+func (p *lru_policy) removed(page_id uint32) {
+	if elem, ok := p.elems[page_id]; ok {
+		p.order.Remove(elem)
+		delete(p.elems, page_id)
+	}
+}
+
+func (p *lru_policy) victim(evictable func(page_id uint32) bool) (uint32, bool) {
+	for elem := p.order.Back(); elem != nil; elem = elem.Prev() {
+		if page_id := elem.Value.(uint32); evictable(page_id) {
+			return page_id, true
+		}
+	}
+	return 0, false
+}
+
+// CLOCK
+
+type clock_slot struct {
+	page_id    uint32
+	in_use     bool
+	referenced bool
+}
+
+type clock_policy struct {
+	slots      []clock_slot
+	slot_of    map[uint32]int
+	free_slots []int
+	hand       int
+}
+
+func new_clock_policy() *clock_policy {
+	return &clock_policy{slot_of: make(map[uint32]int)}
+}
+
+func (p *clock_policy) added(page_id uint32) {
+	slot := clock_slot{page_id: page_id, in_use: true, referenced: true}
+	if n := len(p.free_slots); n > 0 {
+		i := p.free_slots[n-1]
+		p.free_slots = p.free_slots[:n-1]
+		p.slots[i] = slot
+		p.slot_of[page_id] = i
+		return
+	}
+	p.slots = append(p.slots, slot)
+	p.slot_of[page_id] = len(p.slots) - 1
+}
+
+func (p *clock_policy) accessed(page_id uint32) {
+	if i, ok := p.slot_of[page_id]; ok {
+		p.slots[i].referenced = true
+	}
+}
+
+func (p *clock_policy) removed(page_id uint32) {
+	if i, ok := p.slot_of[page_id]; ok {
+		p.slots[i] = clock_slot{}
+		p.free_slots = append(p.free_slots, i)
+		delete(p.slot_of, page_id)
+	}
+}
+
+func (p *clock_policy) victim(evictable func(page_id uint32) bool) (uint32, bool) {
+	// Two full sweeps, the first one may only be clearing reference bits
+	for step := 0; step < 2*len(p.slots); step++ {
+		if p.hand >= len(p.slots) {
+			p.hand = 0
+		}
+		slot := &p.slots[p.hand]
+		p.hand++
+		if !slot.in_use || !evictable(slot.page_id) {
+			continue
+		}
+		if slot.referenced {
+			slot.referenced = false
+			continue
+		}
+		return slot.page_id, true
+	}
+	return 0, false
+}
+
+// 2Q
+
+type two_q_policy struct {
+	a1in      *list.List // FIFO of pages seen once, front is the newest
+	am        *list.List // LRU of pages seen again, front is the most recently used
+	a1out     *list.List // Ids of the pages evicted from a1in, front is the newest
+	elems     map[uint32]*list.Element
+	in_am     map[uint32]bool
+	a1out_ids map[uint32]*list.Element
+	max_a1in  int
+	max_a1out int
+
+	tick               uint64            // Counts every use of every page
+	last_use           map[uint32]uint64 // Tick of the previous use of the pages in a1in
+	correlation_period uint64
+}
+
+func new_two_q_policy(max_frames int) *two_q_policy {
+	// The sizes suggested by the 2Q paper: A1in gets a quarter of the pool, A1out remembers half of it
+	return &two_q_policy{
+		a1in:      list.New(),
+		am:        list.New(),
+		a1out:     list.New(),
+		elems:     make(map[uint32]*list.Element),
+		in_am:     make(map[uint32]bool),
+		a1out_ids: make(map[uint32]*list.Element),
+		max_a1in:  max(1, max_frames/4),
+		max_a1out: max(1, max_frames/2),
+
+		last_use:           make(map[uint32]uint64),
+		correlation_period: uint64(max(1, max_frames/4)),
+	}
+}
+
+func (p *two_q_policy) added(page_id uint32) {
+	p.tick++
+	if elem, ok := p.a1out_ids[page_id]; ok {
+		// Used again after falling out of A1in, so it is hot
+		p.a1out.Remove(elem)
+		delete(p.a1out_ids, page_id)
+		p.elems[page_id] = p.am.PushFront(page_id)
+		p.in_am[page_id] = true
+		return
+	}
+	p.elems[page_id] = p.a1in.PushFront(page_id)
+	p.last_use[page_id] = p.tick
+}
+
+func (p *two_q_policy) accessed(page_id uint32) {
+	p.tick++
+	if p.in_am[page_id] {
+		p.am.MoveToFront(p.elems[page_id])
+		return
+	}
+	elem, ok := p.elems[page_id]
+	if !ok {
+		return
+	}
+
+	// Pages in A1in are left where they are while they are used in a burst
+	if p.tick-p.last_use[page_id] <= p.correlation_period {
+		p.last_use[page_id] = p.tick
+		return
+	}
+	p.a1in.Remove(elem)
+	delete(p.last_use, page_id)
+	p.elems[page_id] = p.am.PushFront(page_id)
+	p.in_am[page_id] = true
+}
+
+func (p *two_q_policy) removed(page_id uint32) {
+	elem, ok := p.elems[page_id]
+	if !ok {
+		return
+	}
+	if p.in_am[page_id] {
+		p.am.Remove(elem)
+		delete(p.in_am, page_id)
+	} else {
+		p.a1in.Remove(elem)
+		delete(p.last_use, page_id)
+		// Remember it, so that it goes straight to Am if it comes back soon
+		p.a1out_ids[page_id] = p.a1out.PushFront(page_id)
+		if p.a1out.Len() > p.max_a1out {
+			oldest := p.a1out.Back()
+			p.a1out.Remove(oldest)
+			delete(p.a1out_ids, oldest.Value.(uint32))
+		}
+	}
+	delete(p.elems, page_id)
+}
+
+func (p *two_q_policy) victim(evictable func(page_id uint32) bool) (uint32, bool) {
+	first, second := p.am, p.a1in
+	if p.a1in.Len() > p.max_a1in {
+		first, second = p.a1in, p.am
+	}
+	for _, queue := range []*list.List{first, second} {
+		for elem := queue.Back(); elem != nil; elem = elem.Prev() {
+			if page_id := elem.Value.(uint32); evictable(page_id) {
+				return page_id, true
+			}
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// A pool of `num_frames` pages run on nothing but the policy (like replay_trace), to see what it keeps
+type policy_harness struct {
+	policy     eviction_policy
+	num_frames int
+	cached     map[uint32]bool
+}
+
+func new_policy_harness(t *testing.T, policy_name string, num_frames int) *policy_harness {
+	policy, err := new_eviction_policy(Eviction_policy_ids[policy_name], num_frames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &policy_harness{policy: policy, num_frames: num_frames, cached: make(map[uint32]bool)}
+}
+
+func (h *policy_harness) use(page_ids ...uint32) {
+	for _, page_id := range page_ids {
+		if h.cached[page_id] {
+			h.policy.accessed(page_id)
+			continue
+		}
+		if len(h.cached) >= h.num_frames {
+			h.evict()
+		}
+		h.cached[page_id] = true
+		h.policy.added(page_id)
+	}
+}
+
+func (h *policy_harness) evict() uint32 {
+	victim, found := h.policy.victim(func(page_id uint32) bool { return true })
+	if !found {
+		return 0
+	}
+	h.policy.removed(victim)
+	delete(h.cached, victim)
+	return victim
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		policy  string
+		frames  int
+		uses    []uint32
+		victims []uint32 // Evicted one after the other once the uses are done
+	}{
+		// The least recently used goes first, a use moves a page to the back of the line
+		{"LRU order", "LRU", 4, []uint32{1, 2, 3, 4, 1, 3}, []uint32{2, 4, 1, 3}},
+		// The first sweep clears every bit and comes back round to 1
+		{"CLOCK sweep", "CLOCK", 4, []uint32{1, 2, 3, 4}, []uint32{1}},
+		// 5 takes the place of 1 and 2 is used again, so both get passed over once more while 3 and 4 go
+		{"CLOCK second chance", "CLOCK", 4, []uint32{1, 2, 3, 4, 5, 2}, []uint32{3, 4, 2, 5}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			h := new_policy_harness(t, test.policy, test.frames)
+			h.use(test.uses...)
+			for i, want := range test.victims {
+				if victim := h.evict(); victim != want {
+					t.Fatalf("victim %v is the page %v instead of %v", i, victim, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTwoQScanResistance(t *testing.T) {
+	// A page used again a while after it came in goes to Am, and a scan over more pages than the whole pool only
+	// churns A1in around it
+	for _, policy_name := range []string{"2Q", "LRU"} {
+		h := new_policy_harness(t, policy_name, 16)
+		h.use(1000)
+		for page_id := uint32(1); page_id <= 8; page_id++ {
+			h.use(page_id) // Longer than the correlation period
+		}
+		h.use(1000)
+		for page_id := uint32(2000); page_id < 2100; page_id++ {
+			h.use(page_id)
+		}
+
+		kept := h.cached[1000]
+		if policy_name == "2Q" && (!kept || !h.policy.(*two_q_policy).in_am[1000]) {
+			t.Fatal("2Q let a scan push the reused page out of Am")
+		}
+		if policy_name == "LRU" && kept {
+			t.Fatal("LRU kept the reused page through a scan bigger than the pool, the scan isn't big enough to test 2Q")
+		}
+	}
+}
+
+func TestPinInternalNodes(t *testing.T) {
+	// The root is read once, and then every other page of the db is read through a pool much smaller than the db
+	store, _ := New_memory_page_store(DEFAULT_PAGESIZE)
+	file, file_header, err := Create_and_ConnectDB_with_store(store, Default_connect_options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := uint32(0); key < 3000; key++ {
+		err = Insert(key, []byte(fmt.Sprintf("value-%v-%064d", key, key)), file_header, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	DisconnectDB(file, file_header)
+
+	for _, policy_name := range []string{"LRU", "CLOCK", "2Q"} {
+		for _, pin_internal_nodes := range []bool{false, true} {
+			t.Run(fmt.Sprint(policy_name, "/", pin_internal_nodes), func(t *testing.T) {
+				options := Default_connect_options
+				options.Buffer_pool_bytes = 8 * 2 * DEFAULT_PAGESIZE
+				options.Eviction_policy = Eviction_policy_ids[policy_name]
+				options.Pin_internal_nodes = pin_internal_nodes
+				file, file_header, err := ConnectDB_with_store(store, options)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer DisconnectDB(file, file_header)
+
+				root_id := file_header.Root_node_id
+				_, _, root, _, err := ReadPage(file, root_id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if root.Children[0] == 0 {
+					t.Fatal("the root is a leaf, there are no internal nodes to pin")
+				}
+				num_pages, _ := num_pages_in_db_file(file)
+				for page_id := uint32(num_file_header_slots); page_id < num_pages; page_id++ {
+					if page_id != root_id {
+						_, _, _, _, err = ReadPage(file, page_id)
+						if err != nil {
+							t.Fatal(err)
+						}
+					}
+				}
+
+				file.pool.lock.Lock()
+				_, cached := file.pool.frames[root_id]
+				file.pool.lock.Unlock()
+				if cached != pin_internal_nodes {
+					t.Fatalf("the root is cached = %v after reading %v pages through %v frames", cached, num_pages, file.pool.max_frames)
+				}
+			})
+		}
+	}
+}
+
+// Hot point lookups (90% of them on 1% of the keys) with a scan over 20% of the keys every 2000 lookups
+// Run with `go test -bench EvictionPolicies -run XXX`, the hit ratio of every policy is reported along with the time
+func BenchmarkEvictionPolicies(b *testing.B) {
+	const num_keys = 20000
+	const num_frames = 64
+
+	store, _ := New_memory_page_store(DEFAULT_PAGESIZE)
+	file, file_header, err := Create_and_ConnectDB_with_store(store, Default_connect_options)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for key := 0; key < num_keys; key++ {
+		err = Insert(uint32(key), []byte(fmt.Sprintf("value-%v-%0128d", key, key)), file_header, file)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	DisconnectDB(file, file_header)
+
+	for _, policy_name := range []string{"LRU", "CLOCK", "2Q"} {
+		for _, pin_internal_nodes := range []bool{false, true} {
+			b.Run(fmt.Sprint(policy_name, "/pin_internal_nodes=", pin_internal_nodes), func(b *testing.B) {
+				options := Default_connect_options
+				options.Buffer_pool_bytes = num_frames * 2 * DEFAULT_PAGESIZE
+				options.Eviction_policy = Eviction_policy_ids[policy_name]
+				options.Pin_internal_nodes = pin_internal_nodes
+				file, file_header, err := ConnectDB_with_store(store, options)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer DisconnectDB(file, file_header)
+
+				rng := rand.New(rand.NewSource(1)) // Same workload for everyone
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					key := rng.Intn(num_keys)
+					if rng.Intn(10) != 0 {
+						key = rng.Intn(num_keys / 100)
+					}
+					_, _, err = Get(uint32(key), file_header, file)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if i%2000 == 1999 {
+						scan_start := rng.Intn(num_keys - num_keys/5)
+						for key := scan_start; key < scan_start+num_keys/5; key++ {
+							_, _, err = Get(uint32(key), file_header, file)
+							if err != nil {
+								b.Fatal(err)
+							}
+						}
+					}
+				}
+				b.StopTimer()
+
+				stats := Buffer_pool_stats(file)
+				b.ReportMetric(100*float64(stats.Hits)/float64(max(1, stats.Hits+stats.Misses)), "hit%")
+			})
+		}
+	}
+}
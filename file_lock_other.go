@@ -0,0 +1,15 @@
+//go:build !unix && !windows
+
+package main
+
+import "os"
+
+// No file locking is available on this platform, so every lock request simply succeeds.
+
+func try_lock_file(file *os.File, exclusive bool) (bool, error) {
+	return true, nil
+}
+
+func unlock_file(file *os.File) error {
+	return nil
+}
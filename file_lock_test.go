@@ -0,0 +1,83 @@
+//go:build unix || windows
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestSecondWriterLocked(t *testing.T) {
+	const db_name = "test_file_lock_writers"
+	create_test_db(t, db_name)
+
+	file, file_header, err := ConnectDB(db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DisconnectDB(file, file_header)
+
+	options := Default_connect_options
+	options.Lock_timeout = 200 * time.Millisecond
+	start := time.Now()
+	_, _, err = ConnectDB_with_options(db_name, options)
+	waited := time.Since(start)
+	if !errors.Is(err, ErrDatabaseLocked) {
+		t.Fatalf("a second writer got %v instead of ErrDatabaseLocked", err)
+	}
+	if waited < options.Lock_timeout || waited > options.Lock_timeout+time.Second {
+		t.Fatalf("the second writer gave up after %v, with a lock timeout of %v", waited, options.Lock_timeout)
+	}
+}
+
+func TestReadersShareTheFile(t *testing.T) {
+	const db_name = "test_file_lock_readers"
+	create_test_db(t, db_name)
+
+	options := Default_connect_options
+	options.Lock_timeout = 200 * time.Millisecond
+	options.Read_only = true
+	file_1, file_header_1, err := ConnectDB_with_options(db_name, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file_2, file_header_2, err := ConnectDB_with_options(db_name, options)
+	if err != nil {
+		t.Fatalf("a second reader couldn't connect: %v", err)
+	}
+	_, found, err := Get(10, file_header_2, file_2)
+	if err != nil || !found {
+		t.Fatalf("the second reader couldn't read key 10 (err = %v)", err)
+	}
+
+	// No writer while they are there
+	writer := options
+	writer.Read_only = false
+	_, _, err = ConnectDB_with_options(db_name, writer)
+	if !errors.Is(err, ErrDatabaseLocked) {
+		t.Fatalf("a writer got %v instead of ErrDatabaseLocked while readers were connected", err)
+	}
+	DisconnectDB(file_1, file_header_1)
+	DisconnectDB(file_2, file_header_2)
+}
+
+func TestReaderLockedOutByWriter(t *testing.T) {
+	const db_name = "test_file_lock_reader"
+	create_test_db(t, db_name)
+
+	file, file_header, err := ConnectDB(db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DisconnectDB(file, file_header)
+
+	options := Default_connect_options
+	options.Lock_timeout = 200 * time.Millisecond
+	options.Read_only = true
+	_, _, err = ConnectDB_with_options(db_name, options)
+	if !errors.Is(err, ErrDatabaseLocked) {
+		t.Fatalf("a reader got %v instead of ErrDatabaseLocked while a writer was connected", err)
+	}
+}
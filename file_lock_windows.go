@@ -0,0 +1,44 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Locking of the db file through LockFileEx, which covers the whole file (and anything it could grow into).
+
+const lockfile_fail_immediately = 0x00000001
+const lockfile_exclusive_lock = 0x00000002
+const error_lock_violation syscall.Errno = 33
+
+var kernel32 = syscall.NewLazyDLL("kernel32.dll")
+var proc_lock_file_ex = kernel32.NewProc("LockFileEx")
+var proc_unlock_file_ex = kernel32.NewProc("UnlockFileEx")
+
+func try_lock_file(file *os.File, exclusive bool) (bool, error) {
+	flags := uintptr(lockfile_fail_immediately)
+	if exclusive {
+		flags |= lockfile_exclusive_lock
+	}
+	var overlapped syscall.Overlapped
+	r1, _, err := proc_lock_file_ex.Call(file.Fd(), flags, 0, 0xFFFFFFFF, 0xFFFFFFFF, uintptr(unsafe.Pointer(&overlapped)))
+	if r1 != 0 {
+		return true, nil
+	}
+	if err == error_lock_violation {
+		return false, nil
+	}
+	return false, err
+}
+
+func unlock_file(file *os.File) error {
+	var overlapped syscall.Overlapped
+	r1, _, err := proc_unlock_file_ex.Call(file.Fd(), 0, 0xFFFFFFFF, 0xFFFFFFFF, uintptr(unsafe.Pointer(&overlapped)))
+	if r1 == 0 {
+		return err
+	}
+	return nil
+}
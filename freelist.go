@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	Freelist of the db file, for the free pages that don't fit in the Free Space table of the File Header.
+
+	The Free Space table only has room for 200 runs of free pages. Every page deleted after it is full goes to the
+	freelist instead, which is a chain of FreelistPages starting at Freelist_head of the File Header. Each FreelistPage
+	holds the ids of free pages (1019 of them for 4kB pages) and the id of the next FreelistPage, so there is no limit
+	on how many free pages can be kept track of, and the db file never has to be rewritten just because lots of pages
+	got deleted.
+
+		push	->	the page id goes into the first FreelistPage of the chain. If it is full (or there is none), the
+					freed page itself becomes the new first FreelistPage, pointing to the old one.
+		pop		->	the last page id of the first FreelistPage is handed out. If that one is empty, the FreelistPage
+					itself is handed out and the next one becomes the first.
+
+	So the FreelistPages are free pages as well, they are just holding the list for now. They aren't counted in
+	Total_pages or Freelist_size, and the compaction of the db file moves them down like any other page (see
+	compaction.go). New pages are taken from the Free Space table first, then from the freelist, and only then from
+	the end of the file.
+
+	Trimming the db file can cut off pages which are still in the freelist. They aren't looked for in the whole chain
+	right then (that would be a read of every FreelistPage for every trim, and the compaction trims after every page
+	it moves), pop drops them instead once their FreelistPage is the first one, so every pop is still one FreelistPage
+	read and written. Until then they stay counted in Freelist_size. The file only grows again once the freelist is
+	used up, so an id past the end of the file is always one of these and never a page in use.
+
+	Both are only ever called with file.alloc_lock held.
+*/
+
+func read_freelist_page(page_id uint32, file *DBFile) (*FreelistPage, error) {
+
+	buf, err := ReadChunk(file, page_id)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("error while trying to read the freelist page %v", page_id))
+	}
+	ident, page_type := decode_page_start(buf)
+	if ident != PAGE_IDENTITY_NUM || page_type != Page_type_ids["Freelist"] {
+		return nil, errors.New(fmt.Sprintf("expected to find a freelist page at page_id = %v. found page type = %v", page_id, page_type))
+	}
+	err = verify_page_checksum(page_id, buf, file.layout.page_size)
+	if err != nil {
+		return nil, err
+	}
+
+	fp := new_freelist_page(file.layout)
+	decode_freelist_page(buf, fp, file.layout)
+	return fp, nil
+}
+
+func push_to_freelist(page_id uint32, file_header *FileHeaderPage, file *DBFile) error {
+
+	if file_header.Freelist_head != 0 {
+		fp, err := read_freelist_page(file_header.Freelist_head, file)
+		if err != nil {
+			return err
+		}
+		if int(fp.Num_entries) < len(fp.Page_ids) {
+			fp.Page_ids[fp.Num_entries] = page_id
+			fp.Num_entries += 1
+			err = WriteChunk(file, file_header.Freelist_head, Data_to_Bytes(fp))
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("error while trying to add page %v to the freelist page %v", page_id, file_header.Freelist_head))
+			}
+			file_header.Freelist_size += 1
+			return nil
+		}
+	}
+
+	// No room left in the chain, so this page starts a new FreelistPage in front of it
+	fp := new_freelist_page(file.layout)
+	fp.Identification_num = PAGE_IDENTITY_NUM
+	fp.Page_type = Page_type_ids["Freelist"]
+	fp.Next_freelist_page = file_header.Freelist_head
+	err := WriteChunk(file, page_id, Data_to_Bytes(fp))
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("error while trying to make page %v a freelist page", page_id))
+	}
+	file_header.Freelist_head = page_id
+	return nil
+}
+
+// Returns false if the freelist is empty
+func pop_from_freelist(file_header *FileHeaderPage, file *DBFile) (uint32, bool, error) {
+
+	if file_header.Freelist_head == 0 {
+		return 0, false, nil
+	}
+	fp, err := read_freelist_page(file_header.Freelist_head, file)
+	if err != nil {
+		return 0, false, err
+	}
+	num_pages, err := num_pages_in_db_file(file)
+	if err != nil {
+		return 0, false, err
+	}
+	dropped := drop_cut_off_page_ids(fp, num_pages)
+	file_header.Freelist_size -= dropped
+
+	if fp.Num_entries == 0 {
+		// Nothing left in it, so the FreelistPage itself is the free page
+		page_id := file_header.Freelist_head
+		file_header.Freelist_head = fp.Next_freelist_page
+		return page_id, true, nil
+	}
+
+	fp.Num_entries -= 1
+	page_id := fp.Page_ids[fp.Num_entries]
+	fp.Page_ids[fp.Num_entries] = 0
+	err = WriteChunk(file, file_header.Freelist_head, Data_to_Bytes(fp))
+	if err != nil {
+		return 0, false, errors.Wrap(err, fmt.Sprintf("error while trying to take page %v out of the freelist page %v", page_id, file_header.Freelist_head))
+	}
+	file_header.Freelist_size -= 1
+	return page_id, true, nil
+}
+
+func drop_cut_off_page_ids(fp *FreelistPage, num_pages uint32) uint32 {
+	// Takes the ids of the pages trimmed off the end of the file out of the FreelistPage, returns how many there were
+
+	var kept uint32
+	for i := uint32(0); i < fp.Num_entries; i++ {
+		if fp.Page_ids[i] < num_pages {
+			fp.Page_ids[kept] = fp.Page_ids[i]
+			kept++
+		}
+	}
+	dropped := fp.Num_entries - kept
+	clear(fp.Page_ids[kept:fp.Num_entries])
+	fp.Num_entries = kept
+	return dropped
+}
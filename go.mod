@@ -2,4 +2,4 @@ module VirajAgarwal1/b_tree_disk
 
 go 1.22.5
 
-require github.com/pkg/errors v0.9.1 // indirect
+require github.com/pkg/errors v0.9.1
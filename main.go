@@ -1,15 +1,18 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
-func postorder(node_id uint32, want_expanded_output bool, file_header *FileHeaderPage, file *os.File) error {
+func postorder(node_id uint32, want_expanded_output bool, file_header *FileHeaderPage, file *DBFile) error {
 	var err error
 	if node_id != 0 {
 		err = Visualize_Page(node_id, file_header, file)
@@ -187,7 +190,160 @@ func test(db_name string) error {
 	return nil
 }
 
+// Compares the eviction policies of the buffer pool, `go run . bench <trace_file>` replays a trace of page ids
+// (separated by whitespace) straight against the policies
+// The hot key and scan workload on a real db is BenchmarkEvictionPolicies, `go test -bench EvictionPolicies -run XXX`
+func bench_eviction_policies(trace_file string) error {
+
+	policies := []string{"LRU", "CLOCK", "2Q"}
+	num_frames := 64
+
+	trace_bytes, err := os.ReadFile(trace_file)
+	if err != nil {
+		return errors.Wrap(err, "error while reading the trace file")
+	}
+	var trace []uint32
+	for _, field := range strings.Fields(string(trace_bytes)) {
+		page_id, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("bad page id %v in the trace file", field))
+		}
+		trace = append(trace, uint32(page_id))
+	}
+
+	fmt.Printf("\nReplaying %v page accesses with %v pages of cache\n\n", len(trace), num_frames)
+	for _, name := range policies {
+		hits, misses, err := replay_trace(trace, Eviction_policy_ids[name], num_frames)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-6v hits = %-8v misses = %-8v hit ratio = %.2f%%\n", name, hits, misses, 100*float64(hits)/float64(max(1, hits+misses)))
+	}
+	return nil
+}
+
+func replay_trace(trace []uint32, policy_id uint8, num_frames int) (int, int, error) {
+	// Only the policy is run, no pages are read
+	policy, err := new_eviction_policy(policy_id, num_frames)
+	if err != nil {
+		return 0, 0, err
+	}
+	cached := make(map[uint32]bool)
+	always := func(page_id uint32) bool { return true }
+
+	hits, misses := 0, 0
+	for _, page_id := range trace {
+		if cached[page_id] {
+			hits++
+			policy.accessed(page_id)
+			continue
+		}
+		misses++
+		if len(cached) >= num_frames {
+			victim, found := policy.victim(always)
+			if found {
+				policy.removed(victim)
+				delete(cached, victim)
+			}
+		}
+		cached[page_id] = true
+		policy.added(page_id)
+	}
+	return hits, misses, nil
+}
+
+func vacuum_command(db_name string) error {
+	file_size := func() (int64, error) {
+		file_stats, err := os.Stat(db_file_path(db_name))
+		if err != nil {
+			return 0, errors.Wrap(err, "coudnt get the file stats")
+		}
+		return file_stats.Size(), nil
+	}
+
+	before, err := file_size()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = Vacuum_db(db_name, Default_connect_options)
+	if err != nil {
+		return err
+	}
+	after, err := file_size()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Vacuumed %v in %v: %v B -> %v B\n", db_file_path(db_name), time.Since(start), before, after)
+	return nil
+}
+
+func check_command(db_name string) (bool, error) {
+	options := Default_connect_options
+	options.Read_only = true
+	file, file_header, err := ConnectDB_with_options(db_name, options)
+	if err != nil {
+		return false, err
+	}
+	defer DisconnectDB(file, file_header)
+
+	report, err := Check(file_header, file)
+	if err != nil {
+		return false, err
+	}
+	out, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		return false, errors.Wrap(err, "coudnt encode the check report")
+	}
+	fmt.Println(string(out))
+	return report.Ok, nil
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		if len(os.Args) < 3 {
+			fmt.Println("usage: bench <trace_file>")
+			os.Exit(2)
+		}
+		err := bench_eviction_policies(os.Args[2])
+		if err != nil {
+			fmt.Printf("%+v\n", err)
+			panic(err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "vacuum" {
+		// `vacuum <db_name>` rewrites ./databases/<db_name>.db into a packed file (see vacuum.go)
+		if len(os.Args) < 3 {
+			fmt.Println("usage: vacuum <db_name>")
+			os.Exit(2)
+		}
+		err := vacuum_command(os.Args[2])
+		if err != nil {
+			fmt.Printf("%+v\n", err)
+			panic(err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		// `check <db_name>` prints the report of Check (see check.go) as json, and exits with 1 if anything is wrong
+		if len(os.Args) < 3 {
+			fmt.Println("usage: check <db_name>")
+			os.Exit(2)
+		}
+		ok, err := check_command(os.Args[2])
+		if err != nil {
+			fmt.Printf("%+v\n", err)
+			panic(err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
 	for i := 0; i < 1; i++ {
 		err := test("aswd")
 		if err != nil {
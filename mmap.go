@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	Memory mapped read path (ConnectOptions.Use_mmap), for read-mostly use. Only the file store has it (see page_store.go).
+
+	The whole db file is mapped read-only, and reading a page from the disk is just slicing the mapping, no read call
+	and no copy. The slice handed out by ReadChunk then points straight into the mapping, so it must never be written
+	to (the mapping is read-only and the process would crash). Writes still go through WriteAt, and show up in the
+	mapping on their own.
+
+	The mapping is made bigger than the file (twice its size), so that the file can grow for a while without a remap.
+	When it outgrows the mapping, a new mapping is made, but the old one can't be unmapped right away, since readers
+	may still be holding pages sliced out of it. Old mappings are only unmapped when nobody can be reading, i.e. when
+	the file is trimmed (which happens with file.lock held in write mode) and on DisconnectDB. Trimming also remaps to
+	fit the smaller file.
+
+	With the buffer pool turned off as well, Get and Get_into look the key up right in the mapped pages without decoding
+	them (see page_view.go), so Get_into allocates nothing at all and Get only the value it returns.
+*/
+
+const min_mapping_size = 1 << 20 // 1MB
+
+type file_mapping struct {
+	lock      sync.RWMutex
+	data      []byte // The current mapping, longer than the file
+	file_size int64  // How much of the mapping is backed by the file, reading past it would crash
+	page_size int64
+	retired   [][]byte
+}
+
+func mapping_size_for(file_size int64) int {
+	return int(max(2*file_size, min_mapping_size))
+}
+
+func open_mapping(file *os.File, page_size int) (*file_mapping, error) {
+
+	file_stats, err := file.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "coudnt get the file stats")
+	}
+	data, err := map_file(file, mapping_size_for(file_stats.Size()))
+	if err != nil {
+		return nil, errors.Wrap(err, "error while memory mapping the db file")
+	}
+	return &file_mapping{data: data, file_size: file_stats.Size(), page_size: int64(page_size)}, nil
+}
+
+func (m *file_mapping) read_chunk(pageIndex uint32) ([]byte, error) {
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	offset := int64(pageIndex) * m.page_size
+	if offset >= m.file_size {
+		return nil, errors.New(fmt.Sprintf("Specified pageIndex = %v is out of the scope of the file", pageIndex))
+	}
+	end := min(offset+m.page_size, m.file_size)
+	return m.data[offset:end:end], nil
+}
+
+func (m *file_mapping) grown(new_file_size int64, file *os.File) error {
+	// The file was written up to `new_file_size` bytes
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if new_file_size <= m.file_size {
+		return nil
+	}
+	if new_file_size > int64(len(m.data)) {
+		data, err := map_file(file, mapping_size_for(new_file_size))
+		if err != nil {
+			return errors.Wrap(err, "error while remapping the grown db file")
+		}
+		m.retired = append(m.retired, m.data)
+		m.data = data
+	}
+	m.file_size = new_file_size
+	return nil
+}
+
+func (m *file_mapping) shrunk(new_file_size int64, file *os.File) error {
+	// Only called with file.lock held in write mode, so no one is holding pages of any of the mappings
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	data, err := map_file(file, mapping_size_for(new_file_size))
+	if err != nil {
+		return errors.Wrap(err, "error while remapping the trimmed db file")
+	}
+	m.retired = append(m.retired, m.data)
+	m.data = data
+	m.file_size = new_file_size
+	return m.unmap_retired()
+}
+
+func (m *file_mapping) unmap_retired() error {
+	for _, old := range m.retired {
+		err := unmap_file(old)
+		if err != nil {
+			return errors.Wrap(err, "error while unmapping an old mapping of the db file")
+		}
+	}
+	m.retired = nil
+	return nil
+}
+
+func (m *file_mapping) close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.retired = append(m.retired, m.data)
+	m.data = nil
+	m.file_size = 0
+	return m.unmap_retired()
+}
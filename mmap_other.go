@@ -0,0 +1,19 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// No memory mapping on this platform, ConnectOptions.Use_mmap can't be used here.
+
+func map_file(file *os.File, length int) ([]byte, error) {
+	return nil, errors.New("memory mapping the db file is not supported on this platform")
+}
+
+func unmap_file(mapping []byte) error {
+	return nil
+}
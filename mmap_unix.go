@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Read-only shared mapping of the db file through mmap(2). Writes made through the file show up in it right away.
+
+func map_file(file *os.File, length int) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, length, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func unmap_file(mapping []byte) error {
+	return syscall.Munmap(mapping)
+}
@@ -0,0 +1,55 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetIntoNoAllocs(t *testing.T) {
+	// With the file mapped and no buffer pool, Get_into reads straight out of the mapping into dst
+	for _, tree_mode := range []string{"BTree", "BLink", "BPlus"} {
+		for _, inline_value_size := range []int{0, 32} {
+			t.Run(fmt.Sprint(tree_mode, "/inline=", inline_value_size), func(t *testing.T) {
+				options := Default_connect_options
+				options.Tree_mode = Tree_mode_ids[tree_mode]
+				options.Inline_value_size = inline_value_size
+				options.Buffer_pool_bytes = 0
+				options.Use_mmap = true
+				store, err := Open_file_page_store(filepath.Join(t.TempDir(), "allocs.db"), true, options)
+				if err != nil {
+					t.Fatal(err)
+				}
+				file, file_header, err := Create_and_ConnectDB_with_store(store, options)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer DisconnectDB(file, file_header)
+				for key := uint32(0); key < 2000; key++ {
+					err = Insert(key, []byte(fmt.Sprintf("value-%v", key)), file_header, file)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				if store.(*file_page_store).mapping == nil {
+					t.Fatal("the file isn't mapped")
+				}
+
+				dst := make([]byte, 0, 64)
+				key := uint32(0)
+				allocs := testing.AllocsPerRun(1000, func() {
+					data, found, err := Get_into(key, dst[:0], file_header, file)
+					if err != nil || !found || len(data) == 0 {
+						t.Fatalf("Get_into(%v) gave %q, found = %v (err = %v)", key, string(data), found, err)
+					}
+					key = (key + 7) % 2000
+				})
+				if allocs != 0 {
+					t.Fatalf("Get_into made %v allocations per call", allocs)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+// The pages written and read with reflection (binary.Write / binary.Read) field by field, the way they were before
+// page_codec.go, to check the codec against
+func binary_page_fields(page any) []any {
+	var padding_at_end int
+	var fields []any
+	switch page := page.(type) {
+	case *FileHeaderPage:
+		layout, _ := layout_for_page_size(int(page.Page_size))
+		fields = []any{&page.Identification_num, &page.Page_type, &page.Checksum, &page.Sequence_num, &page.Total_pages, &page.Total_data_size, &page.Root_node_id, &page.Tree_mode, &page.Space_table_size, &page.Free_space_table, &page.Page_size, &page.Freelist_head, &page.Freelist_size, &page.Inline_value_size, &page.Min_fill, &page.Fill_factor, &page.Lazy_rebalance}
+		padding_at_end = layout.page_size - (file_header_table_offset + num_free_space_entries_file_header*(4+2) + 4 + 4 + 4 + 1 + 1 + 1 + 1)
+	case *NodePage:
+		layout := layout_of_page(page)
+		fields = []any{&page.Identification_num, &page.Page_type, &page.Checksum, &page.Data_page_id, &page.Block_size, &page.Right_link, &page.High_key, &page.Left_link, &page.Keys_only, &page.Inline_size, make([]byte, node_page_header_size-(4+1+4+4+2+4+4+4+1+1)), page.Blocks, page.Children}
+		padding_at_end = layout.page_size - (node_page_header_size + len(page.Blocks)*8 + len(page.Children)*4)
+	case *DataPage:
+		layout := layout_of_page(page)
+		fields = []any{&page.Identification_num, &page.Page_type, &page.Checksum, &page.Data_held, &page.Next_data_page, &page.Parent_node_page, &page.Num_slots, page.Slots, make([]byte, layout.data_page_header_size-(data_page_slots_offset+len(page.Slots)*4)), page.Data}
+	}
+	return append(fields, make([]byte, padding_at_end))
+}
+
+func layout_of_page(page any) *page_layout {
+	for _, layout := range page_layouts {
+		switch page := page.(type) {
+		case *NodePage:
+			if layout.max_degree == len(page.Blocks) {
+				return layout
+			}
+		case *DataPage:
+			if layout.max_data_size == len(page.Data) {
+				return layout
+			}
+		}
+	}
+	return nil
+}
+
+func binary_write_page(page any) []byte {
+	buf := new(bytes.Buffer)
+	for _, field := range binary_page_fields(page) {
+		binary.Write(buf, NativeEndian, field)
+	}
+	return buf.Bytes()
+}
+
+func binary_read_page(b []byte, page any) {
+	buf := bytes.NewReader(b)
+	for _, field := range binary_page_fields(page) {
+		binary.Read(buf, NativeEndian, field)
+	}
+}
+
+func random_pages(rng *rand.Rand, layout *page_layout) (*FileHeaderPage, *NodePage, *DataPage) {
+	// Every field filled with random bytes
+	fp := &FileHeaderPage{Identification_num: rng.Uint32(), Page_type: uint8(rng.Uint32()), Checksum: rng.Uint32(), Sequence_num: rng.Uint64(), Total_pages: rng.Uint32(), Total_data_size: rng.Uint64(), Root_node_id: rng.Uint32(), Tree_mode: uint8(rng.Uint32()), Space_table_size: uint16(rng.Uint32()), Page_size: uint32(layout.page_size), Freelist_head: rng.Uint32(), Freelist_size: rng.Uint32(), Inline_value_size: uint8(rng.Uint32()), Min_fill: uint8(rng.Uint32()), Fill_factor: uint8(rng.Uint32()), Lazy_rebalance: uint8(rng.Uint32())}
+	for i := range fp.Free_space_table {
+		fp.Free_space_table[i] = free_space_table_row{Page_id: rng.Uint32(), Num_pages: uint16(rng.Uint32())}
+	}
+	np := new_node_page(layout, 0)
+	np.Identification_num, np.Page_type, np.Checksum, np.Data_page_id, np.Block_size, np.Right_link, np.High_key, np.Left_link = rng.Uint32(), uint8(rng.Uint32()), rng.Uint32(), rng.Uint32(), uint16(rng.Uint32()), rng.Uint32(), rng.Uint32(), rng.Uint32() // Keys_only and Inline_size stay 0, they change the layout
+	for i := range np.Blocks {
+		np.Blocks[i] = node_page_cell_offet{Key: rng.Uint32(), Offset: rng.Uint32()}
+	}
+	for i := range np.Children {
+		np.Children[i] = rng.Uint32()
+	}
+	dp := new_data_page(layout)
+	dp.Identification_num, dp.Page_type, dp.Checksum, dp.Data_held, dp.Next_data_page, dp.Parent_node_page, dp.Num_slots = rng.Uint32(), uint8(rng.Uint32()), rng.Uint32(), uint16(rng.Uint32()), rng.Uint32(), rng.Uint32(), uint16(rng.Uint32())
+	for i := range dp.Slots {
+		dp.Slots[i] = data_page_slot{Offset: uint16(rng.Uint32()), Length: uint16(rng.Uint32())}
+	}
+	rng.Read(dp.Data)
+	return fp, np, dp
+}
+
+func TestCodecMatchesBinary(t *testing.T) {
+	// The hand written codec gives the same bytes as binary.Write, and decodes them back, on random pages of every type
+	// and page size
+
+	rng := rand.New(rand.NewSource(1))
+	for _, page_size := range Page_sizes {
+		layout := page_layouts[page_size]
+		for round := 0; round < 100; round++ {
+			fp, np, dp := random_pages(rng, layout)
+
+			for _, page := range []any{fp, np, dp} {
+				want := binary_write_page(page)
+				got := Data_to_Bytes(page)
+				if len(got) != page_size || !bytes.Equal(want, got) {
+					t.Fatalf("the page codec encoded a %T of a %vB page differently from binary.Write", page, page_size)
+				}
+			}
+
+			var fp2 FileHeaderPage
+			var np2 NodePage
+			var dp2 DataPage
+			decode_file_header_page(Data_to_Bytes(fp), &fp2)
+			decode_node_page(Data_to_Bytes(np), &np2, layout)
+			decode_data_page(Data_to_Bytes(dp), &dp2, layout)
+			if fp2 != *fp || !bytes.Equal(Data_to_Bytes(&np2), Data_to_Bytes(np)) || !bytes.Equal(Data_to_Bytes(&dp2), Data_to_Bytes(dp)) {
+				t.Fatalf("the page codec didn't decode the %vB pages back to what they were", page_size)
+			}
+		}
+	}
+}
+
+// Every benchmark runs binary.Write / binary.Read and the codec side by side, `go test -bench Page -benchmem`
+
+func bench_both(b *testing.B, reflect func(), codec func()) {
+	for _, way := range []struct {
+		name string
+		f    func()
+	}{{"binary", reflect}, {"codec", codec}} {
+		b.Run(way.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				way.f()
+			}
+		})
+	}
+}
+
+func bench_pages() (*page_layout, *FileHeaderPage, *NodePage, *DataPage) {
+	layout := page_layouts[DEFAULT_PAGESIZE]
+	fp, np, dp := random_pages(rand.New(rand.NewSource(1)), layout)
+	return layout, fp, np, dp
+}
+
+func BenchmarkEncodeNodePage(b *testing.B) {
+	_, _, np, _ := bench_pages()
+	bench_both(b, func() { binary_write_page(np) }, func() { Data_to_Bytes(np) })
+}
+
+func BenchmarkDecodeNodePage(b *testing.B) {
+	layout, _, np, _ := bench_pages()
+	buf := Data_to_Bytes(np)
+	bench_both(b, func() { binary_read_page(buf, new_node_page(layout, 0)) }, func() { var np2 NodePage; decode_node_page(buf, &np2, layout) })
+}
+
+func BenchmarkEncodeDataPage(b *testing.B) {
+	_, _, _, dp := bench_pages()
+	bench_both(b, func() { binary_write_page(dp) }, func() { Data_to_Bytes(dp) })
+}
+
+func BenchmarkDecodeDataPage(b *testing.B) {
+	layout, _, _, dp := bench_pages()
+	buf := Data_to_Bytes(dp)
+	bench_both(b, func() { binary_read_page(buf, new_data_page(layout)) }, func() { var dp2 DataPage; decode_data_page(buf, &dp2, layout) })
+}
+
+func BenchmarkEncodeFileHeaderPage(b *testing.B) {
+	_, fp, _, _ := bench_pages()
+	bench_both(b, func() { binary_write_page(fp) }, func() { Data_to_Bytes(fp) })
+}
+
+func BenchmarkDecodeFileHeaderPage(b *testing.B) {
+	_, fp, _, _ := bench_pages()
+	buf := Data_to_Bytes(fp)
+	bench_both(b, func() { binary_read_page(buf, &FileHeaderPage{Page_size: fp.Page_size}) }, func() { var fp2 FileHeaderPage; decode_file_header_page(buf, &fp2) })
+}
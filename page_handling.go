@@ -1,61 +1,63 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
-	"os"
 	"sort"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
 // Easy Visual Way to see what is there in the DB
-func VisualizeDB(file *os.File) error {
+func VisualizeDB(file *DBFile) error {
+	file.lock.Lock()
+	defer file.lock.Unlock()
 
-	file_stats, err := file.Stat()
+	file_size, err := db_file_size(file)
 	if err != nil {
-		return errors.Wrap(err, "coudnt get the file stats")
+		return err
 	}
-	if file_stats.Size()%PAGESIZE != 0 {
-		return errors.New(fmt.Sprintf("DB size does not satisfy the implicit assumption of being multiple of 4096 bytes. This could mean that one of the pages being saved in the DB exceed or subceed the PAGESIZE (=%dB). This is should be fixed right away, as without this the DB will fail catastrophically", PAGESIZE))
+	page_size := int64(file.layout.page_size)
+	if file_size%page_size != 0 {
+		return errors.New(fmt.Sprintf("DB size does not satisfy the implicit assumption of being multiple of the page size. This could mean that one of the pages being saved in the DB exceed or subceed the page size (=%dB). This is should be fixed right away, as without this the DB will fail catastrophically", page_size))
 	}
-	num_pages_in_db := uint32(file_stats.Size() / PAGESIZE)
+	num_pages_in_db := uint32(file_size / page_size)
 
 	var buf []byte
-	var buf_reader *bytes.Reader
 	var read_page Page
 	var fp FileHeaderPage
 	var np NodePage
 	var dp DataPage
+	var flp FreelistPage
 	var i uint32
 
-	fmt.Printf("\nThe file is %d B = %d * 4kB long\n[REF] %v * %v = %v\n", file_stats.Size(), file_stats.Size()/PAGESIZE, file_stats.Size()/PAGESIZE, PAGESIZE, (file_stats.Size()/PAGESIZE)*PAGESIZE)
+	fmt.Printf("\nThe file is %d B = %d * %dB long\n[REF] %v * %v = %v\n", file_size, file_size/page_size, page_size, file_size/page_size, page_size, (file_size/page_size)*page_size)
 	for i = 0; i < num_pages_in_db; i++ {
 		buf, err = ReadChunk(file, i)
 		if err != nil {
 			return errors.Wrap(err, "error in reading page while trying to visualize the db")
 		}
-		buf_reader = bytes.NewReader(buf)
-		binary.Read(buf_reader, NativeEndian, &read_page)
+		read_page.Identification_num, read_page.Page_type = decode_page_start(buf)
 
 		if read_page.Identification_num != PAGE_IDENTITY_NUM {
 			fmt.Printf("%d. Free\n", i)
 		} else {
-			buf_reader.Reset(buf)
-
 			if read_page.Page_type == Page_type_ids["FileHeader"] {
-				binary.Read(buf_reader, NativeEndian, &fp)
+				decode_file_header_page(buf, &fp)
 				fmt.Printf("%d. File Header\n", i)
 
 			} else if read_page.Page_type == Page_type_ids["Node"] {
-				binary.Read(buf_reader, NativeEndian, &np)
+				decode_node_page(buf, &np, file.layout)
 				fmt.Printf("%d. Node -> [data] %v\n", i, np.Data_page_id)
 
 			} else if read_page.Page_type == Page_type_ids["Data"] {
-				binary.Read(buf_reader, NativeEndian, &dp)
+				decode_data_page(buf, &dp, file.layout)
 				fmt.Printf("%d. Data [%v] -> [next] %v\n", i, dp.Parent_node_page, dp.Next_data_page)
 
+			} else if read_page.Page_type == Page_type_ids["Freelist"] {
+				decode_freelist_page(buf, &flp, file.layout)
+				fmt.Printf("%d. Freelist (%v free pages) -> [next] %v\n", i, flp.Num_entries, flp.Next_freelist_page)
+
 			} else {
 				fmt.Printf("%d. Free\n", i)
 			}
@@ -64,97 +66,346 @@ func VisualizeDB(file *os.File) error {
 	return nil
 }
 
-func Create_and_ConnectDB(db_name string) (*os.File, *FileHeaderPage, error) {
+type ConnectOptions struct {
+	Lock_timeout time.Duration // How long to wait for other processes to let go of the db file before giving up with ErrDatabaseLocked
+	Read_only    bool          // Open the file with O_RDONLY and share it with other readers, every mutating call fails with ErrReadOnly
+	Tree_mode    uint8         // One of Tree_mode_ids, only used while creating a db (an existing db keeps the mode it was created with)
+	Page_size    int           // One of Page_sizes (0 for the default 4kB), only used while creating a db in a file like Tree_mode
+
+	Buffer_pool_bytes  int   // Memory budget of the page cache (see buffer_pool.go), 0 turns it off and every page access goes to the file
+	Eviction_policy    uint8 // One of Eviction_policy_ids
+	Pin_internal_nodes bool  // Never evict internal NodePages from the page cache
+	Use_mmap           bool  // Read the file through a read-only memory mapping instead of read calls (see mmap.go), only for the file store
+
+	Compaction_rate int  // Pages per second moved down by the background compaction of the db file (see compaction.go), 0 turns it off
+	Compress_values bool // Compress new values with flate when that makes them smaller (see value_compression.go), they are read back either way
+
+	Min_fill       int  // Percent of a node's keys below which Delete rebalances it (0 for the default 50, see btree_fill.go). Only used while creating a db like the two below, it is kept in the db
+	Fill_factor    int  // Percent of a node's keys kept when appending to the rightmost node splits it (0 for the default 100)
+	Lazy_rebalance bool // Leave nodes underfull and only rebalance them once they are empty
+
+	Inline_value_size int // Values of up to this many bytes are kept right in their node cell, without a DataPage (0 turns it off, at most max_inline_value_size). Only used while creating a db, every cell of a node takes up this much more room
+}
+
+var Default_connect_options = ConnectOptions{
+	Lock_timeout:      5 * time.Second,
+	Buffer_pool_bytes: Default_buffer_pool_bytes,
+}
+
+func Create_and_ConnectDB(db_name string) (*DBFile, *FileHeaderPage, error) {
+	return Create_and_ConnectDB_with_options(db_name, Default_connect_options)
+}
+
+func Create_and_ConnectDB_with_options(db_name string, options ConnectOptions) (*DBFile, *FileHeaderPage, error) {
 
-	file, err := os.OpenFile("./databases/"+db_name+".db", os.O_CREATE|os.O_RDWR, 0644)
+	// Checked before the file is made, so that a bad call doesn't leave an empty file behind
+	err := check_create_options(options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	store, err := Open_file_page_store(db_file_path(db_name), true, options)
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "error while creating the database file")
 	}
+	return Create_and_ConnectDB_with_store(store, options)
+}
+
+func Create_and_ConnectDB_with_store(store PageStore, options ConnectOptions) (*DBFile, *FileHeaderPage, error) {
+	// Makes a new db in `store`, which is closed if this fails
+
+	err := check_create_options(options)
+	if err != nil {
+		store.Close()
+		return nil, nil, err
+	}
+
+	// The page size is the store's
+	layout, err := layout_for_page_size(store.Page_size())
+	if err == nil && options.Page_size != 0 && options.Page_size != layout.page_size {
+		err = errors.New(fmt.Sprintf("asked for a page size of %v but the store is made for %v", options.Page_size, layout.page_size))
+	}
+	if err != nil {
+		store.Close()
+		return nil, nil, err
+	}
+
+	fill, _ := fill_policy_for_options(options) // Already checked along with the rest of the options
+	file := &DBFile{store: store, layout: layout, compress_values: options.Compress_values, fill: fill}
+	err = open_page_io(file, options)
+	if err != nil {
+		store.Close()
+		return nil, nil, err
+	}
 
 	file_header := FileHeaderPage{
 		Identification_num: PAGE_IDENTITY_NUM,
 		Page_type:          Page_type_ids["FileHeader"],
-		Total_pages:        1,
+		Total_pages:        num_file_header_slots,
+		Tree_mode:          options.Tree_mode,
+		Page_size:          uint32(layout.page_size),
+		Inline_value_size:  uint8(options.Inline_value_size),
+	}
+	fill.save_in_header(&file_header)
+	// Both the slots get a copy, so that the second slot is valid even before the first flush
+	for i := uint32(0); i < num_file_header_slots; i++ {
+		err = WriteChunk(file, i, Data_to_Bytes(file_header))
+		if err != nil {
+			store.Close()
+			return nil, nil, errors.Wrap(err, fmt.Sprintf("error while writing the file header to slot %v", i))
+		}
 	}
-	buf := Data_to_Bytes(file_header)
-	WriteChunk(file, 0, buf)
 
+	start_compaction(options.Compaction_rate, &file_header, file)
 	return file, &file_header, nil
 }
 
-func ConnectDB(db_name string) (*os.File, *FileHeaderPage, error) {
+func check_create_options(options ConnectOptions) error {
+	if options.Read_only {
+		return errors.Wrap(ErrReadOnly, "cannot create a new database in read-only mode")
+	}
+	if options.Tree_mode != Tree_mode_ids["BTree"] && options.Tree_mode != Tree_mode_ids["BLink"] && options.Tree_mode != Tree_mode_ids["BPlus"] {
+		return errors.New(fmt.Sprintf("unknown tree mode %v", options.Tree_mode))
+	}
+	if options.Inline_value_size < 0 || options.Inline_value_size > max_inline_value_size {
+		return errors.New(fmt.Sprintf("the inline value size has to be from 0 to %v, not %v", max_inline_value_size, options.Inline_value_size))
+	}
+	_, err := fill_policy_for_options(options)
+	return err
+}
+
+func db_file_path(db_name string) string {
+	return "./databases/" + db_name + ".db"
+}
 
-	file, err := os.OpenFile("./databases/"+db_name+".db", os.O_RDWR, 0644)
+func open_page_io(file *DBFile, options ConnectOptions) error {
+	// The buffer pool, if it is asked for
+
+	if options.Buffer_pool_bytes == 0 {
+		return nil
+	}
+	pool, err := new_buffer_pool(options.Buffer_pool_bytes, options.Eviction_policy, options.Pin_internal_nodes, file)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "error while creating the database file")
+		return errors.Wrap(err, "error while making the buffer pool")
 	}
+	file.pool = pool
+	return nil
+}
+
+func read_file_header_slot(slot uint32, file *DBFile) (*FileHeaderPage, error) {
 
-	buf, err := ReadChunk(file, 0)
+	buf, err := ReadChunk(file, slot)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "error while reading file header")
+		return nil, errors.Wrap(err, fmt.Sprintf("error while reading file header slot %v", slot))
 	}
-	buf_reader := bytes.NewReader(buf)
 	var file_header FileHeaderPage
-	binary.Read(buf_reader, NativeEndian, &file_header)
+	decode_file_header_page(buf, &file_header)
 	if file_header.Identification_num != PAGE_IDENTITY_NUM {
-		return nil, nil, errors.New(fmt.Sprintf("the file header which was read doesn't have page identification number right, the page_ident_num in the age found = %d", file_header.Identification_num))
+		return nil, errors.New(fmt.Sprintf("the file header which was read doesn't have page identification number right, the page_ident_num in the age found = %d", file_header.Identification_num))
 	}
 	if file_header.Page_type != Page_type_ids["FileHeader"] {
-		return nil, nil, errors.New(fmt.Sprintf("page read doesnt have a valid type id, found id = %d, expected to be %d (FileHeader)", file_header.Page_type, Page_type_ids["FileHeader"]))
+		return nil, errors.New(fmt.Sprintf("page read doesnt have a valid type id, found id = %d, expected to be %d (FileHeader)", file_header.Page_type, Page_type_ids["FileHeader"]))
+	}
+	err = verify_page_checksum(slot, buf, file.layout.page_size)
+	if err != nil {
+		return nil, err
 	}
 
-	return file, &file_header, nil
+	return &file_header, nil
+}
+
+func save_file_header(file_header *FileHeaderPage, file *DBFile) error {
+
+	// The newest copy sits in slot (Sequence_num % num_file_header_slots), so bumping the number lands on the older slot
+	file_header.Sequence_num += 1
+	slot := uint32(file_header.Sequence_num % num_file_header_slots)
+
+	err := WriteChunk(file, slot, Data_to_Bytes(file_header))
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("error while trying to save file_header to slot %v of the db file", slot))
+	}
+	return nil
+}
+
+func ConnectDB(db_name string) (*DBFile, *FileHeaderPage, error) {
+	return ConnectDB_with_options(db_name, Default_connect_options)
+}
+
+func ConnectDB_with_options(db_name string, options ConnectOptions) (*DBFile, *FileHeaderPage, error) {
+
+	store, err := Open_file_page_store(db_file_path(db_name), false, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ConnectDB_with_store(store, options)
+}
+
+func ConnectDB_with_store(store PageStore, options ConnectOptions) (*DBFile, *FileHeaderPage, error) {
+	// Connects to the db already in `store`, which is closed if this fails
+
+	layout, err := layout_for_page_size(store.Page_size())
+	if err != nil {
+		store.Close()
+		return nil, nil, err
+	}
+	file := &DBFile{store: store, layout: layout, Read_only: options.Read_only, compress_values: options.Compress_values}
+	err = open_page_io(file, options)
+	if err != nil {
+		store.Close()
+		return nil, nil, err
+	}
+
+	// Pick the newest copy of the file header which still validates
+	var file_header *FileHeaderPage
+	var slot_err error
+	for i := uint32(0); i < num_file_header_slots; i++ {
+		temp, err := read_file_header_slot(i, file)
+		if err != nil {
+			slot_err = err
+			continue
+		}
+		if file_header == nil || temp.Sequence_num > file_header.Sequence_num {
+			file_header = temp
+		}
+	}
+	if file_header == nil {
+		store.Close()
+		return nil, nil, errors.Wrap(slot_err, "none of the file header copies in the db file are valid")
+	}
+	header_layout, err := layout_for_page_size(int(file_header.Page_size))
+	if err == nil && header_layout != layout {
+		err = errors.New(fmt.Sprintf("the db has a page size of %v but the store is made for %v", header_layout.page_size, layout.page_size))
+	}
+	if err == nil {
+		file.fill, err = fill_policy_for_header(file_header)
+	}
+	if err != nil {
+		store.Close()
+		return nil, nil, err
+	}
+
+	start_compaction(options.Compaction_rate, file_header, file)
+	return file, file_header, nil
 }
 
-func ReadPage(file *os.File, page_id uint32) (uint8, *FileHeaderPage, *NodePage, *DataPage, error) {
+func ReadPage(file *DBFile, page_id uint32) (uint8, *FileHeaderPage, *NodePage, *DataPage, error) {
+
+	if file.pool != nil {
+		// Decoded pages are cached in the pool
+		return file.pool.read_page(page_id, file)
+	}
 
 	buf, err := ReadChunk(file, page_id)
 	if err != nil {
 		return 0, nil, nil, nil, errors.Wrap(err, fmt.Sprintf("error while trying to read %v page from file", page_id))
 	}
-	buf_reader := bytes.NewReader(buf)
+	return decode_page(page_id, buf, file.layout)
+}
+
+func decode_page(page_id uint32, buf []byte, layout *page_layout) (uint8, *FileHeaderPage, *NodePage, *DataPage, error) {
+
 	var temp Page
-	binary.Read(buf_reader, NativeEndian, &temp)
+	temp.Identification_num, temp.Page_type = decode_page_start(buf)
 
 	if temp.Identification_num != PAGE_IDENTITY_NUM {
 		return Page_type_ids["Free"], nil, nil, nil, nil
 		// return 0, nil, nil, nil, errors.New(fmt.Sprintf("read random bytes instead of the page while trying to read page_id = %v. read ident_num = 0x%X", page_id, temp.Identification_num))
 	}
-
-	buf_reader.Reset(buf)
+	err := verify_page_checksum(page_id, buf, layout.page_size)
+	if err != nil {
+		return 0, nil, nil, nil, err
+	}
 
 	if temp.Page_type == Page_type_ids["FileHeader"] {
 		var temp2 FileHeaderPage
-		binary.Read(buf_reader, NativeEndian, &temp2)
+		decode_file_header_page(buf, &temp2)
 		return Page_type_ids["FileHeader"], &temp2, nil, nil, nil
 
 	} else if temp.Page_type == Page_type_ids["Node"] {
 		var temp2 NodePage
-		binary.Read(buf_reader, NativeEndian, &temp2)
+		decode_node_page(buf, &temp2, layout)
 		return Page_type_ids["Node"], nil, &temp2, nil, nil
 
 	} else if temp.Page_type == Page_type_ids["Data"] {
 		var temp2 DataPage
-		binary.Read(buf_reader, NativeEndian, &temp2)
+		decode_data_page(buf, &temp2, layout)
 		return Page_type_ids["Data"], nil, nil, &temp2, nil
 
 	}
 	return 0, nil, nil, nil, nil
 }
 
-func DisconnectDB(file *os.File, file_header *FileHeaderPage) {
+func DisconnectDB(file *DBFile, file_header *FileHeaderPage) {
+	stop_compaction(file)
 
-	err := WriteChunk(file, 0, Data_to_Bytes(file_header))
-	if err != nil {
-		fmt.Printf("error while trying to save file_header to the db file: \n%+v\n", err)
-		return
+	// Wait for everyone else using the handle to be done with it
+	file.lock.Lock()
+	defer file.lock.Unlock()
+
+	var err error
+	if !file.Read_only {
+		err = write_back_db(file_header, file)
+		if err != nil {
+			// The db file is still closed, so that the lock on it goes away. The File Header left in it is the one of
+			// the last write back, which only points to pages written before it
+			fmt.Printf("error while trying to write the db back to the file: \n%+v\n", err)
+		}
 	}
-	err = file.Close()
+	err = file.store.Close()
 	if err != nil {
 		fmt.Printf("error while trying to close the db file:\n%+v\n", err)
 	}
 }
 
+func Commit(file_header *FileHeaderPage, file *DBFile) error {
+	// Makes everything done so far durable: every dirty page in the buffer pool and then the file header go to the disk
+	// Nothing done since the last Commit (or connecting) survives a crash, as the buffer pool only writes pages back
+	// when it runs out of room
+
+	if file.Read_only {
+		return errors.Wrap(ErrReadOnly, "cannot commit")
+	}
+
+	file.lock.Lock()
+	defer file.lock.Unlock()
+
+	return write_back_db(file_header, file)
+}
+
+func write_back_db(file_header *FileHeaderPage, file *DBFile) error {
+	/*
+		The pages go to the disk before the File Header which points to them, with a sync in between, so a new File
+		Header which passes its checksum is only ever found on the disk with all of its pages there as well. A crash in
+		the middle leaves the older File Header (in the other slot) as the newest valid one.
+		That doesn't make the older one safe to go back to: pages are freed and handed out again right away, so pages
+		evicted since the last write back may have already overwritten some of what it points to.
+		Must be called with file.lock held in write mode
+	*/
+
+	err := flush_buffer_pool(false, file)
+	if err != nil {
+		return errors.Wrap(err, "error while trying to flush the buffer pool to the db file")
+	}
+	err = file.store.Sync()
+	if err != nil {
+		return errors.Wrap(err, "error while trying to sync the db file")
+	}
+
+	err = save_file_header(file_header, file)
+	if err != nil {
+		return err
+	}
+	err = flush_buffer_pool(true, file)
+	if err != nil {
+		return errors.Wrap(err, "error while trying to flush the file header to the db file")
+	}
+	err = file.store.Sync()
+	if err != nil {
+		return errors.Wrap(err, "error while trying to sync the db file")
+	}
+	return nil
+}
+
 func overlap_intervals_pages(a, b free_space_table_row) bool {
 	// a and b should be in sorted order
 	if a.Page_id < b.Page_id {
@@ -231,19 +482,24 @@ func SpaceTableFixer(file_header *FileHeaderPage) {
 	file_header.Space_table_size = i
 }
 
-func Trim_db_file(file_header *FileHeaderPage, file *os.File) error {
+// Must be run with file.lock held in write mode (as it is by Compact), since a memory mapped file gets remapped
+func Trim_db_file(file_header *FileHeaderPage, file *DBFile) error {
+
+	if file.Read_only {
+		return errors.Wrap(ErrReadOnly, "cannot trim the db file")
+	}
 
-	file_stats, err := file.Stat()
+	file_size, err := db_file_size(file)
 	if err != nil {
-		return errors.Wrap(err, "coudnt get the file stats")
+		return err
 	}
-	if file_stats.Size()%PAGESIZE != 0 {
-		return errors.New(fmt.Sprintf("DB size does not satisfy the implicit assumption of being multiple of 4096 bytes. This could mean that one of the pages being saved in the DB exceed or subceed the PAGESIZE (=%dB). This is should be fixed right away, as without this the DB will fail catastrophically", PAGESIZE))
+	page_size := int64(file.layout.page_size)
+	if file_size%page_size != 0 {
+		return errors.New(fmt.Sprintf("DB size does not satisfy the implicit assumption of being multiple of the page size. This could mean that one of the pages being saved in the DB exceed or subceed the page size (=%dB). This is should be fixed right away, as without this the DB will fail catastrophically", page_size))
 	}
-	num_pages_in_db := uint32(file_stats.Size() / PAGESIZE)
+	num_pages_in_db := uint32(file_size / page_size)
 
 	var buf []byte
-	var buf_reader *bytes.Reader
 	var read_page Page
 	var i uint32
 	var j uint32
@@ -253,8 +509,7 @@ func Trim_db_file(file_header *FileHeaderPage, file *os.File) error {
 		if err != nil {
 			return errors.Wrap(err, fmt.Sprintf("error in reading page %v while trying to visualize the db", num_pages_in_db-i-1))
 		}
-		buf_reader = bytes.NewReader(buf)
-		binary.Read(buf_reader, NativeEndian, &read_page)
+		read_page.Identification_num, read_page.Page_type = decode_page_start(buf)
 
 		if read_page.Identification_num != PAGE_IDENTITY_NUM {
 			j++
@@ -264,50 +519,47 @@ func Trim_db_file(file_header *FileHeaderPage, file *os.File) error {
 			break
 		} else if read_page.Page_type == Page_type_ids["Data"] {
 			break
+		} else if read_page.Page_type == Page_type_ids["Freelist"] {
+			// Still holding the freelist
+			break
 		} else {
 			j++
 		}
 	}
 
-	err = file.Truncate(int64(num_pages_in_db-j) * PAGESIZE)
+	err = truncate_db_file(file, num_pages_in_db-j)
 	if err != nil {
-		return errors.Wrap(err, fmt.Sprintf("error while trying to truncate the file to size %v from %v", int64(num_pages_in_db-j)*PAGESIZE, file_stats.Size()))
+		return errors.Wrap(err, fmt.Sprintf("error while trying to truncate the file to size %v from %v", int64(num_pages_in_db-j)*page_size, file_size))
 	}
 
 	page_id_to_find := num_pages_in_db - uint32(j)
 
-	// file_header.Free_space_table should most probably be sorted in decreasing order before the execution of this code
-	// And hence this for loop should break at 0th index whenever that is true
-	var changed int = -1
-	for i := 0; i < int(file_header.Space_table_size); i++ {
-		p, k := file_header.Free_space_table[i].Page_id, file_header.Free_space_table[i].Num_pages
-		if page_id_to_find >= p && page_id_to_find < p+uint32(k) {
-			file_header.Free_space_table[i].Num_pages -= uint16(j)
-			changed = i
-			break
-		}
-	}
+	// Some of the cut off pages might be in the freelist as well, they are dropped from it as it is popped (see
+	// freelist.go)
 
-	if changed != -1 {
-		if file_header.Free_space_table[changed].Num_pages == 0 {
-			file_header.Free_space_table[changed].Page_id = 0
-			// Shift all the cells to the left
-			for t := changed; t < int(file_header.Space_table_size)-1; t++ {
-				// file_header.Free_space_table[t].Page_id, file_header.Free_space_table[t].Num_pages = file_header.Free_space_table[t+1].Page_id, file_header.Free_space_table[t+1].Num_pages
-				file_header.Free_space_table[t] = file_header.Free_space_table[t+1]
-			}
-			file_header.Free_space_table[file_header.Space_table_size-1] = free_space_table_row{0, 0}
-			file_header.Space_table_size -= 1
+	// The runs of free pages in the table are cut down to what is left of the file, the cut off pages can be spread
+	// over more than one of them (and the freelist)
+	for i := 0; i < int(file_header.Space_table_size); i++ {
+		row := &file_header.Free_space_table[i]
+		if row.Page_id >= page_id_to_find {
+			*row = free_space_table_row{0, 0}
+		} else if row.Page_id+uint32(row.Num_pages) > page_id_to_find {
+			row.Num_pages = uint16(page_id_to_find - row.Page_id)
 		}
 	}
+	SpaceTableFixer(file_header)
 
 	return nil
 }
 
-func DeletePage(page_id uint32, file_header *FileHeaderPage, file *os.File) error {
+func DeletePage(page_id uint32, file_header *FileHeaderPage, file *DBFile) error {
+
+	if file.Read_only {
+		return errors.Wrap(ErrReadOnly, fmt.Sprintf("cannot delete the page %v", page_id))
+	}
 
-	if page_id == 0 {
-		return errors.New("cannot delete the file header page of the db without deleting the db")
+	if page_id < num_file_header_slots {
+		return errors.New("cannot delete the file header pages of the db without deleting the db")
 	}
 
 	pg_type, _, np, dp, err := ReadPage(file, page_id)
@@ -319,7 +571,7 @@ func DeletePage(page_id uint32, file_header *FileHeaderPage, file *os.File) erro
 		// return errors.New(fmt.Sprintf("read random bytes instead of the page while trying to read page_id = %v", page_id))
 	}
 
-	empty_buffer := Data_to_Bytes(Page{})
+	empty_buffer := make([]byte, file.layout.page_size)
 
 	if pg_type == Page_type_ids["Data"] {
 		// Should I allow deletion of data pages with data inside it? ---- Yes, atleast now, since this function will only be run by approved code
@@ -333,7 +585,6 @@ func DeletePage(page_id uint32, file_header *FileHeaderPage, file *os.File) erro
 			}
 		}
 
-		file_header.Total_data_size -= uint64(dp.Data_held)
 		err = WriteChunk(file, page_id, empty_buffer)
 		if err != nil {
 			return errors.Wrap(err, fmt.Sprintf("error while trying to overwrite the page index = %v", page_id))
@@ -344,9 +595,11 @@ func DeletePage(page_id uint32, file_header *FileHeaderPage, file *os.File) erro
 		// if np.Block_size != 0 {
 		// 	return errors.New(fmt.Sprintf("cannot delete a node page %v with still data inside of it", page_id))
 		// }
-		err = DeletePage(np.Data_page_id, file_header, file)
-		if err != nil {
-			return errors.Wrap(err, fmt.Sprintf("error while trying to delete the data page (%v) associated with the node page at page_id = %v (node)", np.Data_page_id, page_id))
+		if np.Data_page_id != 0 { // Keys only nodes have no DataPages
+			err = DeletePage(np.Data_page_id, file_header, file)
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("error while trying to delete the data page (%v) associated with the node page at page_id = %v (node)", np.Data_page_id, page_id))
+			}
 		}
 
 		err = WriteChunk(file, page_id, empty_buffer)
@@ -361,11 +614,18 @@ func DeletePage(page_id uint32, file_header *FileHeaderPage, file *os.File) erro
 		return nil
 	}
 
+	// The page is already wiped, so it can be handed out again as soon as it is in the free space table
+	file.alloc_lock.Lock()
+	defer file.alloc_lock.Unlock()
+
 	file_header.Total_pages -= 1
 
 	if file_header.Space_table_size == num_free_space_entries_file_header {
-		// the Free Space table is full -> So, defragment the whole db_file to make a fresh start
-		defragment_db_file(file_header, file)
+		// the Free Space table is full -> So, the page goes to the freelist (see freelist.go)
+		err = push_to_freelist(page_id, file_header, file)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("error while trying to put the deleted page %v in the freelist", page_id))
+		}
 
 	} else if file_header.Space_table_size != 0 {
 		i := file_header.Space_table_size
@@ -383,7 +643,7 @@ func DeletePage(page_id uint32, file_header *FileHeaderPage, file *os.File) erro
 	return nil
 }
 
-func put_nodeId_to_data_page(node_page_id uint32, data_page_id uint32, file *os.File) error {
+func put_nodeId_to_data_page(node_page_id uint32, data_page_id uint32, file *DBFile) error {
 
 	pt, _, _, dp, err := ReadPage(file, data_page_id)
 	if err != nil {
@@ -409,7 +669,11 @@ func put_nodeId_to_data_page(node_page_id uint32, data_page_id uint32, file *os.
 	return nil
 }
 
-func MakeNewPage(page_type uint8, file_header *FileHeaderPage, file *os.File) (uint32, error) {
+func MakeNewPage(page_type uint8, file_header *FileHeaderPage, file *DBFile) (uint32, error) {
+
+	if file.Read_only {
+		return 0, errors.Wrap(ErrReadOnly, "cannot make a new page")
+	}
 
 	if page_type == Page_type_ids["FileHeader"] {
 		return 0, errors.New("invalid request! cannot make another file header inside an existing db file")
@@ -424,48 +688,23 @@ func MakeNewPage(page_type uint8, file_header *FileHeaderPage, file *os.File) (u
 		if err != nil {
 			return 0, errors.Wrap(err, "could not make the data page for the node page")
 		}
-		temp := NodePage{
-			Identification_num: PAGE_IDENTITY_NUM,
-			Page_type:          Page_type_ids["Node"],
-			Data_page_id:       data_page_id,
-		}
+		temp := new_node_page(file.layout, int(file_header.Inline_value_size))
+		temp.Identification_num = PAGE_IDENTITY_NUM
+		temp.Page_type = Page_type_ids["Node"]
+		temp.Data_page_id = data_page_id
 		buf = Data_to_Bytes(temp)
 
 	} else if page_type == Page_type_ids["Data"] {
-		temp := DataPage{
-			Identification_num: PAGE_IDENTITY_NUM,
-			Page_type:          Page_type_ids["Data"],
-			Space_table_size:   1,
-		}
-		temp.Unallocated_space_table[0] = data_page_unallocated_space_table_row{
-			Offset: 0,
-			Size:   uint16(len(temp.Data)),
-		}
+		temp := new_data_page(file.layout)
+		temp.Identification_num = PAGE_IDENTITY_NUM
+		temp.Page_type = Page_type_ids["Data"]
 		buf = Data_to_Bytes(temp)
 
 	} else {
 		return 0, errors.New(fmt.Sprintf("invalid input! recieved request to make a page of unknown type = %v", page_type))
 	}
 
-	var page_id uint32
-
-	if file_header.Space_table_size != 0 {
-
-		i := file_header.Space_table_size - 1
-		page_id = file_header.Free_space_table[i].Page_id
-		file_header.Free_space_table[i].Num_pages -= 1
-		file_header.Free_space_table[i].Page_id += 1
-
-		if file_header.Free_space_table[i].Num_pages == 0 {
-			file_header.Free_space_table[i].Page_id = 0
-			file_header.Space_table_size -= 1
-		}
-
-	} else {
-		page_id = file_header.Total_pages
-	}
-
-	err = WriteChunk(file, page_id, buf)
+	page_id, err := write_new_page(buf, file_header, file)
 	if err != nil {
 		if page_type == Page_type_ids["Node"] {
 			err = DeletePage(data_page_id, file_header, file)
@@ -475,7 +714,6 @@ func MakeNewPage(page_type uint8, file_header *FileHeaderPage, file *os.File) (u
 		}
 		return 0, errors.Wrap(err, fmt.Sprintf("error while writing to page index = %v", page_id))
 	}
-	file_header.Total_pages += 1
 
 	if page_type == Page_type_ids["Node"] {
 		// The node page has the data page id but the data page id doesn't
@@ -489,121 +727,92 @@ func MakeNewPage(page_type uint8, file_header *FileHeaderPage, file *os.File) (u
 	return page_id, nil
 }
 
-func defragment_db_file(file_header *FileHeaderPage, file *os.File) error {
+func write_new_page(buf []byte, file_header *FileHeaderPage, file *DBFile) (uint32, error) {
 
-	changes_record := make(map[uint32]uint32)
+	// The page id is handed out and the page is written under the same lock, so that no one else can get the same id
+	file.alloc_lock.Lock()
+	defer file.alloc_lock.Unlock()
 
-	file_stats, err := file.Stat()
+	page_id, err := take_free_page_id(file_header, file)
 	if err != nil {
-		return err
+		return page_id, err
+	}
+	err = WriteChunk(file, page_id, buf)
+	if err != nil {
+		return page_id, err
 	}
-	num_pages := file_stats.Size() / PAGESIZE
+	file_header.Total_pages += 1
+	return page_id, nil
+}
 
-	empty_page := Page{}
+func take_free_page_id(file_header *FileHeaderPage, file *DBFile) (uint32, error) {
+	// The lowest run in the Free Space table first, then the freelist, then the end of the file
+	// Must be called with file.alloc_lock held, Total_pages is left for the caller to count the page in
 
-	// Defragment- Move the pages from non-empty to empty and concentrate them
-	j := 1
-	k := 1
-	for j < int(num_pages) && k < int(num_pages) {
-		pt, fp, np, dp, err := ReadPage(file, uint32(k))
-		if err != nil {
-			return err
-		}
+	if file_header.Space_table_size != 0 {
 
-		if pt == Page_type_ids["Node"] || pt == Page_type_ids["Data"] || pt == Page_type_ids["FileHeader"] {
-			// Filled Page needs to be moved to j_th position (Free Page)
-			if j == k {
-				j++
-				k++
-				continue
-			}
+		i := file_header.Space_table_size - 1
+		page_id := file_header.Free_space_table[i].Page_id
+		file_header.Free_space_table[i].Num_pages -= 1
+		file_header.Free_space_table[i].Page_id += 1
 
-			changes_record[uint32(k)] = uint32(j)
-			if pt == Page_type_ids["Node"] {
-				err = WriteChunk(file, uint32(j), Data_to_Bytes(np))
-				if err != nil {
-					return err
-				}
-			}
-			if pt == Page_type_ids["Data"] {
-				err = WriteChunk(file, uint32(j), Data_to_Bytes(dp))
-				if err != nil {
-					return err
-				}
-			}
-			if pt == Page_type_ids["FileHeader"] {
-				err = WriteChunk(file, uint32(j), Data_to_Bytes(fp))
-				if err != nil {
-					return err
-				}
-			}
-			err = WriteChunk(file, uint32(k), Data_to_Bytes(empty_page))
-			if err != nil {
-				return err
-			}
-			j++
-			k++
-			continue
+		if file_header.Free_space_table[i].Num_pages == 0 {
+			file_header.Free_space_table[i].Page_id = 0
+			file_header.Space_table_size -= 1
 		}
-		// This is a free page, increment k for all such free pages
-		k++
+		return page_id, nil
 	}
 
-	// Change the file_header
-	if val, ok := changes_record[file_header.Root_node_id]; ok {
-		file_header.Root_node_id = val
+	page_id, found, err := pop_from_freelist(file_header, file)
+	if err != nil {
+		return 0, err
 	}
-	for i := 0; i < int(file_header.Space_table_size); i++ {
-		file_header.Free_space_table[i] = free_space_table_row{0, 0}
+	if !found {
+		// No free pages anywhere, so every page in the file is in use and the new one goes at the end
+		page_id = file_header.Total_pages
 	}
-	file_header.Space_table_size = 0
+	return page_id, nil
+}
 
-	// Relay the changes in the page ids to every individual page
-	for i := 1; i < int(num_pages); i++ {
-		pt, _, np, dp, err := ReadPage(file, uint32(i))
-		if err != nil {
-			return err
-		}
+func db_file_size(file *DBFile) (int64, error) {
 
-		if pt == Page_type_ids["Node"] {
-			if val, ok := changes_record[np.Data_page_id]; ok {
-				np.Data_page_id = val
-			}
-			for j := 0; j < int(np.Block_size)+1; j++ {
-				if val, ok := changes_record[np.Children[j]]; ok {
-					np.Children[j] = val
-				}
-			}
-			err = WriteChunk(file, uint32(i), Data_to_Bytes(np))
-			if err != nil {
-				return err
-			}
-		}
-		if pt == Page_type_ids["Data"] {
-			if val, ok := changes_record[dp.Next_data_page]; ok {
-				dp.Next_data_page = val
-			}
-			if val, ok := changes_record[dp.Parent_node_page]; ok {
-				dp.Parent_node_page = val
-			}
-			err = WriteChunk(file, uint32(i), Data_to_Bytes(dp))
-			if err != nil {
-				return err
-			}
-		}
+	// Pages which are only in the buffer pool so far count as well
+	if file.pool != nil {
+		file.pool.lock.Lock()
+		defer file.pool.lock.Unlock()
+		return int64(file.pool.num_pages) * int64(file.layout.page_size), nil
 	}
+	return file.store.Size()
+}
 
-	// Fix the database file
-	SpaceTableFixer(file_header)
-	err = Trim_db_file(file_header, file)
+func num_pages_in_db_file(file *DBFile) (uint32, error) {
+
+	file_size, err := db_file_size(file)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	return uint32(file_size / int64(file.layout.page_size)), nil
+}
 
-	return Trim_db_file(file_header, file)
+func truncate_db_file(file *DBFile, num_pages uint32) error {
+	if file.pool != nil {
+		return file.pool.truncate(num_pages, file)
+	}
+	return file.store.Truncate(num_pages)
+}
+
+func add_to_total_data_size(delta int64, file_header *FileHeaderPage, file *DBFile) {
+	file.alloc_lock.Lock()
+	defer file.alloc_lock.Unlock()
+
+	file_header.Total_data_size = uint64(int64(file_header.Total_data_size) + delta)
 }
 
-func SavePage(page_id uint32, page_data []byte, file_header *FileHeaderPage, file *os.File) error {
+func SavePage(page_id uint32, page_data []byte, file_header *FileHeaderPage, file *DBFile) error {
+
+	if file.Read_only {
+		return errors.Wrap(ErrReadOnly, fmt.Sprintf("cannot save the page %v", page_id))
+	}
 
 	err := WriteChunk(file, page_id, page_data)
 	if err != nil {
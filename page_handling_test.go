@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func create_test_db(t *testing.T, db_name string) {
+	// A db file with a few keys in it, removed once the test is done
+	t.Helper()
+	err := os.MkdirAll("./databases", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(db_file_path(db_name)) })
+	file, file_header, err := Create_and_ConnectDB(db_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := uint32(0); key < 100; key++ {
+		err = Insert(key, []byte("some value"), file_header, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	DisconnectDB(file, file_header)
+}
+
+func header_slots(t *testing.T, store PageStore) [num_file_header_slots]FileHeaderPage {
+	t.Helper()
+	var slots [num_file_header_slots]FileHeaderPage
+	for i := range slots {
+		buf, err := store.Read_page(uint32(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decode_file_header_page(buf, &slots[i])
+	}
+	return slots
+}
+
+func TestFileHeaderSlots(t *testing.T) {
+	store, _ := New_memory_page_store(DEFAULT_PAGESIZE)
+	file, file_header, err := Create_and_ConnectDB_with_store(store, Default_connect_options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := uint32(0); key < 1000; key++ {
+		err = Insert(key, []byte("some value"), file_header, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Two flushes of the same tree, one by Commit and one by DisconnectDB, so both slots point to it
+	err = Commit(file_header, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	DisconnectDB(file, file_header)
+
+	slots := header_slots(t, store)
+	newest := 0
+	if slots[1].Sequence_num > slots[0].Sequence_num {
+		newest = 1
+	}
+	older := 1 - newest
+	if slots[newest].Sequence_num != slots[older].Sequence_num+1 || slots[newest].Sequence_num%num_file_header_slots != uint64(newest) {
+		t.Fatalf("the slots have the sequence numbers %v and %v", slots[0].Sequence_num, slots[1].Sequence_num)
+	}
+
+	// A damaged newest copy falls back to the other one (read-only, so that disconnecting doesn't write a new copy over
+	// the damaged one)
+	flip_byte(t, store, uint32(newest), 100)
+	read_only := Default_connect_options
+	read_only.Read_only = true
+	file, file_header, err = ConnectDB_with_store(store, read_only)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file_header.Sequence_num != slots[older].Sequence_num {
+		t.Fatalf("connected with the sequence number %v instead of %v of the older copy", file_header.Sequence_num, slots[older].Sequence_num)
+	}
+	check_ok(t, "with the older copy", 1000, file_header, file)
+	DisconnectDB(file, file_header)
+
+	// Nothing to fall back to
+	flip_byte(t, store, uint32(older), 100)
+	_, _, err = ConnectDB_with_store(store, read_only)
+	var corrupt *ErrCorruptPage
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("connecting with both copies damaged gave %v instead of ErrCorruptPage", err)
+	}
+}
+
+func TestReadOnlyHandle(t *testing.T) {
+	const db_name = "test_read_only"
+	create_test_db(t, db_name)
+	before, err := os.ReadFile(db_file_path(db_name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := Default_connect_options
+	options.Read_only = true
+	file, file_header, err := ConnectDB_with_options(db_name, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, mutate := range map[string]func() error{
+		"Insert":      func() error { return Insert(1000, []byte("value"), file_header, file) },
+		"Delete":      func() error { return Delete(10, file_header, file) },
+		"MakeNewPage": func() error { _, err := MakeNewPage(Page_type_ids["Node"], file_header, file); return err },
+		"DeletePage":  func() error { return DeletePage(file_header.Root_node_id, file_header, file) },
+		"Compact":     func() error { _, err := Compact(10, file_header, file); return err },
+		"Commit":      func() error { return Commit(file_header, file) },
+	} {
+		err = mutate()
+		if !errors.Is(err, ErrReadOnly) {
+			t.Errorf("%v on a read-only handle gave %v instead of ErrReadOnly", name, err)
+		}
+	}
+	DisconnectDB(file, file_header)
+
+	// Not a byte of the file was written, the File Header copies included
+	after, err := os.ReadFile(db_file_path(db_name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatal("the file changed while it was connected read-only")
+	}
+}
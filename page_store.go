@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	Storage backends of the db (PageStore).
+
+	Everything the db needs from the storage goes through a PageStore: reading and writing whole pages, the size, cutting
+	it down and making the writes durable. The buffer pool and ReadChunk / WriteChunk sit on top of it, so nothing else
+	knows what the pages are actually kept in.
+
+		file		->	the db file on the disk (what ConnectDB and Create_and_ConnectDB use). It holds the flock of the
+						file, and reads through the memory mapping when ConnectOptions.Use_mmap is set (see mmap.go).
+		memory		->	the pages are just kept in memory and are gone with the store. For tests, ephemeral caches and
+						such. Closing it keeps the pages, so the same store can be connected to again.
+
+	Any other backend (like one that wraps another store and injects faults) can be used with Create_and_ConnectDB_with_store
+	and ConnectDB_with_store.
+
+	A store is made for one page size and only ever gets whole pages of it. The file store finds the page size of an
+	existing db in its File Header. Writing past the end grows it, with the pages skipped over reading back as zeroes
+	(free pages). The bytes returned by Read_page must not be changed, they may be the store's own.
+*/
+
+type PageStore interface {
+	Read_page(page_id uint32) ([]byte, error) // Fails if the page is past the end of the store
+	Write_page(page_id uint32, data []byte) error
+	Size() (int64, error) // In bytes
+	Truncate(num_pages uint32) error
+	Sync() error
+	Close() error
+	Page_size() int
+}
+
+// FILE
+
+type file_page_store struct {
+	file      *os.File
+	page_size int
+	mapping   *file_mapping // nil unless the file is read through mmap
+}
+
+func Open_file_page_store(path string, create bool, options ConnectOptions) (PageStore, error) {
+
+	// Readers share the file with each other, writers need it all to themselves
+	flag := os.O_RDWR
+	if options.Read_only {
+		flag = os.O_RDONLY
+	}
+	if create {
+		flag |= os.O_CREATE
+	}
+	file, err := open_locked_file(path, flag, options)
+	if err != nil {
+		return nil, err
+	}
+
+	// A new db gets the page size it is asked for, an existing one already has its own
+	var layout *page_layout
+	if create {
+		layout, err = layout_for_page_size(options.Page_size)
+	} else {
+		layout, err = detect_page_size(file)
+	}
+	if err != nil {
+		unlock_file(file)
+		file.Close()
+		return nil, err
+	}
+
+	store := &file_page_store{file: file, page_size: layout.page_size}
+	if options.Use_mmap {
+		store.mapping, err = open_mapping(file, layout.page_size)
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+func open_locked_file(path string, flag int, options ConnectOptions) (*os.File, error) {
+	// Lock before anything is read or written, another process might still be using this file. While waiting for the
+	// lock, Vacuum_db may have put a new file in place of this one (and the lock then got is on the old file, which
+	// nobody will ever read again), so the file is opened again until the locked file is the one at `path`
+
+	for {
+		file, err := os.OpenFile(path, flag, 0644)
+		if err != nil {
+			return nil, errors.Wrap(err, "error while opening the database file")
+		}
+		err = lock_db_file(file, !options.Read_only, options.Lock_timeout)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		locked_stats, err := file.Stat()
+		if err != nil {
+			unlock_file(file)
+			file.Close()
+			return nil, errors.Wrap(err, "coudnt get the file stats")
+		}
+		path_stats, err := os.Stat(path)
+		if err == nil && os.SameFile(locked_stats, path_stats) {
+			return file, nil
+		}
+		unlock_file(file)
+		file.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrap(err, "coudnt get the file stats")
+		}
+	}
+}
+
+func detect_page_size(file *os.File) (*page_layout, error) {
+	// The page size is in the File Header, but where the second copy of it is depends on the page size. So every page
+	// size is tried, and the one whose File Header copy validates and says it is of that size is it.
+
+	var header_err error
+	for slot := int64(0); slot < num_file_header_slots; slot++ {
+		for _, page_size := range Page_sizes {
+			buf := make([]byte, page_size)
+			_, err := file.ReadAt(buf, slot*int64(page_size))
+			if err != nil {
+				continue
+			}
+			ident, page_type := decode_page_start(buf)
+			if ident != PAGE_IDENTITY_NUM || page_type != Page_type_ids["FileHeader"] {
+				continue
+			}
+			err = verify_page_checksum(uint32(slot), buf, page_size)
+			if err != nil {
+				header_err = err
+				continue
+			}
+			var file_header FileHeaderPage
+			decode_file_header_page(buf, &file_header)
+			layout, err := layout_for_page_size(int(file_header.Page_size))
+			if err == nil && layout.page_size == page_size {
+				return layout, nil
+			}
+		}
+	}
+	if header_err == nil {
+		header_err = errors.New("no file header found")
+	}
+	return nil, errors.Wrap(header_err, "couldn't find out the page size of the db file")
+}
+
+// Positional reads and writes are used, so that readers sharing the same handle don't fight over the file offset
+func (s *file_page_store) Read_page(page_id uint32) ([]byte, error) {
+	if s.mapping != nil {
+		return s.mapping.read_chunk(page_id)
+	}
+
+	// Calculate the byte offset for the specified chunk
+	offset := int64(page_id) * int64(s.page_size)
+
+	// Create a buffer to hold the chunk data
+	buffer := make([]byte, s.page_size)
+
+	// Read the chunk into the buffer
+	bytesRead, err := s.file.ReadAt(buffer, offset)
+	if err == io.EOF && bytesRead == 0 {
+		return nil, errors.New(fmt.Sprintf("Specified pageIndex = %v is out of the scope of the file", page_id))
+	}
+	if err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, fmt.Sprintf("error reading chunk at index %d", page_id))
+	}
+
+	// If fewer bytes were read, adjust the buffer size
+	return buffer[:bytesRead], nil
+}
+
+func (s *file_page_store) Write_page(page_id uint32, data []byte) error {
+	// Calculate the byte offset for the specified chunk
+	offset := int64(page_id) * int64(s.page_size)
+
+	// Write the data to the file
+	_, err := s.file.WriteAt(data, offset)
+	if err != nil {
+		return errors.Wrap(err, "error writing to chunk")
+	}
+
+	if s.mapping != nil {
+		return s.mapping.grown(offset+int64(s.page_size), s.file)
+	}
+	return nil
+}
+
+func (s *file_page_store) Size() (int64, error) {
+	file_stats, err := s.file.Stat()
+	if err != nil {
+		return 0, errors.Wrap(err, "coudnt get the file stats")
+	}
+	return file_stats.Size(), nil
+}
+
+func (s *file_page_store) Truncate(num_pages uint32) error {
+	err := s.file.Truncate(int64(num_pages) * int64(s.page_size))
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("error while truncating the db file to %v pages", num_pages))
+	}
+
+	if s.mapping != nil {
+		size, err := s.Size()
+		if err != nil {
+			return err
+		}
+		return s.mapping.shrunk(size, s.file)
+	}
+	return nil
+}
+
+func (s *file_page_store) Sync() error {
+	return s.file.Sync()
+}
+
+func (s *file_page_store) Close() error {
+	if s.mapping != nil {
+		err := s.mapping.close()
+		if err != nil {
+			fmt.Printf("error while trying to unmap the db file:\n%+v\n", err)
+		}
+	}
+	err := unlock_file(s.file)
+	if err != nil {
+		fmt.Printf("error while trying to unlock the db file:\n%+v\n", err)
+	}
+	return s.file.Close()
+}
+
+func (s *file_page_store) Page_size() int {
+	return s.page_size
+}
+
+// MEMORY
+
+type memory_page_store struct {
+	lock      sync.RWMutex
+	pages     [][]byte // Every page is page_size long, nil for the pages which were skipped over and never written
+	page_size int
+}
+
+func New_memory_page_store(page_size int) (PageStore, error) {
+	layout, err := layout_for_page_size(page_size)
+	if err != nil {
+		return nil, err
+	}
+	return &memory_page_store{page_size: layout.page_size}, nil
+}
+
+func (s *memory_page_store) Read_page(page_id uint32) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if int(page_id) >= len(s.pages) {
+		return nil, errors.New(fmt.Sprintf("Specified pageIndex = %v is out of the scope of the store", page_id))
+	}
+	if s.pages[page_id] == nil {
+		return make([]byte, s.page_size), nil
+	}
+	// Pages are replaced as a whole on writes, never changed in place, so handing this one out is safe
+	return s.pages[page_id], nil
+}
+
+func (s *memory_page_store) Write_page(page_id uint32, data []byte) error {
+	if len(data) != s.page_size {
+		return errors.New(fmt.Sprintf("data must be exactly %d bytes", s.page_size))
+	}
+	page := make([]byte, s.page_size)
+	copy(page, data)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if int(page_id) >= len(s.pages) {
+		s.pages = append(s.pages, make([][]byte, int(page_id)+1-len(s.pages))...)
+	}
+	s.pages[page_id] = page
+	return nil
+}
+
+func (s *memory_page_store) Size() (int64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return int64(len(s.pages)) * int64(s.page_size), nil
+}
+
+func (s *memory_page_store) Truncate(num_pages uint32) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if int(num_pages) <= len(s.pages) {
+		clear(s.pages[num_pages:]) // So that the cut off pages can be collected
+		s.pages = s.pages[:num_pages]
+	} else {
+		s.pages = append(s.pages, make([][]byte, int(num_pages)-len(s.pages))...)
+	}
+	return nil
+}
+
+func (s *memory_page_store) Sync() error {
+	return nil
+}
+
+func (s *memory_page_store) Close() error {
+	return nil
+}
+
+func (s *memory_page_store) Page_size() int {
+	return s.page_size
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestMemoryPageStore(t *testing.T) {
+	store, err := New_memory_page_store(DEFAULT_PAGESIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Read_page(0); err == nil {
+		t.Fatal("read a page of an empty store")
+	}
+
+	page := bytes.Repeat([]byte{7}, DEFAULT_PAGESIZE)
+	if err := store.Write_page(3, page); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := store.Size(); size != 4*DEFAULT_PAGESIZE {
+		t.Fatalf("size is %v after writing the page 3", size)
+	}
+	if got, _ := store.Read_page(1); !bytes.Equal(got, make([]byte, DEFAULT_PAGESIZE)) {
+		t.Fatal("a page skipped over isn't all zeroes")
+	}
+	page[0] = 8 // The store keeps its own copy
+	if got, _ := store.Read_page(3); got[0] != 7 {
+		t.Fatal("the store didn't copy the page written")
+	}
+	if err := store.Write_page(0, page[:10]); err == nil {
+		t.Fatal("wrote a page of the wrong size")
+	}
+
+	if err := store.Truncate(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Read_page(3); err == nil {
+		t.Fatal("read a page cut off by truncate")
+	}
+	if _, err := New_memory_page_store(1000); err == nil {
+		t.Fatal("made a store of a page size which isn't one of Page_sizes")
+	}
+}
+
+// Test values of every kind: empty, short (inline when the db has Inline_value_size), compressible, and a few spread
+// over more than one DataPage
+func test_value(key int, r *rand.Rand) []byte {
+	switch key % 10 {
+	case 0:
+		return nil
+	case 1:
+		return bytes.Repeat([]byte(fmt.Sprint("value-", key, "|")), 20+r.Intn(100))
+	case 2:
+		if key%40 == 2 {
+			value := make([]byte, 5000+r.Intn(20000))
+			r.Read(value)
+			return value
+		}
+	}
+	value := make([]byte, 1+r.Intn(60))
+	r.Read(value)
+	return value
+}
+
+func check_values(t *testing.T, values map[uint32][]byte, num_keys int, file_header *FileHeaderPage, file *DBFile) {
+	t.Helper()
+	for key := uint32(0); key < uint32(num_keys); key++ {
+		data, found, err := Get(key, file_header, file)
+		want, kept := values[key]
+		if err != nil || found != kept || !bytes.Equal(data, want) {
+			t.Fatalf("key %v: found = %v (want %v), err = %v, %v bytes (want %v)", key, found, kept, err, len(data), len(want))
+		}
+	}
+}
+
+func check_ok(t *testing.T, when string, num_keys int, file_header *FileHeaderPage, file *DBFile) *CheckReport {
+	t.Helper()
+	report, err := Check(file_header, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Ok {
+		t.Fatalf("%v: %v errors, first one %+v", when, len(report.Errors), report.Errors[0])
+	}
+	if report.Num_keys != uint64(num_keys) {
+		t.Fatalf("%v: found %v keys instead of %v", when, report.Num_keys, num_keys)
+	}
+	return report
+}
+
+func TestMemoryStoreTree(t *testing.T) {
+	for _, tree_mode := range []string{"BTree", "BLink", "BPlus"} {
+		for _, page_size := range Page_sizes {
+			for _, test := range []struct {
+				name    string
+				options func(options *ConnectOptions)
+			}{
+				{"default", func(options *ConnectOptions) {}},
+				{"inline compressed", func(options *ConnectOptions) { options.Inline_value_size = 32; options.Compress_values = true }},
+				{"lazy no pool", func(options *ConnectOptions) { options.Lazy_rebalance = true; options.Buffer_pool_bytes = 0 }},
+			} {
+				t.Run(fmt.Sprint(tree_mode, "/", page_size, "/", test.name), func(t *testing.T) {
+					options := Default_connect_options
+					options.Tree_mode = Tree_mode_ids[tree_mode]
+					options.Page_size = page_size
+					test.options(&options)
+
+					store, err := New_memory_page_store(page_size)
+					if err != nil {
+						t.Fatal(err)
+					}
+					file, file_header, err := Create_and_ConnectDB_with_store(store, options)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					// A few levels of nodes with the smaller pages, and still quick with the bigger ones
+					num_keys := 3 * page_layouts[DEFAULT_PAGESIZE].max_degree
+					r := rand.New(rand.NewSource(int64(page_size)))
+					values := make(map[uint32][]byte)
+					for _, key := range r.Perm(num_keys) {
+						values[uint32(key)] = test_value(key, r)
+						err = Insert(uint32(key), values[uint32(key)], file_header, file)
+						if err != nil {
+							t.Fatal(err)
+						}
+					}
+					check_values(t, values, num_keys, file_header, file)
+					check_ok(t, "after inserting", len(values), file_header, file)
+
+					for _, key := range r.Perm(num_keys)[:num_keys*2/3] {
+						err = Delete(uint32(key), file_header, file)
+						if err != nil {
+							t.Fatal(err)
+						}
+						delete(values, uint32(key))
+					}
+					check_values(t, values, num_keys, file_header, file)
+					check_ok(t, "after deleting", len(values), file_header, file)
+
+					num_pages, _ := num_pages_in_db_file(file)
+					_, err = Compact(int(num_pages), file_header, file)
+					if err != nil {
+						t.Fatal(err)
+					}
+					report := check_ok(t, "after compacting", len(values), file_header, file)
+					if report.Num_free_pages != 0 || report.Num_pages > num_pages {
+						t.Fatalf("compacting left %v free pages, %v pages out of %v", report.Num_free_pages, report.Num_pages, num_pages)
+					}
+					check_values(t, values, num_keys, file_header, file)
+
+					dst, _ := New_memory_page_store(page_size)
+					err = Vacuum(dst, file_header, file)
+					if err != nil {
+						t.Fatal(err)
+					}
+					DisconnectDB(file, file_header)
+					file, file_header, err = ConnectDB_with_store(dst, options)
+					if err != nil {
+						t.Fatal(err)
+					}
+					report = check_ok(t, "after vacuuming", len(values), file_header, file)
+					if report.Num_free_pages != 0 || len(report.Warnings) != 0 {
+						t.Fatalf("the vacuumed db has %v free pages and %v warnings", report.Num_free_pages, len(report.Warnings))
+					}
+					check_values(t, values, num_keys, file_header, file)
+					DisconnectDB(file, file_header)
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	Point lookups straight over the raw pages (Get_into, and Get whenever the buffer pool is off).
+
+	ReadPage decodes a whole page into a new NodePage or DataPage, slices and all, though a lookup only looks at a
+	handful of fields of a few pages. So with the buffer pool turned off, lookups read those fields right out of the
+	bytes ReadChunk hands back, at the offsets page_codec.go lays the pages out with. With Use_mmap (or the memory
+	store) those bytes are the store's own, so nothing at all is allocated on the way down the tree and along the
+	chain of DataPages. The only allocation left is the value itself: Get makes a new slice for it, while Get_into
+	appends it to a buffer of the caller, so a lookup into a buffer with enough room allocates nothing. Compressed values
+	are the exception, decompressing them allocates.
+
+	The lookups latch like the decoded path does: crabbing down one node at a time in read mode, and in the B-link tree
+	latching only the node being looked at and following Right_link past splits, like blink_get (so they don't wait
+	on splits there either). With the buffer pool on, Get_into is just Get with the value appended to the buffer,
+	since the pool hands out copies of the pages anyway.
+*/
+
+func Get_into(key uint32, dst []byte, file_header *FileHeaderPage, file *DBFile) ([]byte, bool, error) {
+	// Like Get, but the value is appended to `dst` (which is handed back as it is if the key isn't there)
+
+	if file.pool != nil {
+		data, found, err := Get(key, file_header, file)
+		if err != nil || !found {
+			return dst, found, err
+		}
+		return append(dst, data...), true, nil
+	}
+
+	file.lock.RLock()
+	defer file.lock.RUnlock()
+
+	return view_get(key, dst, file_header, file)
+}
+
+func view_get(key uint32, dst []byte, file_header *FileHeaderPage, file *DBFile) ([]byte, bool, error) {
+
+	if is_blink(file_header) {
+		return view_blink_get(key, dst, file_header, file)
+	}
+	return view_crab_get(key, dst, file_header, file)
+}
+
+func view_crab_get(key uint32, dst []byte, file_header *FileHeaderPage, file *DBFile) ([]byte, bool, error) {
+
+	file.root_latch.RLock()
+	node_id := file_header.Root_node_id
+	if node_id != 0 {
+		get_page_latch(file, node_id).RLock()
+	}
+	file.root_latch.RUnlock()
+
+	for node_id != 0 {
+		latch := get_page_latch(file, node_id)
+		buf, err := view_page(node_id, Page_type_ids["Node"], file)
+		if err != nil {
+			latch.RUnlock()
+			return dst, false, err
+		}
+
+		var child_id uint32
+		ind, found := view_node_index(buf, key)
+		if buf[node_page_keys_only_offset] != 0 {
+			// Keys_only, a key equal to the separator is under the child to its right
+			if found {
+				ind++
+			}
+			child_id = view_node_child(buf, ind, file)
+		} else if found {
+			dst, err = view_node_value(buf, ind, dst, file)
+			latch.RUnlock()
+			if err != nil {
+				return dst, false, errors.Wrap(err, fmt.Sprintf("error while trying to retrieve key %v data from the nodepage %v", key, node_id))
+			}
+			return dst, true, nil
+		} else {
+			child_id = view_node_child(buf, ind, file)
+		}
+
+		// Crab down, the child is latched before letting go of this node
+		if child_id != 0 {
+			get_page_latch(file, child_id).RLock()
+		}
+		latch.RUnlock()
+		node_id = child_id
+	}
+	return dst, false, nil
+}
+
+func view_blink_get(key uint32, dst []byte, file_header *FileHeaderPage, file *DBFile) ([]byte, bool, error) {
+	// blink_get over the raw pages
+
+	for attempt := 0; attempt < blink_max_attempts; attempt++ {
+		epoch := file.blink_epoch.Load()
+
+		file.root_latch.RLock()
+		root_id := file_header.Root_node_id
+		file.root_latch.RUnlock()
+
+		out, found, err := view_blink_search_helper(key, dst, root_id, file)
+		if found || file.blink_epoch.Load() == epoch {
+			return out, found, err
+		}
+	}
+
+	// The keys kept moving around this search, so crab down instead
+	return view_crab_get(key, dst, file_header, file)
+}
+
+func view_blink_search_helper(key uint32, dst []byte, root_id uint32, file *DBFile) ([]byte, bool, error) {
+	// blink_search_helper, every node is latched on its own while it is looked at and let go of before the next one
+
+	node_id := root_id
+	for node_id != 0 {
+		latch := get_page_latch(file, node_id)
+		latch.RLock()
+		buf, err := view_page(node_id, Page_type_ids["Node"], file)
+		if err != nil {
+			latch.RUnlock()
+			return dst, false, err
+		}
+
+		ind, found := view_node_index(buf, key)
+		if found {
+			dst, err = view_node_value(buf, ind, dst, file)
+			latch.RUnlock()
+			if err != nil {
+				return dst, false, errors.Wrap(err, fmt.Sprintf("error while trying to retrieve key %v data from the nodepage %v", key, node_id))
+			}
+			return dst, true, nil
+		}
+
+		right_link := NativeEndian.Uint32(buf[node_page_right_link_offset:node_page_high_key_offset])
+		high_key := NativeEndian.Uint32(buf[node_page_high_key_offset:node_page_left_link_offset])
+		if right_link != 0 && key >= high_key {
+			latch.RUnlock()
+			if key == high_key {
+				// The key belongs in one of the nodes above, which were already passed
+				return dst, false, nil
+			}
+			// The node was split after its parent was read, the key went to the right
+			node_id = right_link
+			continue
+		}
+
+		node_id = view_node_child(buf, ind, file)
+		latch.RUnlock()
+	}
+	return dst, false, nil
+}
+
+func view_page(page_id uint32, page_type uint8, file *DBFile) ([]byte, error) {
+	// The raw page, checked like decode_page does. It must not be changed (it may be the store's own bytes)
+
+	buf, err := ReadChunk(file, page_id)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("error while trying to read %v page from file", page_id))
+	}
+	ident, pt := decode_page_start(buf)
+	if ident != PAGE_IDENTITY_NUM || pt != page_type {
+		return nil, errors.New(fmt.Sprintf("read page %v isn't of type %v. read page of type %v", page_id, page_type, pt))
+	}
+	err = verify_page_checksum(page_id, buf, file.layout.page_size)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// NodePage, at the offsets of page_codec.go
+
+func view_node_cell_size(buf []byte) int {
+	if buf[node_page_keys_only_offset] != 0 {
+		return 4 // Keys_only, just the key
+	}
+	return 4 + 4 + int(buf[node_page_inline_size_offset])
+}
+
+func view_node_index(buf []byte, key uint32) (int, bool) {
+	// binary_index_node over the cells of the page
+
+	cell_size := view_node_cell_size(buf)
+	l, r := 0, int(NativeEndian.Uint16(buf[node_page_block_size_offset:node_page_right_link_offset]))
+	for l < r {
+		mid := (l + r) / 2
+		off := node_page_header_size + mid*cell_size
+		mid_key := NativeEndian.Uint32(buf[off : off+4])
+		if mid_key == key {
+			return mid, true
+		} else if mid_key > key {
+			r = mid
+		} else {
+			l = mid + 1
+		}
+	}
+	return l, false
+}
+
+func view_node_child(buf []byte, ind int, file *DBFile) uint32 {
+
+	max_degree := inline_max_degree(file.layout, int(buf[node_page_inline_size_offset]))
+	if buf[node_page_keys_only_offset] != 0 {
+		max_degree = file.layout.keys_only_max_degree
+	}
+	off := node_page_header_size + max_degree*view_node_cell_size(buf) + 4*ind
+	return NativeEndian.Uint32(buf[off : off+4])
+}
+
+func view_node_value(buf []byte, ind int, dst []byte, file *DBFile) ([]byte, error) {
+	// read_node_value, appending to `dst`
+
+	off := node_page_header_size + ind*view_node_cell_size(buf)
+	ref := NativeEndian.Uint32(buf[off+4 : off+8])
+	if ref&data_ref_inline != 0 {
+		size := int(buf[node_page_inline_size_offset])
+		length := int(ref &^ data_ref_inline)
+		if length > size {
+			return dst, errors.New(fmt.Sprintf("the inline value at %v is %v bytes long, but the cells only have room for %v", ind, length, size))
+		}
+		return append(dst, buf[off+8:off+8+length]...), nil
+	}
+
+	// data_chain.get_value, but with the records appended to `dst` as they are found
+	data_page_id := NativeEndian.Uint32(buf[node_page_data_page_id_offset:node_page_block_size_offset])
+	start := len(dst)
+	var flags uint8
+	for pieces := 0; ; pieces++ {
+		if pieces > max_data_chain_length {
+			return dst, errors.New(fmt.Sprintf("the records of the value at %v go round in circles", ref))
+		}
+		record, err := view_data_record(data_page_id, ref, file)
+		if err != nil {
+			return dst, err
+		}
+		if pieces == 0 {
+			flags = record[0] & DATA_RECORD_COMPRESSED
+		}
+		if record[0]&DATA_RECORD_CONTINUED == 0 {
+			dst = append(dst, record[data_record_header_size:]...)
+			break
+		}
+		if len(record) < data_record_continued_size {
+			return dst, errors.New(fmt.Sprintf("the record at %v is too short to be continued", ref))
+		}
+		dst = append(dst, record[data_record_continued_size:]...)
+		ref = NativeEndian.Uint32(record[data_record_header_size:data_record_continued_size])
+	}
+
+	if flags == 0 {
+		return dst, nil
+	}
+	value, err := decode_value(dst[start:], flags)
+	if err != nil {
+		return dst[:start], err
+	}
+	return append(dst[:start], value...), nil
+}
+
+// DataPage, at the offsets of page_codec.go
+
+func view_data_record(data_page_id uint32, ref uint32, file *DBFile) ([]byte, error) {
+	// data_chain.record, walking the chain from its first DataPage
+
+	chain_ind, slot := split_data_ref(ref)
+	page_id := data_page_id
+	var buf []byte
+	for i := 0; ; i++ {
+		if page_id == 0 {
+			return nil, errors.New(fmt.Sprintf("there is no datapage %v in a chain of %v datapages", chain_ind, i))
+		}
+		var err error
+		buf, err = view_page(page_id, Page_type_ids["Data"], file)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("error while trying to find the datapage of the data ref %v", ref))
+		}
+		if i == chain_ind {
+			break
+		}
+		page_id = NativeEndian.Uint32(buf[data_page_next_data_page_offset:data_page_parent_node_page_offset])
+	}
+
+	num_slots := NativeEndian.Uint16(buf[data_page_num_slots_offset:data_page_slots_offset])
+	off := data_page_slots_offset + 4*int(slot)
+	if slot >= num_slots || int(slot) >= file.layout.data_page_num_slots {
+		return nil, errors.New(fmt.Sprintf("there is no record in the slot %v", slot))
+	}
+	record_offset := int(NativeEndian.Uint16(buf[off : off+2]))
+	record_length := int(NativeEndian.Uint16(buf[off+2 : off+4]))
+	if record_length == 0 {
+		return nil, errors.New(fmt.Sprintf("there is no record in the slot %v", slot))
+	}
+	if record_offset+record_length > file.layout.max_data_size {
+		return nil, errors.New(fmt.Sprintf("the record in the slot %v goes past the end of the datapage", slot))
+	}
+	start := file.layout.data_page_header_size + record_offset
+	return buf[start : start+record_length], nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestViewBLinkFollowsRightLinks(t *testing.T) {
+	// A reader whose parent was read before a split lands left of the key, like starting the search at the leftmost
+	// leaf for every key of the level. The right links have to bring it to the key anyway
+	options := Default_connect_options
+	options.Tree_mode = Tree_mode_ids["BLink"]
+	options.Buffer_pool_bytes = 0
+	store, _ := New_memory_page_store(DEFAULT_PAGESIZE)
+	file, file_header, err := Create_and_ConnectDB_with_store(store, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DisconnectDB(file, file_header)
+	for key := uint32(0); key < 3000; key++ {
+		err = Insert(key, []byte(fmt.Sprintf("value-%v", key)), file_header, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	leftmost_leaf := file_header.Root_node_id
+	for {
+		_, _, node, _, err := ReadPage(file, leftmost_leaf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.Children[0] == 0 {
+			break
+		}
+		leftmost_leaf = node.Children[0]
+	}
+
+	num_leaves := 0
+	for node_id := leftmost_leaf; node_id != 0; num_leaves++ {
+		_, _, node, _, err := ReadPage(file, node_id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, cell := range node.Blocks[:node.Block_size] {
+			data, found, err := view_blink_search_helper(cell.Key, nil, leftmost_leaf, file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !found || string(data) != fmt.Sprintf("value-%v", cell.Key) {
+				t.Fatalf("the key %v of the leaf %v came back as %q (found = %v) from the leftmost leaf", cell.Key, node_id, string(data), found)
+			}
+		}
+		node_id = node.Right_link
+	}
+	if num_leaves < 2 {
+		t.Fatal("only one leaf, there are no right links to follow")
+	}
+
+	// Keys of the levels above are passed over, not looked for to the right
+	_, _, root, _, err := ReadPage(file, file_header.Root_node_id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, found, err := view_blink_search_helper(root.Blocks[0].Key, nil, leftmost_leaf, file)
+	if err != nil || found {
+		t.Fatalf("the root key %v was found = %v (err = %v) starting from the leftmost leaf", root.Blocks[0].Key, found, err)
+	}
+}
@@ -1,17 +1,32 @@
 /*
 	BIG ENDIAN is followed for saving data.
 
-	Each DB file will be implicitly partitioned into 4kB (4 kilo Byte) slabs. This is strict and should not be overriden
+	Each DB file will be implicitly partitioned into slabs of the page size, which is picked when the db is created
+	(ConnectOptions.Page_size, one of 4kB, 8kB, 16kB or 64kB, 4kB by default) and never changed after that. It is kept
+	in the File Header as Page_size (0 there means 4kB, as in the files made before the page size could be picked).
 
-	Each 4kB slab is reffered to as a page. Since they can be accessed in one disk access. Run
-	`grep -ir pagesize /proc/self/smaps` to check appropriate page size on any UNIX like system. This code however
-	works only with 4kB page sizes and wil require considerable changes to work for other page sizes including rethinking
-	a maority of design decisions made.
+	Each slab is reffered to as a page. Since they can be accessed in one disk access. Run
+	`grep -ir pagesize /proc/self/smaps` to check appropriate page size on any UNIX like system. Bigger pages suit SSDs
+	and large values better.
+
+	Everything sized by the page size (the fan-out of the nodes, the header and the slots of the data pages) is
+	worked out from it at runtime, see page_layout. So the arrays in the NodePage and the DataPage are slices, made to
+	the right length by new_node_page / new_data_page and by the decoders in page_codec.go.
 
 	EVERY page starts with a 4B random number (common number for all pages) which helps in identifying that what we are
 	reading is indeed a page and not a random sequence of bytes.
 
-	The first page of the file is will always be the File Header page.
+	Right after the 1B page type, EVERY page stores a 4B CRC32C checksum of the whole page (computed with the checksum
+	field itself taken as zero). It is stamped by WriteChunk and verified by ReadPage, so that bit rot anywhere in the
+	page is caught instead of silently being read back as keys or data.
+
+	The first TWO pages of the file will always be the File Header pages. They hold alternating copies of the same
+	header, each with a sequence number. Every flush of the header bumps the sequence number and overwrites the older
+	copy, so a torn write can only ever damage one copy and the newest copy which still validates is used on connect.
+
+	Keys are fixed 4B integers, kept whole in every cell of a NodePage. So there is no prefix compression of the keys:
+	there are no shared prefixes to store once per node, and nothing to gain from truncating the separators. It only
+	makes sense once keys are variable length, which changes the cell layout, the codec and every key comparison.
 
 	Page Types allowed along wit there ids:
 		PAGE_TYPE			TYPE_ID
@@ -26,29 +41,82 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"io"
+	"hash/crc32"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
 var NativeEndian = binary.BigEndian // Can be changed as its system independant
 
-const MAX_DEGREE int = 336 // [DO NOT CHANGE] MAX_DEGREE = 4 means that in one node at most 3 elements can be there and at most 4 children of that node
-const min_block_size int = (MAX_DEGREE / 2) - 1
-
-const PAGESIZE = 4096                          // 4KB // DO NOT CHANGE
+const DEFAULT_PAGESIZE = 4096                  // 4KB // Also the smallest page size, the File Header always fits in it
 const PAGE_IDENTITY_NUM uint32 = 0x6EBC061F    // 4B Random Number used to identify if read memory is actually a page or not. First 4B of EVERY page is this number
 const num_free_space_entries_file_header = 200 // Max Value of 200
-const data_page_space_table_num_entries = 123  // Max value of 123
+const num_file_header_slots = 2                // Pages 0 and 1 are the two copies of the File Header
 const node_page_header_size = 60               // [DO NOT CHANGE]
-var Page_type_ids map[string]uint8 = map[string]uint8{"FileHeader": 21, "Node": 33, "Data": 45, "Free": 0}
+var Page_sizes []int = []int{4096, 8192, 16384, 65536}
+var Page_type_ids map[string]uint8 = map[string]uint8{"FileHeader": 21, "Node": 33, "Data": 45, "Freelist": 57, "Free": 0}
+var Tree_mode_ids map[string]uint8 = map[string]uint8{"BTree": 0, "BLink": 1, "BPlus": 2} // See btree_blink.go for the B-link tree and btree_plus.go for the B+ tree
+
+const page_checksum_offset = 4 + 1 // The checksum is placed right after Identification_num and Page_type in every page
+var crc32c_table = crc32.MakeTable(crc32.Castagnoli)
+
+// Sizes of everything in the pages, for one page size
+type page_layout struct {
+	page_size int
+
+	max_degree           int // max_degree = 4 means that in one node at most 3 elements can be there and at most 4 children of that node
+	min_block_size       int
+	keys_only_max_degree int // max_degree of the nodes which keep only their keys (the internal nodes of a B+ tree)
+
+	data_page_header_size int // The DataPage header takes up an eighth of the page (512B of 4kB)
+	data_page_num_slots   int // Records that can be kept in one DataPage, one slot each
+	max_data_size         int // maximum data that can be put inside the DataPage, the records along with their flags
+
+	freelist_page_num_entries int // Free page ids that fit in one FreelistPage
+}
 
-// General structure of a page
+var page_layouts map[int]*page_layout = make_page_layouts()
+
+func make_page_layouts() map[int]*page_layout {
+	layouts := make(map[int]*page_layout)
+	for _, page_size := range Page_sizes {
+		// A node is its header, max_degree cells of 8B and max_degree+1 children of 4B
+		max_degree := (page_size - node_page_header_size - 4) / (8 + 4)
+		data_page_header_size := page_size / 8
+		layouts[page_size] = &page_layout{
+			page_size:                 page_size,
+			max_degree:                max_degree,
+			min_block_size:            (max_degree / 2) - 1,
+			keys_only_max_degree:      (page_size - node_page_header_size - 4) / (4 + 4),
+			data_page_header_size:     data_page_header_size,
+			data_page_num_slots:       (data_page_header_size - data_page_slots_offset) / (2 + 2),
+			max_data_size:             page_size - data_page_header_size,
+			freelist_page_num_entries: (page_size - freelist_page_table_offset) / 4,
+		}
+	}
+	return layouts
+}
+
+func layout_for_page_size(page_size int) (*page_layout, error) {
+	if page_size == 0 {
+		page_size = DEFAULT_PAGESIZE
+	}
+	layout, ok := page_layouts[page_size]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unsupported page size %v, it has to be one of %v", page_size, Page_sizes))
+	}
+	return layout, nil
+}
+
+// General structure of the start of a page
 type Page struct {
 	Identification_num uint32
 	Page_type          uint8
-	_                  [PAGESIZE - (4 + 1)]byte
+	Checksum           uint32
 }
 
 // Structure of the File Header
@@ -59,131 +127,292 @@ type free_space_table_row struct {
 type FileHeaderPage struct {
 	Identification_num uint32
 	Page_type          uint8
-	Total_pages        uint32 // Includes count of all Pages in the DB (Data, Node and even this FileHeader page as well) // This is important for writing to the DB
+	Checksum           uint32
+	Sequence_num       uint64 // Incremented on every flush, the copy with the larger number is the newer one
+	Total_pages        uint32 // Includes count of all Pages in the DB (Data, Node and even both FileHeader pages as well) // This is important for writing to the DB
 	Total_data_size    uint64
 	Root_node_id       uint32
+	Tree_mode          uint8 // One of Tree_mode_ids, chosen when the db is created and never changed after that
 	Space_table_size   uint16
 	Free_space_table   [num_free_space_entries_file_header]free_space_table_row
-	_                  [PAGESIZE - (4 + 1 + 4 + 8 + 4 + 2 + (num_free_space_entries_file_header * (4 + 2)))]byte
+	Page_size          uint32 // 0 for 4kB
+	Freelist_head      uint32 // First FreelistPage of the chain, 0 if there is none (see freelist.go)
+	Freelist_size      uint32 // Free page ids kept in the freelist, not counting the FreelistPages themselves (but counting the trimmed off ones not yet dropped, see freelist.go)
+	Inline_value_size  uint8  // Inline_size of the new leaves (and nodes), chosen when the db is created
+	Min_fill           uint8  // The fill policy of the db (see btree_fill.go), chosen when the db is created. 0 for the default 50
+	Fill_factor        uint8  // 0 for the default 100
+	Lazy_rebalance     uint8  // 1 if nodes are only rebalanced once empty
+	// the rest of the page (after this) is all zeroes
 }
 
-// Structure of the DataPage
-type data_page_unallocated_space_table_row struct {
-	Offset uint16
-	Size   uint16
+// Structure of the DataPage (see data_in_page_handling.go for how the records are kept in it)
+type data_page_slot struct {
+	Offset uint16 // Where the record starts in Data
+	Length uint16 // Of the record, 0 if the slot is free
 }
 type DataPage struct {
 	// Header Start
-	Identification_num      uint32
-	Page_type               uint8
-	Data_held               uint16
-	Next_data_page          uint32
-	Parent_node_page        uint32
-	Space_table_size        uint16
-	Unallocated_space_table [data_page_space_table_num_entries]data_page_unallocated_space_table_row
-	_                       [512 - (4 + 1 + 2 + 4 + 4 + 2 + (data_page_space_table_num_entries * (2 + 2)))]byte
-	// Header End
-	Data [PAGESIZE - 512]byte
+	Identification_num uint32
+	Page_type          uint8
+	Checksum           uint32
+	Data_held          uint16 // Bytes taken by the records, holes left by deleted ones not counted
+	Next_data_page     uint32
+	Parent_node_page   uint32
+	Num_slots          uint16           // Slots ever used, the ones past it are all free
+	Slots              []data_page_slot // data_page_num_slots long
+	// Header End (at data_page_header_size)
+	Data []byte // max_data_size long
 }
 
 // Structure of the NodePage
 type node_page_cell_offet struct {
 	Key    uint32
-	Offset uint32
+	Offset uint32 // Where the value is kept in the DataPages of the node, a data ref (see data_in_page_handling.go), or the length of an inline value
 }
 type NodePage struct {
 	// Header Start
 	Identification_num uint32
 	Page_type          uint8
+	Checksum           uint32
 	Data_page_id       uint32
 	Block_size         uint16
-	_                  [node_page_header_size - (4 + 1 + 4 + 2)]byte
+	Right_link         uint32 // [BLink mode] The next node on the same level, 0 for the rightmost node. [BPlus mode] The next leaf
+	High_key           uint32 // [BLink mode] Every key under this node is smaller than this, only valid if Right_link != 0
+	Left_link          uint32 // [BPlus mode] The previous leaf, 0 for the leftmost one
+	Keys_only          uint8  // [BPlus mode] 1 for the internal nodes, which have no values and so keep just the keys
+	Inline_size        uint8  // Bytes of room for a value in every cell, so that short values need no DataPage (0 for none)
+	_                  [node_page_header_size - (4 + 1 + 4 + 4 + 2 + 4 + 4 + 4 + 1 + 1)]byte
 	// Header End
-	Blocks   [MAX_DEGREE]node_page_cell_offet // 8*MAX_DEGREE = 2688 Bytes
-	Children [MAX_DEGREE + 1]uint32
+	Blocks        []node_page_cell_offet // max_degree long, 8*336 = 2688 Bytes for 4kB pages (keys_only_max_degree long, 4B each, if Keys_only)
+	Inline_values []byte                 // Inline_size bytes for every cell, kept on the page right after the Offset of the cell
+	Children      []uint32               // max_degree+1 long (keys_only_max_degree+1 if Keys_only)
 }
 
-// Read and Write to a file in pages
-func ReadChunk(file *os.File, pageIndex uint32) ([]byte, error) {
-	// Calculate the byte offset for the specified chunk
-	offset := int64(pageIndex) * PAGESIZE
+// Structure of the FreelistPage (see freelist.go)
+type FreelistPage struct {
+	Identification_num uint32
+	Page_type          uint8
+	Checksum           uint32
+	Next_freelist_page uint32 // 0 for the last one of the chain
+	Num_entries        uint32
+	Page_ids           []uint32 // freelist_page_num_entries long, only the first Num_entries are free pages
+}
 
-	file_stats, err := file.Stat()
-	if err != nil {
-		return nil, errors.Wrap(err, "error while trying to get stats of the file")
-	}
-	file_size := file_stats.Size()
-	if offset >= file_size {
-		return nil, errors.New(fmt.Sprintf("Specified pageIndex = %v is out of the scope of the file", pageIndex))
+func new_node_page(layout *page_layout, inline_size int) *NodePage {
+	max_degree := inline_max_degree(layout, inline_size)
+	return &NodePage{
+		Inline_size:   uint8(inline_size),
+		Blocks:        make([]node_page_cell_offet, max_degree),
+		Inline_values: make([]byte, max_degree*inline_size),
+		Children:      make([]uint32, max_degree+1),
 	}
+}
 
-	// Seek to the specified offset
-	_, err = file.Seek(offset, io.SeekStart)
-	if err != nil {
-		return nil, errors.Wrap(err, fmt.Sprintf("error seeking to offset %d", offset))
+// max_degree of the nodes with `inline_size` bytes of room for a value in every cell (layout.max_degree for none)
+func inline_max_degree(layout *page_layout, inline_size int) int {
+	return (layout.page_size - node_page_header_size - 4) / (8 + inline_size + 4)
+}
+
+func new_keys_only_node_page(layout *page_layout) *NodePage {
+	return &NodePage{
+		Keys_only: 1,
+		Blocks:    make([]node_page_cell_offet, layout.keys_only_max_degree),
+		Children:  make([]uint32, layout.keys_only_max_degree+1),
 	}
+}
 
-	// Create a buffer to hold the chunk data
-	buffer := make([]byte, PAGESIZE)
+// The node splits once it has max_degree keys, so it can only hold one less than this (see split)
+func node_max_degree(np *NodePage) int {
+	return len(np.Blocks)
+}
 
-	// Read the chunk into the buffer
-	bytesRead, err := file.Read(buffer)
-	if err != nil && err != io.EOF {
-		return nil, errors.Wrap(err, fmt.Sprintf("error reading chunk at index %d", pageIndex))
+func new_data_page(layout *page_layout) *DataPage {
+	return &DataPage{
+		Slots: make([]data_page_slot, layout.data_page_num_slots),
+		Data:  make([]byte, layout.max_data_size),
 	}
+}
+
+// The pages share their slices when copied, so these are for when a copy of its own is needed
+func (np *NodePage) clone() *NodePage {
+	temp := *np
+	temp.Blocks = append([]node_page_cell_offet(nil), np.Blocks...)
+	temp.Inline_values = append([]byte(nil), np.Inline_values...)
+	temp.Children = append([]uint32(nil), np.Children...)
+	return &temp
+}
+
+func new_freelist_page(layout *page_layout) *FreelistPage {
+	return &FreelistPage{Page_ids: make([]uint32, layout.freelist_page_num_entries)}
+}
+
+func (dp *DataPage) clone() *DataPage {
+	temp := *dp
+	temp.Slots = append([]data_page_slot(nil), dp.Slots...)
+	temp.Data = append([]byte(nil), dp.Data...)
+	return &temp
+}
+
+// Handle to an opened DB file, along with the mode in which it was opened
+type DBFile struct {
+	store           PageStore    // Where the pages are actually kept, see page_store.go
+	layout          *page_layout // Of the page size of the db
+	Read_only       bool         // Opened with O_RDONLY under a shared lock, nothing in the file may be changed through this handle
+	compress_values bool         // New values are compressed when that makes them smaller, see value_compression.go
+	fill            fill_policy  // When nodes are rebalanced and how full splits leave them, see btree_fill.go
+
+	// Taken in read mode by the B-Tree level calls (Search, Get, Insert, Delete), which then work side by side through the
+	// page latches (see btree_latches.go). Taken in write mode by whatever needs the whole file to itself, i.e.
+	// DisconnectDB, VisualizeDB and the compaction of the db file.
+	lock sync.RWMutex
+
+	root_latch   sync.RWMutex // Guards Root_node_id of the file header
+	latches_lock sync.Mutex
+	latches      map[uint32]*sync.RWMutex // Latch of every NodePage, made on first use
+
+	// Guards the free space table, the freelist, Total_pages and Total_data_size of the file header. Held only while a
+	// page id is being handed out or taken back (along with writing that page), never across B-Tree operations.
+	alloc_lock sync.Mutex
+
+	blink_epoch atomic.Uint64 // [BLink mode] Bumped whenever keys move up or to the left in the tree (see btree_blink.go)
+
+	pool *BufferPool // nil when the page cache is turned off, see buffer_pool.go
+
+	compaction_stop chan struct{} // nil unless the db file is being compacted in the background, see compaction.go
+	compaction_done sync.WaitGroup
+}
+
+var ErrReadOnly = errors.New("the database was opened in read-only mode")
 
-	// If fewer bytes were read, adjust the buffer size
-	return buffer[:bytesRead], nil
+// Read and Write to a file in pages
+// Both go through the buffer pool when it is turned on, the *_store versions below go straight to the PageStore
+// The bytes returned by ReadChunk must not be changed, they may be the PageStore's own (like the memory mapped file)
+func ReadChunk(file *DBFile, pageIndex uint32) ([]byte, error) {
+	if file.pool != nil {
+		return file.pool.read_chunk(pageIndex, file)
+	}
+	return read_chunk_from_store(file, pageIndex)
 }
-func WriteChunk(file *os.File, pageIndex uint32, data []byte) error {
-	// Calculate the byte offset for the specified chunk
-	offset := int64(pageIndex) * PAGESIZE
+func WriteChunk(file *DBFile, pageIndex uint32, data []byte) error {
 
-	// Get the current file size
-	fileInfo, err := file.Stat()
+	// Ensure the data is exactly one page
+	if len(data) != file.layout.page_size {
+		return errors.New(fmt.Sprintf("data must be exactly %d bytes", file.layout.page_size))
+	}
+
+	// Determine where to write: at the end of the file or at the specified page
+	num_pages, err := num_pages_in_db_file(file)
 	if err != nil {
-		return errors.Wrap(err, "error getting file info")
+		return err
+	}
+	if pageIndex > num_pages {
+		// If the page is beyond the file size, write at the end of the file
+		pageIndex = num_pages
 	}
-	currentSize := fileInfo.Size()
 
-	// Determine where to write: at the end of the file or at the specified offset
-	if offset >= currentSize {
-		// If the offset is beyond the file size, write at the end of the file
-		_, err := file.Seek(0, io.SeekEnd)
+	// Stamp the checksum on every real page (free pages are just zeroes and carry no checksum)
+	if NativeEndian.Uint32(data[:4]) == PAGE_IDENTITY_NUM {
+		NativeEndian.PutUint32(data[page_checksum_offset:page_checksum_offset+4], page_checksum(data))
+	}
+
+	if file.pool != nil {
+		return file.pool.write_chunk(pageIndex, data, file)
+	}
+	return write_chunk_to_store(file, pageIndex, data)
+}
+
+func read_chunk_from_store(file *DBFile, pageIndex uint32) ([]byte, error) {
+	return file.store.Read_page(pageIndex)
+}
+func write_chunk_to_store(file *DBFile, pageIndex uint32, data []byte) error {
+	return file.store.Write_page(pageIndex, data)
+}
+
+// Locking the DB file against other processes
+var ErrDatabaseLocked = errors.New("the database file is locked by another process")
+
+const lock_retry_interval = 10 * time.Millisecond
+
+func lock_db_file(file *os.File, exclusive bool, timeout time.Duration) error {
+	// Writers take an exclusive lock and readers a shared one, retrying till the timeout runs out
+	deadline := time.Now().Add(timeout)
+	for {
+		locked, err := try_lock_file(file, exclusive)
 		if err != nil {
-			return errors.Wrap(err, "error seeking to end of file")
+			return errors.Wrap(err, fmt.Sprintf("error while trying to lock the db file %v", file.Name()))
 		}
-	} else {
-		// Otherwise, seek to the specified offset
-		_, err := file.Seek(offset, io.SeekStart)
-		if err != nil {
-			return errors.Wrap(err, fmt.Sprintf("error seeking to offset %d", offset))
+		if locked {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return errors.Wrap(ErrDatabaseLocked, fmt.Sprintf("couldn't lock the db file %v within %v", file.Name(), timeout))
 		}
+		time.Sleep(lock_retry_interval)
 	}
+}
 
-	// Ensure the data is exactly 4KB
-	if len(data) != PAGESIZE {
-		return errors.New(fmt.Sprintf("data must be exactly %d bytes", PAGESIZE))
-	}
+// Checksums of the pages
+type ErrCorruptPage struct {
+	Page_id   uint32
+	Page_type uint8
+	Expected  uint32 // Checksum stored in the page
+	Found     uint32 // Checksum computed from the bytes read
+}
 
-	// Write the data to the file
-	_, err = file.Write(data)
-	if err != nil {
-		return errors.Wrap(err, "error writing to chunk")
-	}
+func (e *ErrCorruptPage) Error() string {
+	return fmt.Sprintf("page %v (type %v) is corrupt: stored checksum 0x%08X, computed checksum 0x%08X", e.Page_id, e.Page_type, e.Expected, e.Found)
+}
+
+var page_checksum_zeroes [4]byte // Not a local of page_checksum, which would get allocated on every call
 
+func page_checksum(page []byte) uint32 {
+	// The checksum field is taken as zero while computing, so that the stored value doesn't affect the result
+	crc := crc32.Update(0, crc32c_table, page[:page_checksum_offset])
+	crc = crc32.Update(crc, crc32c_table, page_checksum_zeroes[:])
+	return crc32.Update(crc, crc32c_table, page[page_checksum_offset+4:])
+}
+
+func verify_page_checksum(page_id uint32, page []byte, page_size int) error {
+	if len(page) != page_size {
+		return errors.New(fmt.Sprintf("page %v is %v bytes long instead of %v bytes, cannot verify its checksum", page_id, len(page), page_size))
+	}
+	stored := NativeEndian.Uint32(page[page_checksum_offset : page_checksum_offset+4])
+	computed := page_checksum(page)
+	if stored != computed {
+		return errors.WithStack(&ErrCorruptPage{Page_id: page_id, Page_type: page[4], Expected: stored, Found: computed})
+	}
 	return nil
 }
 
 // Conversion between data and array of bytes
 func Data_to_Bytes(data any) []byte {
+	// The pages go through the hand written encoders (see page_codec.go), anything else through binary.Write
+	// A page comes out as long as its page size, which is known from the length of its slices
+	switch page := data.(type) {
+	case FileHeaderPage:
+		return encode_file_header_page(&page)
+	case *FileHeaderPage:
+		return encode_file_header_page(page)
+	case NodePage:
+		return encode_node_page(&page)
+	case *NodePage:
+		return encode_node_page(page)
+	case DataPage:
+		return encode_data_page(&page)
+	case *DataPage:
+		return encode_data_page(page)
+	case FreelistPage:
+		return encode_freelist_page(&page)
+	case *FreelistPage:
+		return encode_freelist_page(page)
+	}
 	buf := new(bytes.Buffer)
 	binary.Write(buf, NativeEndian, data)
 	return buf.Bytes()
 }
 
 /*Bytes_to_Data
-can be done with the code
+can be done with decode_file_header_page, decode_node_page, decode_data_page and decode_freelist_page for the pages (given the page_layout), or for anything else
 	buf := bytes.NewReader(ip)
 	binary.Read(buf, NativeEndian, op)
 */
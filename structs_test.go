@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func flip_byte(t *testing.T, store PageStore, page_id uint32, offset int) {
+	// Damages a page of the store behind the back of the db, like bit rot on the disk would
+	t.Helper()
+	buf, err := store.Read_page(page_id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := append([]byte(nil), buf...) // The store's own bytes must not be changed
+	page[offset] ^= 0xFF
+	err = store.Write_page(page_id, page)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCorruptPageDetected(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		pool_bytes int
+		page_type  string
+	}{
+		{"node no pool", 0, "Node"},
+		{"data no pool", 0, "Data"},
+		{"node pool", Default_buffer_pool_bytes, "Node"},
+		{"data pool", Default_buffer_pool_bytes, "Data"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			options := Default_connect_options
+			options.Buffer_pool_bytes = test.pool_bytes
+			store, _ := New_memory_page_store(DEFAULT_PAGESIZE)
+			file, file_header, err := Create_and_ConnectDB_with_store(store, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Few enough keys for the root to be the only node, with its values in its DataPage
+			for key := uint32(0); key < 50; key++ {
+				err = Insert(key, []byte("a value kept in the datapage"), file_header, file)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, _, root, _, err := ReadPage(file, file_header.Root_node_id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			page_id := file_header.Root_node_id
+			if test.page_type == "Data" {
+				page_id = root.Data_page_id
+			}
+			DisconnectDB(file, file_header)
+
+			flip_byte(t, store, page_id, DEFAULT_PAGESIZE/2)
+			file, file_header, err = ConnectDB_with_store(store, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer DisconnectDB(file, file_header)
+
+			_, _, err = Get(10, file_header, file)
+			var corrupt *ErrCorruptPage
+			if !errors.As(err, &corrupt) {
+				t.Fatalf("reading the damaged page gave %v instead of ErrCorruptPage", err)
+			}
+			if corrupt.Page_id != page_id || corrupt.Page_type != Page_type_ids[test.page_type] || corrupt.Expected == corrupt.Found {
+				t.Fatalf("ErrCorruptPage %+v, expected page %v of type %v", corrupt, page_id, Page_type_ids[test.page_type])
+			}
+		})
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	Offline vacuum of a db into a brand new, packed one (Vacuum and Vacuum_db, `go run . vacuum <db_name>`).
+
+	Instead of moving pages around inside the db file, the whole tree is written out again into an empty store:
+
+		File Header		->	pages 0 and 1, as always
+		internal nodes	->	right after, level by level from the root down, all next to each other
+		their DataPages	->	the chains of the internal nodes, in the same order (none in BPlus mode, they keep only keys)
+		leaves			->	in key order, each one followed by its own chain of DataPages
+
+	The values of every node are packed into its chain (in key order, each one into the first DataPage with room for
+	it), so no DataPage has any holes in it, and there are no free pages at all. The shape of the tree stays the same, only where everything
+	is kept changes, so the new db is simply a reorganised copy of the old one.
+
+	Once written, every key and value of the new db is checked against the old one (by walking both in key order).
+	Vacuum_db then puts the new file in place of the old one with a rename, so at any point there is either the old
+	file or the new one, complete. It holds the exclusive lock of the old file all along, till the rename (and the sync
+	of the directory) is done, so nothing else can be using the db while it runs (except on Windows, where the old file
+	has to be closed just before the rename).
+*/
+
+type vacuum_plan struct {
+	order          []uint32          // Old ids of the NodePages, in the order they are written (internal nodes first)
+	num_internal   int               // How many NodePages at the start of `order` are internal nodes
+	new_ids        map[uint32]uint32 // Old id of every NodePage -> its new id
+	data_ids       map[uint32]uint32 // Old id of every NodePage -> new id of the first DataPage of its chain
+	num_data_pages map[uint32]int
+	num_pages      uint32
+	data_size      uint64 // Total_data_size of the new db
+}
+
+// The values of one node packed into a chain of DataPages made in memory
+type packed_chain struct {
+	offsets []uint32 // Data refs of every value (in the order of the keys), as kept in the node
+	chain   *data_chain
+}
+
+func pack_node_values(np *NodePage, file_header *FileHeaderPage, file *DBFile) (*packed_chain, uint64, error) {
+
+	packed := &packed_chain{chain: &data_chain{in_memory: file.layout}}
+	if np.Keys_only != 0 {
+		packed.offsets = make([]uint32, np.Block_size)
+		return packed, 0, nil
+	}
+	err := packed.chain.add_page(nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var data_size uint64
+	source := new_data_chain(np.Data_page_id)
+	for i := 0; i < int(np.Block_size); i++ {
+		if np.Blocks[i].Offset&data_ref_inline != 0 {
+			// Stays right where it is, in the cell
+			data_size += uint64(np.Blocks[i].Offset &^ data_ref_inline)
+			packed.offsets = append(packed.offsets, np.Blocks[i].Offset)
+			continue
+		}
+
+		// Copied over as it is kept, so compressed values stay compressed
+		data, flags, err := source.get_value(np.Blocks[i].Offset, file)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, fmt.Sprintf("error while trying to read the data of the key %v", np.Blocks[i].Key))
+		}
+		value, err := decode_value(data, flags)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, fmt.Sprintf("error while trying to read the data of the key %v", np.Blocks[i].Key))
+		}
+		data_size += uint64(len(value))
+
+		ref, err := packed.chain.put_value(data, flags, nil, nil)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, fmt.Sprintf("error while trying to pack the data of the key %v", np.Blocks[i].Key))
+		}
+		packed.offsets = append(packed.offsets, ref)
+	}
+	return packed, data_size, nil
+}
+
+func plan_vacuum(file_header *FileHeaderPage, file *DBFile) (*vacuum_plan, error) {
+
+	plan := &vacuum_plan{
+		new_ids:        make(map[uint32]uint32),
+		data_ids:       make(map[uint32]uint32),
+		num_data_pages: make(map[uint32]int),
+		num_pages:      num_file_header_slots,
+	}
+	if file_header.Root_node_id == 0 {
+		return plan, nil
+	}
+
+	// Level by level, so that the last level is all the leaves from left to right (the tree is always balanced)
+	var internal, leaves []uint32
+	level := []uint32{file_header.Root_node_id}
+	for len(level) != 0 {
+		var next_level []uint32
+		for _, node_id := range level {
+			pt, _, np, _, err := ReadPage(file, node_id)
+			if err != nil {
+				return nil, err
+			}
+			if pt != Page_type_ids["Node"] {
+				return nil, errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node_id, pt))
+			}
+			chain, data_size, err := pack_node_values(np, file_header, file)
+			if err != nil {
+				return nil, errors.Wrap(err, fmt.Sprintf("error while trying to read the values of the nodepage %v", node_id))
+			}
+			plan.num_data_pages[node_id] = len(chain.chain.pages)
+			plan.data_size += data_size
+
+			if np.Children[0] == 0 {
+				leaves = append(leaves, node_id)
+				continue
+			}
+			internal = append(internal, node_id)
+			next_level = append(next_level, np.Children[:np.Block_size+1]...)
+		}
+		level = next_level
+	}
+
+	for _, node_id := range internal {
+		plan.new_ids[node_id] = plan.num_pages
+		plan.num_pages++
+	}
+	for _, node_id := range internal {
+		plan.data_ids[node_id] = plan.num_pages
+		plan.num_pages += uint32(plan.num_data_pages[node_id])
+	}
+	for _, node_id := range leaves {
+		plan.new_ids[node_id] = plan.num_pages
+		plan.data_ids[node_id] = plan.num_pages + 1
+		plan.num_pages += 1 + uint32(plan.num_data_pages[node_id])
+	}
+	plan.order = append(internal, leaves...)
+	plan.num_internal = len(internal)
+	return plan, nil
+}
+
+func write_vacuumed_node(node_id uint32, chain *packed_chain, plan *vacuum_plan, np *NodePage, dst *DBFile) error {
+
+	new_np := np.clone()
+	new_np.Data_page_id = plan.data_ids[node_id]
+	if np.Keys_only != 0 {
+		new_np.Data_page_id = 0
+	}
+	for i := 0; i < int(np.Block_size); i++ {
+		new_np.Blocks[i].Offset = chain.offsets[i]
+	}
+	for i := 0; i <= int(np.Block_size); i++ {
+		if np.Children[i] != 0 {
+			new_np.Children[i] = plan.new_ids[np.Children[i]]
+		}
+	}
+	if np.Right_link != 0 {
+		right_link, ok := plan.new_ids[np.Right_link]
+		if !ok {
+			return errors.New(fmt.Sprintf("the Right_link %v of the nodepage %v isn't in the tree", np.Right_link, node_id))
+		}
+		new_np.Right_link = right_link
+	}
+	if np.Left_link != 0 {
+		left_link, ok := plan.new_ids[np.Left_link]
+		if !ok {
+			return errors.New(fmt.Sprintf("the Left_link %v of the nodepage %v isn't in the tree", np.Left_link, node_id))
+		}
+		new_np.Left_link = left_link
+	}
+	return WriteChunk(dst, plan.new_ids[node_id], Data_to_Bytes(new_np))
+}
+
+func write_vacuumed_data_pages(node_id uint32, packed *packed_chain, plan *vacuum_plan, dst *DBFile) error {
+
+	first_id := plan.data_ids[node_id]
+	for i, dp := range packed.chain.pages {
+		dp.Parent_node_page = plan.new_ids[node_id]
+		if i+1 < len(packed.chain.pages) {
+			dp.Next_data_page = first_id + uint32(i) + 1
+		}
+		err := WriteChunk(dst, first_id+uint32(i), Data_to_Bytes(dp))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func write_vacuumed_tree(plan *vacuum_plan, file_header *FileHeaderPage, file *DBFile, dst *DBFile) error {
+	// The pages are written strictly in the order of their ids (WriteChunk only ever appends right at the end)
+
+	read_node := func(node_id uint32) (*NodePage, *packed_chain, error) {
+		pt, _, np, _, err := ReadPage(file, node_id)
+		if err != nil {
+			return nil, nil, err
+		}
+		if pt != Page_type_ids["Node"] {
+			return nil, nil, errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node_id, pt))
+		}
+		chain, _, err := pack_node_values(np, file_header, file)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, fmt.Sprintf("error while trying to read the values of the nodepage %v", node_id))
+		}
+		if len(chain.chain.pages) != plan.num_data_pages[node_id] {
+			return nil, nil, errors.New(fmt.Sprintf("the values of the nodepage %v changed while vacuuming", node_id))
+		}
+		return np, chain, nil
+	}
+
+	for i, node_id := range plan.order {
+		np, chain, err := read_node(node_id)
+		if err != nil {
+			return err
+		}
+		err = write_vacuumed_node(node_id, chain, plan, np, dst)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("error while trying to write the nodepage %v", node_id))
+		}
+		if i >= plan.num_internal {
+			err = write_vacuumed_data_pages(node_id, chain, plan, dst)
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("error while trying to write the datapages of the nodepage %v", node_id))
+			}
+		}
+		if i+1 == plan.num_internal {
+			// All the internal nodes are in, now their chains
+			for _, internal_id := range plan.order[:plan.num_internal] {
+				_, chain, err := read_node(internal_id)
+				if err != nil {
+					return err
+				}
+				err = write_vacuumed_data_pages(internal_id, chain, plan, dst)
+				if err != nil {
+					return errors.Wrap(err, fmt.Sprintf("error while trying to write the datapages of the nodepage %v", internal_id))
+				}
+			}
+		}
+	}
+
+	num_pages, err := num_pages_in_db_file(dst)
+	if err != nil {
+		return err
+	}
+	if num_pages != plan.num_pages {
+		return errors.New(fmt.Sprintf("wrote %v pages instead of the %v planned", num_pages, plan.num_pages))
+	}
+	return nil
+}
+
+func tree_digest(node_id uint32, crc uint32, count uint64, file_header *FileHeaderPage, file *DBFile) (uint32, uint64, error) {
+	// Checksum of every key and value under `node_id` in key order, along with how many there are
+
+	if node_id == 0 {
+		return crc, count, nil
+	}
+	pt, _, np, _, err := ReadPage(file, node_id)
+	if err != nil {
+		return 0, 0, err
+	}
+	if pt != Page_type_ids["Node"] {
+		return 0, 0, errors.New(fmt.Sprintf("read page %v isn't a nodepage. read page of type %v", node_id, pt))
+	}
+
+	var key_bytes, length_bytes [4]byte
+	for i := 0; i <= int(np.Block_size); i++ {
+		crc, count, err = tree_digest(np.Children[i], crc, count, file_header, file)
+		if err != nil {
+			return 0, 0, err
+		}
+		if i == int(np.Block_size) || np.Keys_only != 0 {
+			continue // The keys of B+ internal nodes are only separators, every key is in a leaf
+		}
+		data, err := read_node_value(np, i, file_header, file)
+		if err != nil {
+			return 0, 0, errors.Wrap(err, fmt.Sprintf("error while trying to read the data of the key %v", np.Blocks[i].Key))
+		}
+		NativeEndian.PutUint32(key_bytes[:], np.Blocks[i].Key)
+		crc = crc32.Update(crc, crc32c_table, key_bytes[:])
+		NativeEndian.PutUint32(length_bytes[:], uint32(len(data)))
+		crc = crc32.Update(crc, crc32c_table, length_bytes[:])
+		crc = crc32.Update(crc, crc32c_table, data)
+		count++
+	}
+	return crc, count, nil
+}
+
+func Vacuum(dst PageStore, file_header *FileHeaderPage, file *DBFile) error {
+	// Writes a packed copy of the db into `dst`, which has to be empty and of the same page size. `dst` is closed once
+	// done, like with Create_and_ConnectDB_with_store, and `file` is left as it is
+
+	file.lock.Lock()
+	defer file.lock.Unlock()
+
+	size, err := dst.Size()
+	if err == nil && size != 0 {
+		err = errors.New(fmt.Sprintf("the store to vacuum into isn't empty, it has %v bytes", size))
+	}
+	if err == nil && dst.Page_size() != file.layout.page_size {
+		err = errors.New(fmt.Sprintf("the store to vacuum into is made for a page size of %v but the db has %v", dst.Page_size(), file.layout.page_size))
+	}
+	if err != nil {
+		dst.Close()
+		return err
+	}
+
+	plan, err := plan_vacuum(file_header, file)
+	if err != nil {
+		dst.Close()
+		return errors.Wrap(err, "error while trying to plan the vacuum")
+	}
+
+	options := Default_connect_options
+	options.Tree_mode = file_header.Tree_mode
+	options.Inline_value_size = int(file_header.Inline_value_size)
+	options.Min_fill, options.Fill_factor, options.Lazy_rebalance = file.fill.min_fill, file.fill.fill_factor, file.fill.lazy_rebalance
+	options.Page_size = file.layout.page_size
+	options.Buffer_pool_bytes = 0 // Every page is written once and read back once, so a cache is of no use
+	dst_file, dst_header, err := Create_and_ConnectDB_with_store(dst, options)
+	if err != nil {
+		return errors.Wrap(err, "error while trying to make the db to vacuum into")
+	}
+
+	err = write_vacuumed_tree(plan, file_header, file, dst_file)
+	if err == nil {
+		dst_header.Root_node_id = plan.new_ids[file_header.Root_node_id]
+		dst_header.Total_pages = plan.num_pages
+		dst_header.Total_data_size = plan.data_size
+		err = Commit(dst_header, dst_file)
+	}
+	if err == nil {
+		err = verify_vacuum(file_header, file, dst_header, dst_file)
+	}
+	DisconnectDB(dst_file, dst_header)
+	return err
+}
+
+func verify_vacuum(file_header *FileHeaderPage, file *DBFile, dst_header *FileHeaderPage, dst_file *DBFile) error {
+
+	crc, count, err := tree_digest(file_header.Root_node_id, 0, 0, file_header, file)
+	if err != nil {
+		return errors.Wrap(err, "error while trying to read back the db being vacuumed")
+	}
+	dst_crc, dst_count, err := tree_digest(dst_header.Root_node_id, 0, 0, dst_header, dst_file)
+	if err != nil {
+		return errors.Wrap(err, "error while trying to read back the vacuumed db")
+	}
+	if crc != dst_crc || count != dst_count {
+		return errors.New(fmt.Sprintf("the vacuumed db doesn't match the original, it has %v keys (checksum 0x%X) instead of %v (checksum 0x%X)", dst_count, dst_crc, count, crc))
+	}
+	return nil
+}
+
+func Vacuum_db(db_name string, options ConnectOptions) error {
+	// Vacuums the db `db_name` into a new file next to it, which then replaces it
+
+	if options.Read_only {
+		return errors.Wrap(ErrReadOnly, "cannot vacuum the db")
+	}
+	file, file_header, err := ConnectDB_with_options(db_name, options)
+	if err != nil {
+		return err
+	}
+
+	db_path := db_file_path(db_name)
+	vacuum_path := db_path + ".vacuum"
+	err = os.Remove(vacuum_path) // Left behind by a vacuum which didn't finish
+	if err != nil && !os.IsNotExist(err) {
+		DisconnectDB(file, file_header)
+		return errors.Wrap(err, "error while trying to remove the old vacuum file")
+	}
+
+	dst, err := Open_file_page_store(vacuum_path, true, ConnectOptions{Lock_timeout: options.Lock_timeout, Page_size: file.layout.page_size})
+	if err == nil {
+		err = Vacuum(dst, file_header, file)
+	}
+	if err != nil {
+		DisconnectDB(file, file_header)
+		os.Remove(vacuum_path)
+		return errors.Wrap(err, fmt.Sprintf("error while trying to vacuum the db %v", db_name))
+	}
+
+	// The old file stays connected (and locked) till the new one is in its place, or someone could write to it in
+	// between, and have it all thrown away by the rename. Whoever was waiting for the lock finds the new file then (see
+	// open_locked_file). Windows won't rename over a file which is open, so there it has to be let go of first
+	if runtime.GOOS == "windows" {
+		DisconnectDB(file, file_header)
+	}
+	err = os.Rename(vacuum_path, db_path)
+	if err == nil {
+		err = sync_dir(db_path)
+	}
+	if runtime.GOOS != "windows" {
+		DisconnectDB(file, file_header)
+	}
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("error while trying to put the vacuumed db in place of %v", db_path))
+	}
+	return nil
+}
+
+func sync_dir(path string) error {
+	// The rename is only durable once the directory holding the file is synced. Windows can't sync a directory (and
+	// makes renames durable on its own)
+
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return errors.Wrap(err, "error while opening the directory of the db file")
+	}
+	err = dir.Sync()
+	dir.Close()
+	if err != nil {
+		return errors.Wrap(err, "error while syncing the directory of the db file")
+	}
+	return nil
+}
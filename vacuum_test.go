@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVacuumDbKeepsWritesWaitingForTheLock(t *testing.T) {
+	// Someone connecting while Vacuum_db runs has to wait for it, and then write to the vacuumed file, not the old one
+
+	const db_name = "test_vacuum_lock"
+	err := os.MkdirAll("./databases", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(db_file_path(db_name))
+	options := Default_connect_options
+	options.Lock_timeout = 20 * time.Second
+
+	for round := 0; round < 5; round++ {
+		file, file_header, err := Create_and_ConnectDB_with_options(db_name, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key := uint32(0); key < 3000; key++ {
+			err = Insert(key, []byte("some value"), file_header, file)
+			if err == nil && key%2 == 0 {
+				err = Delete(key, file_header, file)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		DisconnectDB(file, file_header)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := Vacuum_db(db_name, options); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			time.Sleep(time.Duration(round) * time.Millisecond)
+			file, file_header, err := ConnectDB_with_options(db_name, options)
+			if err == nil {
+				err = Insert(100000, []byte("written while vacuuming"), file_header, file)
+				DisconnectDB(file, file_header)
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+		wg.Wait()
+
+		file, file_header, err = ConnectDB_with_options(db_name, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, found, err := Get(100000, file_header, file)
+		DisconnectDB(file, file_header)
+		if err != nil || !found {
+			t.Fatalf("round %v: the key written while vacuuming is gone (err = %v)", round, err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	Compression of the values kept in the DataPages (ConnectOptions.Compress_values).
+
+	With compression on, values are run through flate before they are put in a DataPage, and if that made them
+	smaller, the compressed bytes are kept instead, with DATA_RECORD_COMPRESSED set in the flags of the record (see
+	data_in_page_handling.go). Values which don't get any smaller (and the tiny ones, which never do) are kept as they
+	are, so turning it on never costs any space.
+
+	Reading always looks at the flag, whatever the option is, so a db can be connected to with and without it. The
+	Length of the slot is of the bytes kept, so everything which only moves the records around (like the compaction
+	of the DataPages) doesn't care whether they are compressed or not. Total_data_size stays the size of the values as
+	they were given.
+*/
+
+const min_compressed_value_size = 64 // flate (at BestSpeed) just stores anything shorter as it is, so it never gets smaller
+
+var flate_writers = sync.Pool{New: func() any {
+	writer, _ := flate.NewWriter(nil, flate.BestSpeed) // Can't fail with a valid level
+	return writer
+}}
+
+var flate_readers = sync.Pool{New: func() any {
+	return flate.NewReader(bytes.NewReader(nil))
+}}
+
+func compress_value(data []byte) []byte {
+	var buf bytes.Buffer
+	writer := flate_writers.Get().(*flate.Writer)
+	writer.Reset(&buf)
+	writer.Write(data) // Writing to a bytes.Buffer doesn't fail
+	writer.Close()
+	flate_writers.Put(writer)
+	return buf.Bytes()
+}
+
+func decompress_value(data []byte) ([]byte, error) {
+	reader := flate_readers.Get().(io.ReadCloser)
+	defer flate_readers.Put(reader)
+
+	reader.(flate.Resetter).Reset(bytes.NewReader(data), nil)
+	value, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "error while trying to decompress the data")
+	}
+	return value, nil
+}
+
+func encode_value(data []byte, file *DBFile) ([]byte, uint8) {
+	// The value as it is put in the DataPages, along with the flags for its record
+
+	if !file.compress_values || len(data) < min_compressed_value_size {
+		return data, 0
+	}
+	compressed := compress_value(data)
+	if len(compressed) >= len(data) {
+		return data, 0
+	}
+	return compressed, DATA_RECORD_COMPRESSED
+}
+
+func decode_value(data []byte, flags uint8) ([]byte, error) {
+	// The value back from what encode_value made of it
+
+	if flags&DATA_RECORD_COMPRESSED == 0 {
+		return data, nil
+	}
+	return decompress_value(data)
+}